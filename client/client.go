@@ -0,0 +1,304 @@
+// Package client calls the HTTP API of the shortener: links are shortened, resolved, listed, deleted
+// and inspected through typed methods instead of hand-written requests
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultTimeout     = 30 * time.Second
+	defaultMaxAttempts = 4
+	defaultBaseDelay   = 200 * time.Millisecond
+	defaultMaxDelay    = 10 * time.Second
+
+	// maxErrorBody bounds the part of an error response kept in Error
+	maxErrorBody = 4 << 10
+
+	userCookieName       = "user_id"
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+var (
+	// ErrNotFound is matched by errors of requests to links which do not exist or are owned by someone else
+	ErrNotFound = errors.New("link is not found")
+	// ErrDeleted is matched by errors of requests to deleted links
+	ErrDeleted = errors.New("link is deleted")
+)
+
+// Error is an unsuccessful response of the API
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("shortener: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is makes `404 Not Found` match ErrNotFound and `410 Gone` match ErrDeleted
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrDeleted:
+		return e.StatusCode == http.StatusGone
+	}
+	return false
+}
+
+// Client calls the API of a shortener; it is safe for concurrent use
+type Client struct {
+	baseURL     *url.URL
+	httpClient  *http.Client
+	apiKey      string
+	userCookie  string
+	gzip        bool
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+}
+
+// Option customizes the client built by New
+type Option func(*Client)
+
+// WithHTTPClient sends requests with the HTTP client; by default a client with a cookie jar is used,
+// so that the user issued by the first request creating links owns the following ones
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithAPIKey authenticates requests with the API key token, taking precedence over cookies
+func WithAPIKey(token string) Option {
+	return func(c *Client) {
+		c.apiKey = token
+	}
+}
+
+// WithUserCookie authenticates requests as the user of a signed `user_id` cookie issued by the server earlier
+func WithUserCookie(value string) Option {
+	return func(c *Client) {
+		c.userCookie = value
+	}
+}
+
+// WithGzip compresses request bodies, which the server accepts with `Content-Encoding: gzip`
+func WithGzip() Option {
+	return func(c *Client) {
+		c.gzip = true
+	}
+}
+
+// WithRetries sets how many times a request failing with a network error, `429 Too Many Requests`
+// or a 5xx status is attempted, and the bounds of the exponential backoff between attempts;
+// a Retry-After header of the response takes precedence. One attempt disables retries
+func WithRetries(maxAttempts int, baseDelay, maxDelay time.Duration) Option {
+	return func(c *Client) {
+		c.maxAttempts = maxAttempts
+		c.baseDelay = baseDelay
+		c.maxDelay = maxDelay
+	}
+}
+
+// New makes a client of the shortener serving at the base URL, e.g. `https://short.example`
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return nil, fmt.Errorf("shortener: base URL %q must be an absolute URL", baseURL)
+	}
+	c := &Client{
+		baseURL:     u,
+		maxAttempts: defaultMaxAttempts,
+		baseDelay:   defaultBaseDelay,
+		maxDelay:    defaultMaxDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.httpClient == nil {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			return nil, err
+		}
+		c.httpClient = &http.Client{Timeout: defaultTimeout, Jar: jar}
+	}
+	if c.maxAttempts < 1 {
+		c.maxAttempts = 1
+	}
+	return c, nil
+}
+
+// request is a call of the API which can be sent again
+type request struct {
+	method      string
+	path        string
+	contentType string
+	body        []byte
+	// redirect returns redirect responses instead of following them
+	redirect bool
+}
+
+// do sends the request, retrying it as configured, and returns a successful response;
+// other responses are turned into an Error
+func (c *Client) do(ctx context.Context, req request) (*http.Response, error) {
+	body := req.body
+	if c.gzip && body != nil {
+		var err error
+		if body, err = compress(body); err != nil {
+			return nil, err
+		}
+	}
+	// retried creations must not create links twice, which the server prevents by the key; it ignores the keys
+	// of callers without a user yet, i.e. without a cookie or an API key, whose retries may create links twice
+	var idempotencyKey string
+	if req.method == http.MethodPost {
+		idempotencyKey = newIdempotencyKey()
+	}
+
+	for attempt := 1; ; attempt++ {
+		resp, err := c.send(ctx, req, body, idempotencyKey)
+		if err == nil && resp.StatusCode < http.StatusBadRequest {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			if resp != nil {
+				drain(resp)
+			}
+			return nil, ctx.Err()
+		}
+		var retryAfter time.Duration
+		if err == nil {
+			if !retryable(resp.StatusCode) || attempt >= c.maxAttempts {
+				return nil, responseError(resp)
+			}
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+			drain(resp)
+		} else if attempt >= c.maxAttempts {
+			return nil, err
+		}
+
+		delay := c.backoff(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, req request, body []byte, idempotencyKey string) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, c.baseURL.String()+req.path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if req.contentType != "" {
+		httpReq.Header.Set("Content-Type", req.contentType)
+	}
+	if c.gzip && body != nil {
+		httpReq.Header.Set("Content-Encoding", "gzip")
+	}
+	if idempotencyKey != "" {
+		httpReq.Header.Set(idempotencyKeyHeader, idempotencyKey)
+	}
+	if c.apiKey != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	if c.userCookie != "" {
+		httpReq.AddCookie(&http.Cookie{Name: userCookieName, Value: c.userCookie})
+	}
+
+	httpClient := c.httpClient
+	if req.redirect {
+		noRedirects := *c.httpClient
+		noRedirects.CheckRedirect = func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		httpClient = &noRedirects
+	}
+	return httpClient.Do(httpReq)
+}
+
+// backoff doubles the delay with every attempt up to the maximum, with a jitter of 20%
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := float64(c.baseDelay) * math.Pow(2, float64(attempt-1))
+	if delay > float64(c.maxDelay) {
+		delay = float64(c.maxDelay)
+	}
+	return time.Duration(delay * (0.8 + 0.4*mathrand.Float64()))
+}
+
+func retryable(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+// parseRetryAfter accepts both the seconds and the HTTP date forms of the header
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return time.Until(at)
+	}
+	return 0
+}
+
+func responseError(resp *http.Response) error {
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+}
+
+// drain reads the rest of the body, so that the connection can be reused
+func drain(resp *http.Response) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, maxErrorBody))
+	_ = resp.Body.Close()
+}
+
+func compress(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(body); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand is unavailable: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
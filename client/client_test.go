@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/api"
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+// newServer serves the API with short URLs pointing to the server itself
+func newServer(t *testing.T, keys storage.KeyStorage, wrap func(http.Handler) http.Handler) *httptest.Server {
+	var handler http.Handler
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	h := api.NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), ts.URL)
+	handler = api.NewRouter(h, api.WithAuthenticator(auth.NewAuthenticator(keys, []byte("secret"))))
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	return ts
+}
+
+func idOf(shortURL string) string {
+	return shortURL[strings.LastIndex(shortURL, "/")+1:]
+}
+
+func TestLinkLifecycle(t *testing.T) {
+	ctx := context.Background()
+	ts := newServer(t, nil, nil)
+	c, err := New(ts.URL, WithGzip())
+	require.NoError(t, err)
+
+	shortURL, err := c.Shorten(ctx, "https://go.dev")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(shortURL, ts.URL+"/"))
+	id := idOf(shortURL)
+
+	results, err := c.ShortenBatch(ctx, []BatchItem{{CorrelationID: "a", OriginalURL: "https://ya.ru"}})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "a", results[0].CorrelationID)
+
+	destination, err := c.Resolve(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, "https://go.dev", destination)
+
+	links, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []Link{{ShortURL: shortURL, OriginalURL: "https://go.dev"}, {ShortURL: results[0].ShortURL, OriginalURL: "https://ya.ru"}}, links,
+		"the cookie issued by the first request is kept")
+
+	stats, err := c.Stats(ctx, id)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Clicks)
+
+	require.NoError(t, c.Delete(ctx, id))
+	_, err = c.Resolve(ctx, id)
+	assert.ErrorIs(t, err, ErrDeleted)
+	_, err = c.Resolve(ctx, "missing")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	other, err := New(ts.URL)
+	require.NoError(t, err)
+	_, err = other.List(ctx)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode, "anonymous callers have no links")
+	otherURL, err := other.Shorten(ctx, "https://example.com")
+	require.NoError(t, err)
+	_, err = other.Stats(ctx, id)
+	assert.ErrorIs(t, err, ErrNotFound)
+	links, err = other.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Link{{ShortURL: otherURL, OriginalURL: "https://example.com"}}, links)
+
+	_, err = c.ShortenBatch(ctx, []BatchItem{{CorrelationID: "a", OriginalURL: "not a url"}})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func TestAPIKey(t *testing.T) {
+	ctx := context.Background()
+	keys := storage.NewMemoryKeyStorage()
+	token, key, err := auth.CreateKey(ctx, keys, "ci", "", []auth.Scope{auth.ScopeLinksCreate, auth.ScopeLinksRead})
+	require.NoError(t, err)
+	ts := newServer(t, keys, nil)
+
+	c, err := New(ts.URL, WithAPIKey(token))
+	require.NoError(t, err)
+	shortURL, err := c.Shorten(ctx, "https://go.dev")
+	require.NoError(t, err)
+	links, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Link{{ShortURL: shortURL, OriginalURL: "https://go.dev"}}, links, "links are owned by %s", key.UserID)
+
+	err = c.Delete(ctx, idOf(shortURL))
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusForbidden, apiErr.StatusCode)
+
+	c, err = New(ts.URL, WithAPIKey("invalid"))
+	require.NoError(t, err)
+	_, err = c.Shorten(ctx, "https://go.dev")
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusUnauthorized, apiErr.StatusCode)
+}
+
+func TestUserCookie(t *testing.T) {
+	ctx := context.Background()
+	ts := newServer(t, nil, nil)
+	cookie := auth.NewAuthenticator(nil, []byte("secret")).SignUserID("user")
+
+	c, err := New(ts.URL, WithUserCookie(cookie))
+	require.NoError(t, err)
+	shortURL, err := c.Shorten(ctx, "https://go.dev")
+	require.NoError(t, err)
+
+	c, err = New(ts.URL, WithUserCookie(cookie))
+	require.NoError(t, err)
+	links, err := c.List(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []Link{{ShortURL: shortURL, OriginalURL: "https://go.dev"}}, links)
+}
+
+func TestRetries(t *testing.T) {
+	ctx := context.Background()
+	var attempts int32
+	var keys []string
+	failFirst := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			keys = append(keys, r.Header.Get("Idempotency-Key"))
+			switch atomic.AddInt32(&attempts, 1) {
+			case 1:
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			case 2:
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "slow down", http.StatusTooManyRequests)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+	ts := newServer(t, nil, failFirst)
+
+	c, err := New(ts.URL, WithRetries(3, time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	start := time.Now()
+	_, err = c.Shorten(ctx, "https://go.dev")
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), attempts)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second, "Retry-After is honored")
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, []string{keys[0], keys[0], keys[0]}, keys, "retries reuse the idempotency key")
+
+	atomic.StoreInt32(&attempts, 0)
+	c, err = New(ts.URL, WithRetries(1, time.Millisecond, time.Millisecond))
+	require.NoError(t, err)
+	_, err = c.Shorten(ctx, "https://go.dev")
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, int32(1), attempts)
+}
+
+func TestCancellation(t *testing.T) {
+	ts := newServer(t, nil, func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		})
+	})
+	c, err := New(ts.URL, WithRetries(10, time.Hour, time.Hour))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = c.Shorten(ctx, "https://go.dev")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Less(t, time.Since(start), time.Second, "backoff is interrupted")
+}
+
+func TestNew(t *testing.T) {
+	_, err := New("localhost:8080")
+	assert.Error(t, err)
+	c, err := New("http://localhost:8080/")
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080", c.baseURL.String())
+}
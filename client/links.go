@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ShortenRequest is a link to create; only URL is required
+type ShortenRequest struct {
+	URL string `json:"url"`
+	// Domain is one of the domains configured on the server; the one of the base URL by default
+	Domain string `json:"domain,omitempty"`
+	// Interstitial shows a warning page instead of redirecting to external destinations
+	Interstitial bool `json:"interstitial,omitempty"`
+	// PassQuery merges the query of visits into the destination: link, request or append
+	PassQuery string `json:"pass_query,omitempty"`
+	// PassPath appends the path following the ID in visits to the destination
+	PassPath bool `json:"pass_path,omitempty"`
+	// Variants split visitors across weighted destinations
+	Variants []Variant `json:"variants,omitempty"`
+	// QR asks for the URL of the QR code of the link
+	QR bool `json:"qr,omitempty"`
+}
+
+// ShortenResponse is a created link
+type ShortenResponse struct {
+	ShortURL string `json:"result"`
+	QR       string `json:"qr,omitempty"`
+}
+
+// Variant is one of the weighted destinations of a link
+type Variant struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+}
+
+// BatchItem is a URL to shorten in a batch; the correlation ID matches it with its result
+type BatchItem struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+}
+
+// BatchResult is a URL shortened in a batch
+type BatchResult struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
+}
+
+// Link is a link of the caller
+type Link struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+// Stats are the click statistics of a link
+type Stats struct {
+	ID          string         `json:"id"`
+	ShortURL    string         `json:"short_url"`
+	OriginalURL string         `json:"original_url"`
+	CreatedAt   time.Time      `json:"created_at"`
+	Clicks      int64          `json:"clicks"`
+	Variants    []VariantStats `json:"variants,omitempty"`
+}
+
+// VariantStats are the clicks served by a variant
+type VariantStats struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+	Clicks      int64  `json:"clicks"`
+}
+
+// Shorten creates a link to the URL and returns its short URL
+func (c *Client) Shorten(ctx context.Context, originalURL string) (string, error) {
+	resp, err := c.ShortenLink(ctx, ShortenRequest{URL: originalURL})
+	return resp.ShortURL, err
+}
+
+// ShortenLink creates a link with options
+func (c *Client) ShortenLink(ctx context.Context, req ShortenRequest) (ShortenResponse, error) {
+	var resp ShortenResponse
+	err := c.doJSON(ctx, http.MethodPost, "/api/shorten", req, &resp)
+	return resp, err
+}
+
+// ShortenBatch creates links to all the URLs at once; none is created if any of them is invalid
+func (c *Client) ShortenBatch(ctx context.Context, items []BatchItem) ([]BatchResult, error) {
+	var results []BatchResult
+	err := c.doJSON(ctx, http.MethodPost, "/api/shorten/batch", items, &results)
+	return results, err
+}
+
+// Resolve returns the destination the link with the ID redirects to, which counts as a click.
+// It fails with ErrNotFound or ErrDeleted when the link cannot be followed
+func (c *Client) Resolve(ctx context.Context, id string) (string, error) {
+	resp, err := c.do(ctx, request{method: http.MethodGet, path: "/" + url.PathEscape(id), redirect: true})
+	if err != nil {
+		return "", err
+	}
+	drain(resp)
+	location := resp.Header.Get("Location")
+	if resp.StatusCode < http.StatusMultipleChoices {
+		// interstitial links show a page instead
+		return "", fmt.Errorf("shortener: link %s does not redirect", id)
+	}
+	// unknown IDs are redirected nowhere
+	if location == "" {
+		return "", &Error{StatusCode: http.StatusNotFound, Message: ErrNotFound.Error()}
+	}
+	return location, nil
+}
+
+// List returns the links of the caller which are not deleted
+func (c *Client) List(ctx context.Context) ([]Link, error) {
+	links := []Link{}
+	err := c.doJSON(ctx, http.MethodGet, "/api/user/urls", nil, &links)
+	return links, err
+}
+
+// Delete deletes the links of the caller with the IDs; IDs of links owned by someone else are ignored
+func (c *Client) Delete(ctx context.Context, ids ...string) error {
+	return c.doJSON(ctx, http.MethodDelete, "/api/user/urls", ids, nil)
+}
+
+// Stats returns the click statistics of a link of the caller; it fails with ErrNotFound for links of others
+func (c *Client) Stats(ctx context.Context, id string) (Stats, error) {
+	var stats Stats
+	err := c.doJSON(ctx, http.MethodGet, "/api/stats/"+url.PathEscape(id), nil, &stats)
+	return stats, err
+}
+
+// doJSON sends the value as a JSON body, if any, and decodes a JSON response into the result, if any;
+// `204 No Content` leaves the result as is
+func (c *Client) doJSON(ctx context.Context, method, path string, value interface{}, result interface{}) error {
+	req := request{method: method, path: path}
+	if value != nil {
+		body, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		req.body = body
+		req.contentType = "application/json"
+	}
+	resp, err := c.do(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer drain(resp)
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("shortener: could not decode %s %s response: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const apiKeyUsage = `usage:
+  shortener [flags] apikey create -name NAME -scopes SCOPES [-user USER_ID]
+  shortener [flags] apikey list
+  shortener [flags] apikey revoke ID`
+
+// runAPIKeyCommand manages API keys in the key storage of the configured file storage
+func runAPIKeyCommand(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	keysPath := cfg.apiKeysPath()
+	if keysPath == "" {
+		return errors.New("API keys require a file storage, set `FILE_STORAGE_PATH` or `API_KEYS_PATH`")
+	}
+	if len(args) == 0 {
+		return errors.New(apiKeyUsage)
+	}
+	keys := storage.NewFileKeyStorage(keysPath)
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		fs.SetOutput(out)
+		name := fs.String("name", "", "human-readable name of the key")
+		userID := fs.String("user", "", "ID of the user owning the links created with the key; a new user by default")
+		scopes := fs.String("scopes", string(auth.ScopeLinksCreate), "comma-separated scopes: "+joinScopes(auth.KeyScopes))
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		parsedScopes, err := auth.ParseScopes(*scopes)
+		if err != nil {
+			return err
+		}
+		token, key, err := auth.CreateKey(ctx, keys, *name, *userID, parsedScopes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "id:     %s\nuser:   %s\nscopes: %s\ntoken:  %s\n", key.ID, key.UserID, strings.Join(key.Scopes, ","), token)
+		fmt.Fprintln(out, "the token is shown only once, store it securely")
+		return nil
+	case "list":
+		w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tUSER\tSCOPES\tCREATED\tREVOKED")
+		for _, key := range keys.ListKeys(ctx) {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\n",
+				key.ID, key.Name, key.UserID, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), key.Revoked)
+		}
+		return w.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return errors.New(apiKeyUsage)
+		}
+		revoked, err := keys.RevokeKey(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return fmt.Errorf("API key %q is not found", args[1])
+		}
+		fmt.Fprintf(out, "API key %s is revoked\n", args[1])
+		return nil
+	}
+	return errors.New(apiKeyUsage)
+}
+
+func joinScopes(scopes []auth.Scope) string {
+	names := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		names = append(names, string(scope))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/api"
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/bulk"
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const usage = `usage:
+  shortener [flags] [serve]
+  shortener [flags] shorten [-user USER_ID] [-domain DOMAIN] [-alias ALIAS] [-o text|json] URL
+  shortener [flags] resolve [-domain DOMAIN] [-o text|json] ID
+  shortener [flags] export [-user USER_ID] [-format csv|ndjson] [-out FILE]
+  shortener [flags] import [-user USER_ID] [-format csv|ndjson] [-o text|json] FILE|-
+  shortener [flags] compact [-purge-deleted] [-o text|json]
+  shortener [flags] verify [-o text|json]
+  shortener [flags] apikey ...
+
+all commands but serve work on the file storage directly and refuse to run while the server uses it,
+but verify, which only reads it`
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var errProblemsFound = errors.New("the file storage has problems")
+
+// runCommand runs an operator command against the configured file storage
+func runCommand(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(usage)
+	}
+	if cfg.FileStoragePath == "" {
+		return errors.New("the command requires a file storage, set `FILE_STORAGE_PATH` or -f")
+	}
+	var run func() error
+	switch args[0] {
+	case "shorten":
+		run = func() error { return runShorten(ctx, cfg, args[1:], out) }
+	case "resolve":
+		run = func() error { return runResolve(ctx, cfg, args[1:], out) }
+	case "export":
+		run = func() error { return runExport(ctx, cfg, args[1:], out) }
+	case "import":
+		run = func() error { return runImport(ctx, cfg, args[1:], out) }
+	case "compact":
+		run = func() error { return runCompact(cfg, args[1:], out) }
+	case "verify":
+		return runVerify(cfg, args[1:], out)
+	default:
+		return errors.New(usage)
+	}
+	// opening the log starts a new segment, so even reading commands must not run beside the server
+	lock, err := storage.LockLog(cfg.FileStoragePath)
+	if err != nil {
+		return fmt.Errorf("stop the server first: %w", err)
+	}
+	defer lock.Close()
+	return run()
+}
+
+// commandFlags is the flag set of a command with the -o flag choosing its output
+func commandFlags(name string, out io.Writer) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	output := fs.String("o", outputText, "output format: text or json")
+	return fs, output
+}
+
+func parseFlags(fs *flag.FlagSet, output *string, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *output != outputText && *output != outputJSON {
+		return fmt.Errorf("unknown output format %q, expected %s or %s", *output, outputText, outputJSON)
+	}
+	return nil
+}
+
+// writeOutput writes the value as indented JSON or as text written by the function
+func writeOutput(out io.Writer, output string, value interface{}, text func(w io.Writer) error) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(value)
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if err := text(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// openStorage opens the file storage with the service and the handler building short URLs on top of it
+func openStorage(cfg Config) (*storage.FileStorage, *service.ShorteningService, *api.RequestHandler) {
+	store := storage.NewFileStorage(cfg.FileStoragePath, storage.WithSegmentSize(cfg.FileSegmentSize))
+	shorteningService := service.NewShorteningService(store)
+	return store, shorteningService, api.NewRequestHandler(shorteningService, cfg.BaseURL, api.WithDomains(cfg.Domains))
+}
+
+func lookupDomain(handler *api.RequestHandler, domain string) (string, error) {
+	if domain == "" {
+		return "", nil
+	}
+	found, ok := handler.LookupDomain(domain)
+	if !ok {
+		return "", fmt.Errorf("unknown domain %q, set `DOMAINS`", domain)
+	}
+	return found, nil
+}
+
+type shortened struct {
+	bulk.Record
+	UserID string `json:"user_id"`
+}
+
+func runShorten(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	fs, output := commandFlags("shorten", out)
+	userID := fs.String("user", "", "ID of the user owning the link; a new user by default")
+	domain := fs.String("domain", "", "domain to create the link under; the primary one by default")
+	alias := fs.String("alias", "", "ID of the link; a generated one by default")
+	if err := parseFlags(fs, output, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	store, shorteningService, handler := openStorage(cfg)
+	defer store.Close()
+	linkDomain, err := lookupDomain(handler, *domain)
+	if err != nil {
+		return err
+	}
+	if *userID == "" {
+		*userID = auth.NewUserID()
+	}
+
+	if *alias != "" {
+		if _, taken := shorteningService.Preview(ctx, linkDomain, *alias); taken {
+			return fmt.Errorf("alias %q is taken", *alias)
+		}
+	}
+	link := storage.Link{UserID: *userID, Domain: linkDomain, URL: fs.Arg(0)}
+	id, _, err := shorteningService.Import(ctx, link, *alias)
+	if err != nil {
+		return err
+	}
+	created, _ := shorteningService.Preview(ctx, linkDomain, id)
+	result := shortened{Record: handler.ExportRecord(created), UserID: created.UserID}
+	return writeOutput(out, *output, result, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "short url:\t%s\nuser:\t%s\n", result.ShortURL, result.UserID)
+		return err
+	})
+}
+
+type resolved struct {
+	bulk.Record
+	UserID  string `json:"user_id"`
+	Deleted bool   `json:"deleted"`
+}
+
+func runResolve(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	fs, output := commandFlags("resolve", out)
+	domain := fs.String("domain", "", "domain of the link; the primary one by default")
+	if err := parseFlags(fs, output, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	store, shorteningService, handler := openStorage(cfg)
+	defer store.Close()
+	linkDomain, err := lookupDomain(handler, *domain)
+	if err != nil {
+		return err
+	}
+
+	// Preview does not count a click
+	link, ok := shorteningService.Preview(ctx, linkDomain, fs.Arg(0))
+	if !ok {
+		return fmt.Errorf("link %q is not found", fs.Arg(0))
+	}
+	result := resolved{Record: handler.ExportRecord(link), UserID: link.UserID, Deleted: link.Deleted}
+	return writeOutput(out, *output, result, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "short url:\t%s\noriginal url:\t%s\nuser:\t%s\ncreated:\t%s\nclicks:\t%d\ndeleted:\t%t\n",
+			result.ShortURL, result.OriginalURL, result.UserID, result.CreatedAt.Format(time.RFC3339), result.Clicks, result.Deleted)
+		return err
+	})
+}
+
+func runExport(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(out)
+	userID := fs.String("user", "", "export the links of the user only; all links by default")
+	format := fs.String("format", bulk.FormatCSV, "format of the export: csv or ndjson")
+	path := fs.String("out", "", "file to write the export to; the standard output by default")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := bulk.ValidateFormat(*format); err != nil {
+		return err
+	}
+	store, _, handler := openStorage(cfg)
+	defer store.Close()
+
+	var links []storage.Link
+	if *userID != "" {
+		links = store.GetByUser(ctx, *userID)
+	} else {
+		for _, link := range store.Links(ctx) {
+			if !link.Deleted {
+				links = append(links, link)
+			}
+		}
+	}
+	storage.SortLinks(links)
+
+	w := out
+	var file *os.File
+	if *path != "" {
+		var err error
+		if file, err = os.Create(*path); err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	writer, err := bulk.NewWriter(w, *format)
+	for i := 0; err == nil && i < len(links); i++ {
+		err = writer.Write(handler.ExportRecord(links[i]))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil && file != nil {
+		err = file.Close()
+	}
+	return err
+}
+
+func runImport(ctx context.Context, cfg Config, args []string, out io.Writer) error {
+	fs, output := commandFlags("import", out)
+	userID := fs.String("user", "", "ID of the user owning the links; a new user by default")
+	format := fs.String("format", "", "format of the file: csv or ndjson; taken from the file extension by default")
+	if err := parseFlags(fs, output, args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New(usage)
+	}
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+		if *format == "jsonl" {
+			*format = bulk.FormatNDJSON
+		}
+	}
+	if err := bulk.ValidateFormat(*format); err != nil {
+		return err
+	}
+	in := io.Reader(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	store, shorteningService, handler := openStorage(cfg)
+	defer store.Close()
+	if *userID == "" {
+		*userID = auth.NewUserID()
+	}
+
+	report := &bulk.Report{}
+	err := bulk.Read(in, *format, func(row int, value bulk.Row, err error) {
+		if err == nil {
+			value.Domain, err = lookupDomain(handler, value.Domain)
+		}
+		if err != nil {
+			report.Fail(row, err)
+			return
+		}
+		link := storage.Link{UserID: *userID, Domain: value.Domain, URL: value.URL}
+		id, kept, err := shorteningService.Import(ctx, link, value.Alias)
+		if err != nil {
+			report.Fail(row, err)
+			return
+		}
+		if value.Alias != "" && !kept {
+			report.Renamed(row, value.Alias, handler.ShortURL(value.Domain, id))
+			return
+		}
+		report.Imported++
+	})
+	if err != nil {
+		report.Error = err.Error()
+	}
+	printErr := writeOutput(out, *output, report, func(w io.Writer) error {
+		fmt.Fprintf(w, "imported:\t%d\nfailed:\t%d\nuser:\t%s\n", report.Imported, report.Failed, *userID)
+		for _, row := range report.Rows {
+			if row.Error != "" {
+				fmt.Fprintf(w, "row %d:\t%s\n", row.Row, row.Error)
+			} else {
+				fmt.Fprintf(w, "row %d:\talias %s is taken, imported as %s\n", row.Row, row.Alias, row.ShortURL)
+			}
+		}
+		if report.Truncated {
+			fmt.Fprintln(w, "...")
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return printErr
+}
+
+func runCompact(cfg Config, args []string, out io.Writer) error {
+	fs, output := commandFlags("compact", out)
+	purgeDeleted := fs.Bool("purge-deleted", false, "drop deleted links, so that their IDs can be taken again")
+	if err := parseFlags(fs, output, args); err != nil {
+		return err
+	}
+	stats, err := storage.CompactFile(cfg.FileStoragePath, *purgeDeleted)
+	if err != nil {
+		return err
+	}
+	return writeOutput(out, *output, stats, func(w io.Writer) error {
+		_, err := fmt.Fprintf(w, "records:\t%d\nlinks:\t%d\npurged:\t%d\n", stats.Records, stats.Links, stats.Purged)
+		return err
+	})
+}
+
+// runVerify fails with errProblemsFound when the log has problems, after printing them
+func runVerify(cfg Config, args []string, out io.Writer) error {
+	fs, output := commandFlags("verify", out)
+	if err := parseFlags(fs, output, args); err != nil {
+		return err
+	}
+	report, err := storage.VerifyFile(cfg.FileStoragePath)
+	if err != nil {
+		return err
+	}
+	err = writeOutput(out, *output, report, func(w io.Writer) error {
+		fmt.Fprintf(w, "records:\t%d\nlinks:\t%d\ndeleted:\t%d\nproblems:\t%d\n", report.Records, report.Links, report.Deleted, len(report.Problems))
+		for _, problem := range report.Problems {
+			if problem.Segment != "" {
+				fmt.Fprintf(w, "segment %s line %d:\t%s\n", problem.Segment, problem.Line, problem.Message)
+			} else {
+				fmt.Fprintf(w, "line %d:\t%s\n", problem.Line, problem.Message)
+			}
+		}
+		return nil
+	})
+	if err == nil && len(report.Problems) > 0 {
+		err = errProblemsFound
+	}
+	return err
+}
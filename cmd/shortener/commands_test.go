@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+func TestRunCommand(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{BaseURL: "http://localhost:8080", FileStoragePath: filepath.Join(dir, "links.log")}
+	csvPath := filepath.Join(dir, "links.csv")
+	require.NoError(t, os.WriteFile(csvPath, []byte("url,alias\nhttps://go.dev,go\nnot a url,\n"), 0600))
+
+	// the commands run in turn against the same log
+	tests := []struct {
+		name     string
+		cfg      Config
+		args     []string
+		contains []string
+		err      string
+	}{
+		{name: "no command", cfg: cfg, err: "usage:"},
+		{name: "no file storage", cfg: Config{}, args: []string{"verify"}, err: "FILE_STORAGE_PATH"},
+		{name: "unknown command", cfg: cfg, args: []string{"serve-twice"}, err: "usage:"},
+		{name: "shorten", cfg: cfg, args: []string{"shorten", "-alias", "docs", "-user", "user", "https://ya.ru"},
+			contains: []string{"http://localhost:8080/docs", "user"}},
+		{name: "shorten under a taken alias", cfg: cfg, args: []string{"shorten", "-alias", "docs", "https://ya.ru"},
+			err: `alias "docs" is taken`},
+		{name: "shorten an invalid URL", cfg: cfg, args: []string{"shorten", "ya.ru"}, err: "invalid URL"},
+		{name: "resolve", cfg: cfg, args: []string{"resolve", "-o", "json", "docs"},
+			contains: []string{`"original_url": "https://ya.ru"`, `"deleted": false`}},
+		{name: "resolve an unknown link", cfg: cfg, args: []string{"resolve", "unknown"}, err: `link "unknown" is not found`},
+		{name: "import", cfg: cfg, args: []string{"import", "-user", "user", csvPath}, contains: []string{"imported:", "row 2:"}},
+		{name: "export", cfg: cfg, args: []string{"export", "-user", "user"},
+			contains: []string{"http://localhost:8080/docs", "http://localhost:8080/go,https://go.dev"}},
+		{name: "compact", cfg: cfg, args: []string{"compact", "-o", "json"}, contains: []string{`"links": 2`}},
+		{name: "verify", cfg: cfg, args: []string{"verify"}, contains: []string{"problems:"}},
+		{name: "unknown output", cfg: cfg, args: []string{"verify", "-o", "yaml"}, err: `unknown output format "yaml"`},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		err := runCommand(context.Background(), tt.cfg, tt.args, &out)
+		if tt.err != "" {
+			if assert.Error(t, err, tt.name) {
+				assert.Contains(t, err.Error(), tt.err, tt.name)
+			}
+			continue
+		}
+		require.NoError(t, err, tt.name)
+		for _, s := range tt.contains {
+			assert.Contains(t, out.String(), s, tt.name)
+		}
+	}
+}
+
+func TestRunCommandRefusesLockedLog(t *testing.T) {
+	cfg := Config{BaseURL: "http://localhost:8080", FileStoragePath: filepath.Join(t.TempDir(), "links.log")}
+	require.NoError(t, runCommand(context.Background(), cfg, []string{"shorten", "https://ya.ru"}, &bytes.Buffer{}))
+	lock, err := storage.LockLog(cfg.FileStoragePath)
+	require.NoError(t, err)
+
+	for _, args := range [][]string{
+		{"shorten", "https://ya.ru"},
+		{"resolve", "docs"},
+		{"export"},
+		{"import", "-"},
+		{"compact"},
+	} {
+		err := runCommand(context.Background(), cfg, args, &bytes.Buffer{})
+		assert.ErrorIs(t, err, storage.ErrLogLocked, args[0])
+	}
+	assert.NoError(t, runCommand(context.Background(), cfg, []string{"verify"}, &bytes.Buffer{}), "verify only reads the log")
+
+	require.NoError(t, lock.Close())
+	assert.NoError(t, runCommand(context.Background(), cfg, []string{"shorten", "https://ya.ru"}, &bytes.Buffer{}))
+}
@@ -1,47 +1,384 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"io"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/caarlos0/env/v6"
 
+	"github.com/tsupko/shortener/internal/app/admin"
 	"github.com/tsupko/shortener/internal/app/api"
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/bloom"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/metrics"
+	"github.com/tsupko/shortener/internal/app/ratelimit"
 	"github.com/tsupko/shortener/internal/app/service"
 	"github.com/tsupko/shortener/internal/app/storage"
+	"github.com/tsupko/shortener/internal/app/webhook"
 )
 
+// version is set at link time, e.g. `-ldflags "-X main.version=v1.2.3"`
+var version string
+
 type Config struct {
-	ServerAddress   string `env:"SERVER_ADDRESS" envDefault:"localhost:8080"`
-	BaseURL         string `env:"BASE_URL" envDefault:"http://localhost:8080"`
-	FileStoragePath string `env:"FILE_STORAGE_PATH"`
+	ServerAddress   string   `env:"SERVER_ADDRESS" envDefault:"localhost:8080"`
+	BaseURL         string   `env:"BASE_URL" envDefault:"http://localhost:8080"`
+	FileStoragePath string   `env:"FILE_STORAGE_PATH"`
+	LogLevel        string   `env:"LOG_LEVEL" envDefault:"info"`
+	TrustedProxies  string   `env:"TRUSTED_PROXIES"`
+	TrustedSubnet   string   `env:"TRUSTED_SUBNET"`
+	Domains         []string `env:"DOMAINS" envSeparator:","`
+	UnknownHost     string   `env:"UNKNOWN_HOST" envDefault:"primary"`
+	SecretKey       string   `env:"SECRET_KEY"`
+	APIKeysPath     string   `env:"API_KEYS_PATH"`
+
+	WebhooksPath       string `env:"WEBHOOKS_PATH"`
+	WebhookQueuePath   string `env:"WEBHOOK_QUEUE_PATH"`
+	WebhookMaxAttempts int    `env:"WEBHOOK_MAX_ATTEMPTS" envDefault:"10"`
+	EventsBuffer       int    `env:"EVENTS_BUFFER" envDefault:"1024"`
+
+	MaxBodySize             int64 `env:"MAX_BODY_SIZE" envDefault:"1048576"`
+	MaxDecompressedBodySize int64 `env:"MAX_DECOMPRESSED_BODY_SIZE" envDefault:"10485760"`
+	MaxImportBodySize       int64 `env:"MAX_IMPORT_BODY_SIZE" envDefault:"1073741824"`
+	MaxURLLength            int   `env:"MAX_URL_LENGTH" envDefault:"8192"`
+
+	ReadHeaderTimeout     time.Duration `env:"READ_HEADER_TIMEOUT" envDefault:"5s"`
+	ReadTimeout           time.Duration `env:"READ_TIMEOUT" envDefault:"30s"`
+	WriteTimeout          time.Duration `env:"WRITE_TIMEOUT" envDefault:"30s"`
+	IdleTimeout           time.Duration `env:"IDLE_TIMEOUT" envDefault:"2m"`
+	RequestTimeout        time.Duration `env:"REQUEST_TIMEOUT" envDefault:"10s"`
+	MaxConcurrentRequests int           `env:"MAX_CONCURRENT_REQUESTS" envDefault:"1000"`
+	MetricsAddress        string        `env:"METRICS_ADDRESS"`
+
+	// AdminAddress enables the admin listener, see admin.NewHandler
+	AdminAddress      string `env:"ADMIN_ADDRESS"`
+	AdminLoopbackOnly bool   `env:"ADMIN_LOOPBACK_ONLY" envDefault:"true"`
+
+	ShutdownDelay   time.Duration `env:"SHUTDOWN_DELAY" envDefault:"5s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" envDefault:"30s"`
+
+	// FileStoragePath is the directory of the storage log, see storage.NewFileStorage; FileSegmentSize is the size
+	// in bytes of its segments, and clicks are written to it every FileClickFlushInterval
+	FileSegmentSize        int64         `env:"FILE_SEGMENT_SIZE" envDefault:"67108864"`
+	FileClickFlushInterval time.Duration `env:"FILE_CLICK_FLUSH_INTERVAL" envDefault:"5s"`
+
+	// MemoryCapacity and MemoryTTL bound the memory storage, used without FILE_STORAGE_PATH; zero is unbounded.
+	// MemoryEvictedKeys bounds the keys of evicted links kept from reissue, see storage.WithEvictedKeys.
+	// MemorySnapshotPath persists it, see storage.WithSnapshots
+	MemoryCapacity         int           `env:"MEMORY_CAPACITY"`
+	MemoryTTL              time.Duration `env:"MEMORY_TTL"`
+	MemoryEvictedKeys      int           `env:"MEMORY_EVICTED_KEYS"`
+	MemorySnapshotPath     string        `env:"MEMORY_SNAPSHOT_PATH"`
+	MemorySnapshotInterval time.Duration `env:"MEMORY_SNAPSHOT_INTERVAL" envDefault:"1m"`
+
+	// CacheSize bounds the links cached in front of the storage; the cache is off unless it is set
+	CacheSize        int           `env:"CACHE_SIZE"`
+	CacheTTL         time.Duration `env:"CACHE_TTL" envDefault:"1m"`
+	CacheNegativeTTL time.Duration `env:"CACHE_NEGATIVE_TTL" envDefault:"5s"`
+
+	// BloomFilter spares the storage lookups of unknown IDs; it suits instances which do not share their storage
+	BloomFilter            bool    `env:"BLOOM_FILTER"`
+	BloomExpectedLinks     int     `env:"BLOOM_EXPECTED_LINKS" envDefault:"1000000"`
+	BloomFalsePositiveRate float64 `env:"BLOOM_FALSE_POSITIVE_RATE" envDefault:"0.01"`
+
+	IdempotencyPath string        `env:"IDEMPOTENCY_PATH"`
+	IdempotencyTTL  time.Duration `env:"IDEMPOTENCY_TTL" envDefault:"24h"`
+	// IdempotencyMaxResponses and IdempotencyMaxBytes bound the responses kept, see storage.WithIdempotencyCapacity
+	IdempotencyMaxResponses int   `env:"IDEMPOTENCY_MAX_RESPONSES"`
+	IdempotencyMaxBytes     int64 `env:"IDEMPOTENCY_MAX_BYTES"`
+
+	CreateRateLimit     float64       `env:"RATE_LIMIT_CREATE_RPS"`
+	CreateRateBurst     int           `env:"RATE_LIMIT_CREATE_BURST" envDefault:"10"`
+	RedirectRateLimit   float64       `env:"RATE_LIMIT_REDIRECT_RPS"`
+	RedirectRateBurst   int           `env:"RATE_LIMIT_REDIRECT_BURST" envDefault:"100"`
+	RateLimitMaxClients int           `env:"RATE_LIMIT_MAX_CLIENTS" envDefault:"100000"`
+	RateLimitIdleTTL    time.Duration `env:"RATE_LIMIT_IDLE_TTL" envDefault:"10m"`
+}
+
+// apiKeysPath is where API keys are kept, by default next to the file storage
+func (cfg Config) apiKeysPath() string {
+	if cfg.APIKeysPath != "" || cfg.FileStoragePath == "" {
+		return cfg.APIKeysPath
+	}
+	return cfg.FileStoragePath + ".keys"
+}
+
+// idempotencyPath is where responses to requests with an Idempotency-Key are kept, by default next to the file storage
+func (cfg Config) idempotencyPath() string {
+	if cfg.IdempotencyPath != "" || cfg.FileStoragePath == "" {
+		return cfg.IdempotencyPath
+	}
+	return cfg.FileStoragePath + ".idempotency"
+}
+
+// webhookQueuePath is where undelivered webhooks are kept, by default next to the file storage
+func (cfg Config) webhookQueuePath() string {
+	if cfg.WebhookQueuePath != "" || cfg.FileStoragePath == "" {
+		return cfg.WebhookQueuePath
+	}
+	return cfg.FileStoragePath + ".webhooks"
+}
+
+// redactedSecret replaces secrets in the configuration served by the admin listener
+const redactedSecret = "[redacted]"
+
+// redacted is the configuration without secrets
+func (cfg Config) redacted() Config {
+	if cfg.SecretKey != "" {
+		cfg.SecretKey = redactedSecret
+	}
+	return cfg
 }
 
 func main() {
+	ctx := context.Background()
+
 	var cfg Config
 	err := env.Parse(&cfg)
 	if err != nil {
-		log.Printf("error while parsing environment variables: %s\n", err)
+		logger.Error(ctx, "error while parsing environment variables", "error", err)
 	}
 
 	flag.StringVar(&cfg.ServerAddress, "a", cfg.ServerAddress, "-a serverAddress")
 	flag.StringVar(&cfg.BaseURL, "b", cfg.BaseURL, "-b baseUrl")
 	flag.StringVar(&cfg.FileStoragePath, "f", cfg.FileStoragePath, "-f fileStoragePath")
+	flag.StringVar(&cfg.LogLevel, "l", cfg.LogLevel, "-l logLevel (debug, info, warn, error)")
+	flag.StringVar(&cfg.TrustedSubnet, "t", cfg.TrustedSubnet, "-t trustedSubnet (CIDR served internal statistics)")
 	flag.Parse()
 
+	level, err := logger.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		logger.Warn(ctx, "falling back to info log level", "error", err)
+	}
+	logger.SetLevel(level)
+
+	switch command := flag.Arg(0); command {
+	case "", "serve":
+		serve(ctx, cfg)
+	case "apikey":
+		if err := runAPIKeyCommand(ctx, cfg, flag.Args()[1:], os.Stdout); err != nil {
+			logger.Error(ctx, "apikey command failed", "error", err)
+			os.Exit(1)
+		}
+	default:
+		if err := runCommand(ctx, cfg, flag.Args(), os.Stdout); err != nil {
+			if !errors.Is(err, errProblemsFound) {
+				logger.Error(ctx, command+" command failed", "error", err)
+			}
+			os.Exit(1)
+		}
+	}
+}
+
+// serve runs the server until it fails or is stopped by SIGINT or SIGTERM
+func serve(ctx context.Context, cfg Config) {
 	var store storage.Storage
 	if cfg.FileStoragePath != "" {
-		log.Printf("environment variable `FILE_STORAGE_PATH` is found: %s\n", cfg.FileStoragePath)
-		store = storage.NewFileStorage(cfg.FileStoragePath)
+		logger.Info(ctx, "environment variable `FILE_STORAGE_PATH` is found", "path", cfg.FileStoragePath)
+		lock, err := storage.LockLog(cfg.FileStoragePath)
+		if err != nil {
+			logger.Error(ctx, "could not lock file storage", "error", err)
+			return
+		}
+		defer lock.Close()
+		store = storage.NewFileStorage(cfg.FileStoragePath, storage.WithSegmentSize(cfg.FileSegmentSize),
+			storage.WithClickFlushInterval(cfg.FileClickFlushInterval))
 	} else {
-		store = storage.NewMemoryStorage()
+		store = newMemoryStorage(ctx, cfg)
+	}
+	if cfg.CacheSize > 0 {
+		cache := storage.NewCachedStorage(store,
+			storage.WithCacheSize(cfg.CacheSize),
+			storage.WithCacheTTL(cfg.CacheTTL, cfg.CacheNegativeTTL),
+		)
+		metrics.Publish("storage_cache", func() interface{} { return cache.CacheStats() })
+		store = cache
 	}
-	shorteningService := service.NewShorteningService(store)
-	handler := api.NewRequestHandler(shorteningService, cfg.BaseURL)
-	router := api.NewRouter(handler)
-	err = http.ListenAndServe(cfg.ServerAddress, router)
+	var forward []events.Publisher
+	dispatcher := newWebhookDispatcher(ctx, cfg)
+	if dispatcher != nil {
+		forward = append(forward, dispatcher)
+	}
+	bus := events.NewBus(cfg.EventsBuffer, forward...)
+	serviceOptions := []service.Option{service.WithPublisher(bus)}
+	if cfg.BloomFilter {
+		serviceOptions = append(serviceOptions,
+			service.WithBloomFilter(bloom.New(cfg.BloomExpectedLinks, cfg.BloomFalsePositiveRate)))
+	}
+	shorteningService := service.NewShorteningService(store, serviceOptions...)
+	if err := api.ValidateUnknownHost(cfg.UnknownHost); err != nil {
+		logger.Error(ctx, "serving unknown hosts as the primary domain", "error", err)
+		cfg.UnknownHost = api.UnknownHostPrimary
+	}
+	handler := api.NewRequestHandler(shorteningService, cfg.BaseURL,
+		api.WithDomains(cfg.Domains),
+		api.WithUnknownHost(cfg.UnknownHost),
+		api.WithEventBus(bus),
+		api.WithMaxURLLength(cfg.MaxURLLength),
+	)
+	var keys storage.KeyStorage
+	if keysPath := cfg.apiKeysPath(); keysPath != "" {
+		keys = storage.NewFileKeyStorage(keysPath)
+	}
+	secret := []byte(cfg.SecretKey)
+	if len(secret) == 0 {
+		logger.Warn(ctx, "environment variable `SECRET_KEY` is not set, user cookies will not survive a restart")
+		secret = auth.NewSecret()
+	}
+
+	trustedProxies, err := api.ParseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		logger.Error(ctx, "ignoring trusted proxies", "error", err)
+	}
+	trustedSubnet, err := api.ParseTrustedSubnet(cfg.TrustedSubnet)
 	if err != nil {
-		log.Printf("server returned error: %s\n", err)
+		logger.Error(ctx, "internal statistics are disabled", "error", err)
+	}
+	idempotencyCapacity := storage.WithIdempotencyCapacity(cfg.IdempotencyMaxResponses, cfg.IdempotencyMaxBytes)
+	var idempotency storage.IdempotencyStorage = storage.NewMemoryIdempotencyStorage(idempotencyCapacity)
+	if path := cfg.idempotencyPath(); path != "" {
+		fileIdempotency, err := storage.NewFileIdempotencyStorage(path, idempotencyCapacity)
+		if err != nil {
+			logger.Error(ctx, "keeping idempotent responses in memory", "path", path, "error", err)
+		} else {
+			idempotency = fileIdempotency
+		}
+	}
+	readiness := api.NewReadiness(store)
+	router := api.NewRouter(handler,
+		api.WithReadiness(readiness),
+		api.WithAuthenticator(auth.NewAuthenticator(keys, secret)),
+		api.WithIdempotency(idempotency, cfg.IdempotencyTTL),
+		api.WithBodyLimits(api.BodyLimits{Body: cfg.MaxBodySize, Decompressed: cfg.MaxDecompressedBodySize, Import: cfg.MaxImportBodySize}),
+		api.WithTrustedProxies(trustedProxies),
+		api.WithTrustedSubnet(trustedSubnet),
+		api.WithTimeouts(api.Timeouts{Request: cfg.RequestTimeout, Write: cfg.WriteTimeout, Read: cfg.ReadTimeout}),
+		api.WithMaxConcurrentRequests(cfg.MaxConcurrentRequests),
+		api.WithRateLimiters(
+			ratelimit.NewLimiter(cfg.CreateRateLimit, cfg.CreateRateBurst, cfg.RateLimitMaxClients, cfg.RateLimitIdleTTL),
+			ratelimit.NewLimiter(cfg.RedirectRateLimit, cfg.RedirectRateBurst, cfg.RateLimitMaxClients, cfg.RateLimitIdleTTL),
+		),
+	)
+	if cfg.MetricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", metrics.Handler())
+		go serveInternal(ctx, "metrics", cfg.MetricsAddress, mux)
+	}
+	if cfg.AdminAddress != "" {
+		adminOpts := []admin.Option{admin.WithConfig(cfg.redacted()), admin.WithStorage(store)}
+		if cfg.AdminLoopbackOnly {
+			adminOpts = append(adminOpts, admin.WithLoopbackOnly())
+		}
+		go serveInternal(ctx, "admin", cfg.AdminAddress, admin.NewHandler(admin.ReadBuildInfo(version), adminOpts...))
+	}
+	server := &http.Server{
+		Addr:              cfg.ServerAddress,
+		Handler:           router,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		// the write timeout is set per request by the router, so that event streams are not cut off;
+		// the read timeout is extended by the router as imports are streamed
+		ConnContext: api.ConnContext,
+	}
+	server.RegisterOnShutdown(bus.DropSubscribers)
+
+	stop, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	served := make(chan error, 1)
+	go func() {
+		logger.Info(ctx, "server is starting", "address", cfg.ServerAddress)
+		served <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-served:
+		logger.Error(ctx, "server returned error", "error", err)
+		return
+	case <-stop.Done():
+	}
+
+	// load balancers are given the time to notice that the instance is not ready before it stops accepting requests
+	readiness.Drain()
+	logger.Info(ctx, "server is shutting down", "delay", cfg.ShutdownDelay)
+	time.Sleep(cfg.ShutdownDelay)
+	shutdownCtx, cancelShutdown := context.WithTimeout(ctx, cfg.ShutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error(ctx, "server did not shut down gracefully", "error", err)
+	}
+	// events of the last requests are queued before the dispatcher stops
+	if dispatcher != nil {
+		if err := dispatcher.Close(shutdownCtx); err != nil {
+			logger.Error(ctx, "could not stop webhook dispatcher", "error", err)
+		}
+	}
+	if closer, ok := idempotency.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error(ctx, "could not close idempotency storage", "error", err)
+		}
+	}
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Error(ctx, "could not close storage", "error", err)
+		}
+	}
+	logger.Info(ctx, "server is stopped")
+}
+
+// serveInternal serves a handler kept off the public router, such as the metrics or the admin one
+func serveInternal(ctx context.Context, name, address string, handler http.Handler) {
+	server := &http.Server{Addr: address, Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	logger.Info(ctx, name+" server is starting", "address", address)
+	if err := server.ListenAndServe(); err != nil {
+		logger.Error(ctx, name+" server returned error", "error", err)
+	}
+}
+
+// newMemoryStorage bounds the memory storage and snapshots it as configured
+func newMemoryStorage(ctx context.Context, cfg Config) *storage.MemoryStorage {
+	opts := []storage.MemoryOption{
+		storage.WithCapacity(cfg.MemoryCapacity),
+		storage.WithTTL(cfg.MemoryTTL),
+		storage.WithEvictedKeys(cfg.MemoryEvictedKeys),
+	}
+	if cfg.MemorySnapshotPath != "" {
+		logger.Info(ctx, "memory storage snapshots are enabled", "path", cfg.MemorySnapshotPath,
+			"interval", cfg.MemorySnapshotInterval)
+		opts = append(opts, storage.WithSnapshots(cfg.MemorySnapshotPath, cfg.MemorySnapshotInterval))
+	}
+	return storage.NewMemoryStorage(opts...)
+}
+
+// newWebhookDispatcher starts delivering webhooks to the subscriptions configured in WEBHOOKS_PATH, if any
+func newWebhookDispatcher(ctx context.Context, cfg Config) *webhook.Dispatcher {
+	if cfg.WebhooksPath == "" {
+		return nil
+	}
+	subscriptions, err := webhook.LoadSubscriptions(cfg.WebhooksPath)
+	if err != nil {
+		logger.Error(ctx, "webhooks are disabled", "error", err)
+		return nil
+	}
+	var queue webhook.Queue = webhook.NewMemoryQueue()
+	if queuePath := cfg.webhookQueuePath(); queuePath != "" {
+		fileQueue, err := webhook.NewFileQueue(queuePath)
+		if err != nil {
+			logger.Error(ctx, "webhooks are disabled", "error", err)
+			return nil
+		}
+		queue = fileQueue
+	} else {
+		logger.Warn(ctx, "undelivered webhooks will not survive a restart, set `WEBHOOK_QUEUE_PATH` to keep them")
 	}
+	logger.Info(ctx, "webhooks are enabled", "subscriptions", len(subscriptions))
+	return webhook.NewDispatcher(subscriptions, queue, webhook.WithRetries(cfg.WebhookMaxAttempts, time.Second, time.Hour))
 }
@@ -0,0 +1,185 @@
+// Package admin serves the introspection of a running server: profiles, build info, the configuration,
+// storage and runtime statistics. It is meant for a listener of its own, never for the public router
+package admin
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/metrics"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+// BuildInfo identifies the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildTime string `json:"build_time,omitempty"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+// ReadBuildInfo completes the version, usually set at link time, with what the Go toolchain embeds in the binary
+func ReadBuildInfo(version string) BuildInfo {
+	info := BuildInfo{Version: version, GoVersion: runtime.Version()}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	if info.Version == "" {
+		info.Version = build.Main.Version
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			info.Commit = setting.Value
+		case "vcs.time":
+			info.BuildTime = setting.Value
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// Option customizes the handler built by NewHandler
+type Option func(*handler)
+
+// WithConfig serves the configuration at `/config`; secrets must be redacted by the caller
+func WithConfig(config interface{}) Option {
+	return func(h *handler) {
+		h.config = config
+	}
+}
+
+// WithStorage serves the statistics of the storage at `/storage` if it implements storage.StatsReporter
+func WithStorage(store storage.Storage) Option {
+	return func(h *handler) {
+		h.store = store
+	}
+}
+
+// WithLoopbackOnly answers requests from other than loopback addresses with `403 Forbidden`,
+// which keeps the handler private even when it listens on all interfaces
+func WithLoopbackOnly() Option {
+	return func(h *handler) {
+		h.loopbackOnly = true
+	}
+}
+
+type handler struct {
+	build        BuildInfo
+	config       interface{}
+	store        storage.Storage
+	loopbackOnly bool
+	started      time.Time
+}
+
+// NewHandler serves `net/http/pprof` at `/debug/pprof/`, the published metrics at `/debug/vars`
+// and JSON documents at `/build`, `/config`, `/storage` and `/runtime`
+func NewHandler(build BuildInfo, opts ...Option) http.Handler {
+	h := &handler{build: build, started: time.Now()}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	r := chi.NewRouter()
+	if h.loopbackOnly {
+		r.Use(loopbackOnlyHandle)
+	}
+	r.HandleFunc("/debug/pprof/*", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.Handle("/debug/vars", metrics.Handler())
+	r.Get("/build", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, h.build)
+	})
+	r.Get("/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, h.config)
+	})
+	r.Get("/storage", func(w http.ResponseWriter, r *http.Request) {
+		h.handleStorage(w, r)
+	})
+	r.Get("/runtime", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, r, h.runtimeStats())
+	})
+	return r
+}
+
+func loopbackOnlyHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "Admin endpoints are only served to loopback addresses", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) handleStorage(w http.ResponseWriter, r *http.Request) {
+	reporter, ok := h.store.(storage.StatsReporter)
+	if !ok {
+		http.Error(w, "Storage does not report statistics", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, reporter.Stats(r.Context()))
+}
+
+// RuntimeStats describe the process
+type RuntimeStats struct {
+	Uptime       string `json:"uptime"`
+	Goroutines   int    `json:"goroutines"`
+	GOMAXPROCS   int    `json:"gomaxprocs"`
+	NumCPU       int    `json:"num_cpu"`
+	HeapAlloc    uint64 `json:"heap_alloc_bytes"`
+	HeapInuse    uint64 `json:"heap_inuse_bytes"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	Sys          uint64 `json:"sys_bytes"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"gc_pause_total_ns"`
+	LastGC       string `json:"last_gc,omitempty"`
+}
+
+func (h *handler) runtimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		Uptime:       time.Since(h.started).Round(time.Second).String(),
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		NumCPU:       runtime.NumCPU(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapInuse:    mem.HeapInuse,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+	}
+	if mem.LastGC > 0 {
+		stats.LastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+	return stats
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(w, "Could not marshal response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(append(body, '\n')); err != nil {
+		logger.Error(r.Context(), "could not write response", "error", err)
+	}
+}
@@ -0,0 +1,78 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+func get(t *testing.T, ts *httptest.Server, path string) (int, string) {
+	resp, err := http.Get(ts.URL + path)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+func TestHandler(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	store.Put(context.Background(), storage.Link{ID: "a", URL: "https://a.example"})
+	config := struct{ SecretKey string }{SecretKey: "[redacted]"}
+	ts := httptest.NewServer(NewHandler(BuildInfo{Version: "v1.2.3", Commit: "abc"},
+		WithConfig(config), WithStorage(store), WithLoopbackOnly()))
+	defer ts.Close()
+
+	status, body := get(t, ts, "/build")
+	assert.Equal(t, http.StatusOK, status)
+	assert.JSONEq(t, `{"version":"v1.2.3","commit":"abc","go_version":""}`, body)
+
+	_, body = get(t, ts, "/config")
+	assert.JSONEq(t, `{"SecretKey":"[redacted]"}`, body)
+
+	_, body = get(t, ts, "/storage")
+	assert.JSONEq(t, `{"links":1}`, body)
+
+	_, body = get(t, ts, "/runtime")
+	var stats RuntimeStats
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	assert.Positive(t, stats.Goroutines)
+	assert.Positive(t, stats.HeapAlloc)
+
+	status, body = get(t, ts, "/debug/pprof/")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "goroutine")
+	status, _ = get(t, ts, "/debug/pprof/goroutine?debug=1")
+	assert.Equal(t, http.StatusOK, status)
+	status, body = get(t, ts, "/debug/vars")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "rejected_requests")
+}
+
+func TestLoopbackOnly(t *testing.T) {
+	h := NewHandler(BuildInfo{}, WithLoopbackOnly())
+	r := httptest.NewRequest("GET", "/build", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	r.RemoteAddr = "[::1]:1234"
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestReadBuildInfo(t *testing.T) {
+	info := ReadBuildInfo("v1.2.3")
+	assert.Equal(t, "v1.2.3", info.Version)
+	assert.NotEmpty(t, info.GoVersion)
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+const userCookieName = "user_id"
+
+// authenticate puts the identity of the caller into the request context: the owner of the API key
+// from the `Authorization: Bearer` header, or the user of a validly signed cookie.
+// Requests with an invalid API key are rejected with `401 Unauthorized`
+func authenticate(a *auth.Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if authorization := r.Header.Get("Authorization"); authorization != "" {
+				identity, err := a.AuthenticateKey(r.Context(), bearerToken(authorization))
+				if err != nil {
+					logger.Warn(r.Context(), "API key is rejected")
+					w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+					http.Error(w, "Invalid API key", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+				return
+			}
+			if cookie, err := r.Cookie(userCookieName); err == nil {
+				if userID, ok := a.VerifyUserCookie(cookie.Value); ok {
+					identity := auth.Identity{UserID: userID, Scopes: auth.AllScopes}
+					next.ServeHTTP(w, r.WithContext(auth.WithIdentity(r.Context(), identity)))
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// issueUserCookie makes a new cookie user of an anonymous caller, so that the links it creates have an owner
+func issueUserCookie(a *auth.Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := auth.IdentityFromContext(r.Context()); ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			userID := auth.NewUserID()
+			http.SetCookie(w, &http.Cookie{
+				Name:     userCookieName,
+				Value:    a.SignUserID(userID),
+				Path:     "/",
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			identity := auth.Identity{UserID: userID, Scopes: auth.AllScopes}
+			ctx := context.WithValue(auth.WithIdentity(r.Context(), identity), issuedUserContextKey{}, true)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+type issuedUserContextKey struct{}
+
+// isIssuedUser tells whether the user of the request is new, made by issueUserCookie for an anonymous caller
+func isIssuedUser(ctx context.Context) bool {
+	issued, _ := ctx.Value(issuedUserContextKey{}).(bool)
+	return issued
+}
+
+// requireScope rejects anonymous callers with `401 Unauthorized` and callers lacking the scope with `403 Forbidden`
+func requireScope(scope auth.Scope) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			identity, ok := auth.IdentityFromContext(r.Context())
+			if !ok {
+				http.Error(w, "Authentication is required", http.StatusUnauthorized)
+				return
+			}
+			if !identity.HasScope(scope) {
+				http.Error(w, "API key lacks scope "+string(scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bearerToken(authorization string) string {
+	const prefix = "Bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(authorization[len(prefix):])
+}
@@ -0,0 +1,123 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/tsupko/shortener/internal/app/metrics"
+)
+
+const (
+	DefaultMaxBodySize             = 1 << 20
+	DefaultMaxDecompressedBodySize = 10 << 20
+	DefaultMaxImportBodySize       = 1 << 30
+	DefaultMaxURLLength            = 8 << 10
+)
+
+var errBodyTooLarge = errors.New("request body is too large")
+
+// BodyLimits bound the size of request bodies; zero fields take the defaults
+type BodyLimits struct {
+	// Body bounds bodies as they are received, compressed or not
+	Body int64
+	// Decompressed bounds compressed bodies once they are decompressed, which defeats decompression bombs
+	Decompressed int64
+	// Import bounds bodies of `POST /api/import` both as they are received and once decompressed,
+	// as imports are streamed rather than held in memory
+	Import int64
+}
+
+func (l BodyLimits) withDefaults() BodyLimits {
+	if l.Body <= 0 {
+		l.Body = DefaultMaxBodySize
+	}
+	if l.Decompressed <= 0 {
+		l.Decompressed = DefaultMaxDecompressedBodySize
+	}
+	if l.Import <= 0 {
+		l.Import = DefaultMaxImportBodySize
+	}
+	return l
+}
+
+// WithMaxURLLength bounds the length of the URLs links are created to; DefaultMaxURLLength by default
+func WithMaxURLLength(length int) HandlerOption {
+	return func(h *RequestHandler) {
+		if length > 0 {
+			h.maxURLLength = length
+		}
+	}
+}
+
+// limitBodyHandle answers requests with bodies over the limit with `413 Payload Too Large`: right away when
+// they declare their length, otherwise once handlers read past the limit
+func limitBodyHandle(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				writeBodyTooLarge(w, limit)
+				return
+			}
+			r.Body = &limitedBody{ReadCloser: r.Body, remaining: limit}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBodiesHandle bounds bodies as they are received and once decompressed, decompressing them
+func limitBodiesHandle(body, decompressed int64) func(http.Handler) http.Handler {
+	limit, decompress := limitBodyHandle(body), decompressRequestHandle(decompressed)
+	return func(next http.Handler) http.Handler {
+		return limit(decompress(next))
+	}
+}
+
+// limitedBody fails reads past the limit with errBodyTooLarge instead of silently truncating the body
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// one byte over the limit tells a body of exactly the limit from a larger one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// writeBodyError answers a request whose body could not be read or parsed
+func writeBodyError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errBodyTooLarge) {
+		metrics.Rejected(metrics.ReasonBodyTooLarge)
+		http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, "Could not unmarshal request: "+err.Error(), http.StatusBadRequest)
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, limit int64) {
+	metrics.Rejected(metrics.ReasonBodyTooLarge)
+	http.Error(w, "Request body is larger than "+strconv.FormatInt(limit, 10)+" bytes", http.StatusRequestEntityTooLarge)
+}
+
+// checkURLLength rejects URLs longer than the limit
+func (h *RequestHandler) checkURLLength(urls ...string) error {
+	for _, u := range urls {
+		if len(u) > h.maxURLLength {
+			return fmt.Errorf("URL is longer than %d characters", h.maxURLLength)
+		}
+	}
+	return nil
+}
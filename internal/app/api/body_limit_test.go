@@ -0,0 +1,122 @@
+package api
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+	"github.com/tsupko/shortener/internal/app/util"
+)
+
+func TestLimitedBody(t *testing.T) {
+	body := &limitedBody{ReadCloser: io.NopCloser(strings.NewReader("12345")), remaining: 5}
+	data, err := io.ReadAll(body)
+	assert.NoError(t, err, "a body of exactly the limit is accepted")
+	assert.Equal(t, "12345", string(data))
+
+	body = &limitedBody{ReadCloser: io.NopCloser(strings.NewReader("123456")), remaining: 5}
+	data, err = io.ReadAll(body)
+	assert.ErrorIs(t, err, errBodyTooLarge)
+	assert.Equal(t, "12345", string(data))
+}
+
+func TestBodyLimits(t *testing.T) {
+	ts := getServer(WithBodyLimits(BodyLimits{Body: 1024, Decompressed: 4096}))
+	defer ts.Close()
+
+	large := `{"url":"https://ya.ru/` + strings.Repeat("a", 2000) + `"}`
+	resp, _ := testRequest(t, ts, "POST", "/api/shorten", large)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "declared length")
+	closeBody(t, resp)
+
+	// without a declared length the limit is hit while reading
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/api/shorten/batch", io.MultiReader(strings.NewReader(`[{"correlation_id":"`), strings.NewReader(strings.Repeat("a", 2000)+`"}]`)))
+	require.NoError(t, err)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "chunked body")
+	closeBody(t, resp)
+
+	bomb := zip(`{"url":"https://ya.ru/` + strings.Repeat("a", 10000) + `"}`)
+	require.Less(t, len(bomb), 1024)
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", bomb, "Content-Encoding", "gzip")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode, "decompressed body")
+	closeBody(t, resp)
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten", zip(`{"url":"https://ya.ru"}`), "Content-Encoding", "gzip")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode, body)
+	closeBody(t, resp)
+
+	var deflated bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	_, _ = zw.Write([]byte("https://ya.ru"))
+	require.NoError(t, zw.Close())
+	resp, body = testRequest(t, ts, "POST", "/", deflated.String(), "Content-Encoding", "deflate")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "http://localhost:8080/12345", body)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/", "https://ya.ru", "Content-Encoding", "br")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	assert.Equal(t, "gzip, deflate", resp.Header.Get("Accept-Encoding"))
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/", "not gzip", "Content-Encoding", "gzip")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	closeBody(t, resp)
+}
+
+func TestImportBodyLimit(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithBodyLimits(BodyLimits{Body: 1024, Decompressed: 4096, Import: 64 << 10})))
+	defer ts.Close()
+
+	var csv strings.Builder
+	csv.WriteString("url\n")
+	for i := 0; csv.Len() < 16<<10; i++ {
+		fmt.Fprintf(&csv, "https://ya.ru/%d\n", i)
+	}
+	resp, body := testRequest(t, ts, "POST", "/api/import", csv.String(), "Content-Type", "text/csv")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "imports are not bound by the limit of other bodies")
+	assert.Contains(t, body, `"failed":0`)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/api/import", "url\n"+strings.Repeat("a", 64<<10), "Content-Type", "text/csv")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://ya.ru/`+strings.Repeat("a", 2000)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	closeBody(t, resp)
+}
+
+func TestMaxURLLength(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	long := "https://ya.ru/" + strings.Repeat("a", DefaultMaxURLLength)
+	for path, body := range map[string]string{
+		"/":                  long,
+		"/api/shorten":       `{"url":"` + long + `"}`,
+		"/api/shorten/batch": `[{"correlation_id":"1","original_url":"` + long + `"}]`,
+	} {
+		resp, _ := testRequest(t, ts, "POST", path, body)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, path)
+		closeBody(t, resp)
+	}
+
+	resp, body := testRequest(t, ts, "POST", "/api/import", "url\n"+long+"\n", "Content-Type", "text/csv")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"failed":1`)
+	closeBody(t, resp)
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/bulk"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/metrics"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+// handleImport creates links of the caller from a CSV file with a header row or from NDJSON, see bulk.Read,
+// i.e. `POST /api/import`. Rows are read one at a time, so the body is never held in memory as a whole,
+// and aliases are kept when they are free. Every row is created within the row timeout, if it is set
+func (h *RequestHandler) handleImport(w http.ResponseWriter, r *http.Request, rowTimeout time.Duration) {
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			logger.Error(r.Context(), "could not close request body", "error", err)
+		}
+	}()
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var format string
+	switch mediaType {
+	case "text/csv":
+		format = bulk.FormatCSV
+	case "application/x-ndjson", "application/ndjson", "application/jsonl", "application/x-jsonlines":
+		format = bulk.FormatNDJSON
+	default:
+		http.Error(w, "Unsupported content type, expected text/csv or application/x-ndjson", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	report := &bulk.Report{}
+	err := bulk.Read(r.Body, format, func(row int, value bulk.Row, err error) {
+		if err != nil {
+			report.Fail(row, err)
+			return
+		}
+		h.importRow(r, report, row, value, rowTimeout)
+	})
+	status := http.StatusOK
+	if err != nil {
+		report.Error = err.Error()
+		status = http.StatusBadRequest
+		if errors.Is(err, errBodyTooLarge) {
+			metrics.Rejected(metrics.ReasonBodyTooLarge)
+			status = http.StatusRequestEntityTooLarge
+		}
+	}
+	logger.Info(r.Context(), "links are imported", "format", format, "imported", report.Imported, "failed", report.Failed)
+	h.writeJSON(w, r, status, report)
+}
+
+func (h *RequestHandler) importRow(r *http.Request, report *bulk.Report, row int, value bulk.Row, timeout time.Duration) {
+	domain, ok := h.creationDomain(r, value.Domain)
+	if !ok {
+		report.Fail(row, errors.New("unknown domain "+value.Domain))
+		return
+	}
+	if err := h.checkURLLength(value.URL); err != nil {
+		report.Fail(row, err)
+		return
+	}
+	ctx := r.Context()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	link := storage.Link{UserID: userID(r), Domain: domain, URL: value.URL}
+	id, kept, err := h.service.Import(ctx, link, value.Alias)
+	if err != nil {
+		report.Fail(row, err)
+		return
+	}
+	if value.Alias != "" && !kept {
+		report.Renamed(row, value.Alias, h.ShortURL(domain, id))
+		return
+	}
+	report.Imported++
+}
+
+// handleExport streams the links of the caller as CSV or NDJSON, i.e. `GET /api/export`. The format is taken from
+// the `format` query parameter, then from the Accept header, CSV being the default
+func (h *RequestHandler) handleExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = bulk.FormatCSV
+		if strings.Contains(r.Header.Get("Accept"), "ndjson") {
+			format = bulk.FormatNDJSON
+		}
+	}
+	if err := bulk.ValidateFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	links := h.service.GetUserLinks(r.Context(), userID(r))
+	storage.SortLinks(links)
+	if format == bulk.FormatCSV {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="links.`+format+`"`)
+	writer, err := bulk.NewWriter(w, format)
+	for i := 0; err == nil && i < len(links); i++ {
+		err = writer.Write(h.ExportRecord(links[i]))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		logger.Error(r.Context(), "could not write export", "error", err)
+	}
+}
+
+// ExportRecord describes the link in exports
+func (h *RequestHandler) ExportRecord(link storage.Link) bulk.Record {
+	return bulk.Record{
+		ID:          link.ID,
+		ShortURL:    h.ShortURL(link.Domain, link.ID),
+		OriginalURL: link.URL,
+		Domain:      link.Domain,
+		CreatedAt:   link.CreatedAt,
+		Clicks:      link.Clicks,
+	}
+}
@@ -0,0 +1,257 @@
+package api
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+
+	// minCompressSize is the smallest body worth compressing, smaller ones grow rather than shrink
+	minCompressSize = 1024
+)
+
+var (
+	_ http.ResponseWriter = &compressWriter{}
+	_ http.Flusher        = &compressWriter{}
+	_ http.Hijacker       = &compressWriter{}
+)
+
+// encoder is implemented by both *gzip.Writer and *zlib.Writer, which are reused through pools
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	encodingGzip: {New: func() interface{} {
+		gz, _ := gzip.NewWriterLevel(io.Discard, gzip.BestSpeed)
+		return gz
+	}},
+	encodingDeflate: {New: func() interface{} {
+		zw, _ := zlib.NewWriterLevel(io.Discard, zlib.BestSpeed)
+		return zw
+	}},
+}
+
+// compressResponseHandle compresses responses with the encoding the client prefers, see negotiateEncoding.
+// Only bodies of compressible content types of at least minCompressSize bytes are compressed, unless the handler
+// flushes them earlier, which streamed responses do
+func compressResponseHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding"))}
+		defer func() {
+			if err := cw.close(); err != nil {
+				logger.Error(r.Context(), "could not compress response", "encoding", cw.encoding, "error", err)
+			}
+		}()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks gzip or deflate by their q-values in the Accept-Encoding header, preferring gzip on a tie;
+// it returns an empty string when the client accepts neither
+func negotiateEncoding(acceptEncoding string) string {
+	gzipQ, deflateQ, anyQ := -1.0, -1.0, -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || parsed < 0 {
+				parsed = 0
+			}
+			q = parsed
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "deflate":
+			deflateQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ < 0 {
+		gzipQ = anyQ
+	}
+	if deflateQ < 0 {
+		deflateQ = anyQ
+	}
+	switch {
+	case gzipQ > 0 && gzipQ >= deflateQ:
+		return encodingGzip
+	case deflateQ > 0:
+		return encodingDeflate
+	}
+	return ""
+}
+
+// compressible tells whether bodies of the content type shrink when compressed; images but SVG,
+// archives and other binary formats are compressed already
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/x-ndjson", "application/javascript", "application/xml", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds the status and the beginning of the body back until it is clear whether the response
+// is worth compressing, then either compresses or passes everything through
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	status   int
+	buf      []byte
+	decided  bool
+	encoder  encoder
+}
+
+func (w *compressWriter) WriteHeader(statusCode int) {
+	if statusCode < http.StatusOK {
+		// informational responses precede the final one
+		w.ResponseWriter.WriteHeader(statusCode)
+		return
+	}
+	if w.decided || w.status != 0 {
+		if w.decided {
+			w.ResponseWriter.WriteHeader(statusCode)
+		}
+		return
+	}
+	w.status = statusCode
+	if !bodyAllowed(statusCode) {
+		w.start(false)
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.decided {
+		if len(w.buf)+len(b) < minCompressSize {
+			w.buf = append(w.buf, b...)
+			return len(b), nil
+		}
+		w.buf = append(w.buf, b...)
+		if err := w.start(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.encoder != nil {
+		return w.encoder.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush starts the response, compressing it whatever its size, and writes out the compressed data buffered so far,
+// so that streamed responses are not held back
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		if err := w.start(true); err != nil {
+			return
+		}
+	}
+	if w.encoder != nil {
+		if err := w.encoder.Flush(); err != nil {
+			return
+		}
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over, so that protocols like WebSockets bypass compression
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("the response writer does not support hijacking")
+	}
+	w.decided = true
+	return hijacker.Hijack()
+}
+
+// start sends the header, choosing whether to compress, and then the buffered body
+func (w *compressWriter) start(bigEnough bool) error {
+	w.decided = true
+	header := w.Header()
+	if len(w.buf) > 0 && header.Get("Content-Type") == "" {
+		// sniffed here, as the server would otherwise sniff the compressed bytes
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if bodyAllowed(w.status) && (len(w.buf) > 0 || bigEnough) && compressible(header.Get("Content-Type")) {
+		header.Add("Vary", "Accept-Encoding")
+		if w.encoding != "" && bigEnough && header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" {
+			header.Set("Content-Encoding", w.encoding)
+			header.Del("Content-Length")
+			w.encoder = encoderPools[w.encoding].Get().(encoder)
+			w.encoder.Reset(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(w.buf)
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf)
+	}
+	w.buf = nil
+	return err
+}
+
+// close sends a small body as is and finishes a compressed one
+func (w *compressWriter) close() error {
+	if !w.decided {
+		if w.status == 0 {
+			return nil
+		}
+		return w.start(false)
+	}
+	if w.encoder == nil {
+		return nil
+	}
+	err := w.encoder.Close()
+	w.encoder.Reset(io.Discard)
+	encoderPools[w.encoding].Put(w.encoder)
+	w.encoder = nil
+	return err
+}
+
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
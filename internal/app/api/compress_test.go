@@ -0,0 +1,121 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                            "",
+		"gzip":                        encodingGzip,
+		"gzip, deflate, br":           encodingGzip,
+		"GZIP;q=0.5, deflate;q=0.8":   encodingDeflate,
+		"gzip;q=0, deflate":           encodingDeflate,
+		"gzip;q=0":                    "",
+		"identity":                    "",
+		"*":                           encodingGzip,
+		"*;q=0.5, gzip;q=0":           encodingDeflate,
+		"deflate;q=1.0, gzip;q=1":     encodingGzip,
+		"x-gzip":                      encodingGzip,
+		"gzip;q=invalid, deflate;q=0": "",
+	} {
+		assert.Equal(t, want, negotiateEncoding(header), header)
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	large := strings.Repeat("compressible ", minCompressSize)
+	serve := func(acceptEncoding string, handler http.HandlerFunc) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		compressResponseHandle(handler).ServeHTTP(w, r)
+		return w
+	}
+	text := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Length", "1")
+			_, _ = io.WriteString(w, body)
+		}
+	}
+
+	w := serve("gzip", text(large))
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	assert.Empty(t, w.Header().Get("Content-Length"), "the length of the uncompressed body is dropped")
+	gz, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(gz)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	w = serve("deflate", text(large))
+	assert.Equal(t, "deflate", w.Header().Get("Content-Encoding"))
+	zr, err := zlib.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err = io.ReadAll(zr)
+	require.NoError(t, err)
+	assert.Equal(t, large, string(body))
+
+	w = serve("gzip;q=0", text(large))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"), "caches must not serve the identity body to other clients")
+	assert.Equal(t, large, w.Body.String())
+
+	w = serve("gzip", text("small"))
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "small", w.Body.String())
+
+	w = serve("gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(bytes.Repeat([]byte{0}, 2*minCompressSize))
+	})
+	assert.Empty(t, w.Header().Get("Content-Encoding"), "images are compressed already")
+	assert.Empty(t, w.Header().Get("Vary"))
+
+	w = serve("gzip", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "<html><body>"+large)
+	})
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"), "the type is sniffed before compressing")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+
+	w = serve("gzip", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+	})
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"), "flushed streams are compressed whatever their size")
+	assert.True(t, w.Flushed)
+}
+
+func TestCompressResponseHijack(t *testing.T) {
+	ts := httptest.NewServer(accessLogHandle(compressResponseHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = buf.Flush()
+	}))))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hijacked", string(body))
+}
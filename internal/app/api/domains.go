@@ -0,0 +1,117 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// UnknownHostPrimary serves requests to unknown hosts as if they came to the primary domain
+	UnknownHostPrimary = "primary"
+	// UnknownHostNotFound answers requests to unknown hosts with `404 Not Found`
+	UnknownHostNotFound = "not_found"
+)
+
+// HandlerOption customizes the handler built by NewRequestHandler
+type HandlerOption func(*RequestHandler)
+
+// WithDomains adds the base URLs of the domains links can be created under besides the primary one
+func WithDomains(baseURLs []string) HandlerOption {
+	return func(h *RequestHandler) {
+		for _, baseURL := range baseURLs {
+			baseURL = strings.TrimRight(strings.TrimSpace(baseURL), "/")
+			host := hostOf(baseURL)
+			if host == "" || host == h.primaryHost {
+				continue
+			}
+			h.domains[host] = baseURL
+		}
+	}
+}
+
+// WithUnknownHost sets the response to redirect requests arriving on a host which is not a configured domain:
+// UnknownHostPrimary, UnknownHostNotFound or an absolute URL to redirect to
+func WithUnknownHost(response string) HandlerOption {
+	return func(h *RequestHandler) {
+		h.unknownHost = response
+	}
+}
+
+// ValidateUnknownHost checks a value accepted by WithUnknownHost
+func ValidateUnknownHost(response string) error {
+	switch response {
+	case UnknownHostPrimary, UnknownHostNotFound:
+		return nil
+	}
+	if u, err := url.Parse(response); err != nil || !u.IsAbs() {
+		return fmt.Errorf("unknown host response %q is neither %q, %q nor an absolute URL", response, UnknownHostPrimary, UnknownHostNotFound)
+	}
+	return nil
+}
+
+// hostDomain returns the domain the request arrived on, which is empty for the primary one
+func (h *RequestHandler) hostDomain(r *http.Request) (string, bool) {
+	return h.LookupDomain(r.Host)
+}
+
+// LookupDomain matches the host with and without the port against the configured domains
+func (h *RequestHandler) LookupDomain(host string) (string, bool) {
+	host = strings.ToLower(host)
+	candidates := []string{host}
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		candidates = append(candidates, hostname)
+	}
+	for _, candidate := range candidates {
+		if candidate == h.primaryHost {
+			return "", true
+		}
+		if _, ok := h.domains[candidate]; ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// creationDomain picks the domain a new link is created under: the requested one if any,
+// then the host the request arrived on, then the primary domain
+func (h *RequestHandler) creationDomain(r *http.Request, requested string) (string, bool) {
+	if requested != "" {
+		return h.LookupDomain(requested)
+	}
+	domain, _ := h.hostDomain(r)
+	return domain, true
+}
+
+// handleUnknownHost answers a redirect request arriving on an unknown host;
+// it returns false when the request should be served as a primary domain one
+func (h *RequestHandler) handleUnknownHost(w http.ResponseWriter, r *http.Request) bool {
+	switch h.unknownHost {
+	case "", UnknownHostPrimary:
+		return false
+	case UnknownHostNotFound:
+		http.NotFound(w, r)
+	default:
+		http.Redirect(w, r, h.unknownHost, http.StatusFound)
+	}
+	return true
+}
+
+// ShortURL is the full short URL of the ID under the domain
+func (h *RequestHandler) ShortURL(domain, id string) string {
+	baseURL, ok := h.domains[domain]
+	if !ok {
+		baseURL = h.baseURL
+	}
+	return baseURL + "/" + id
+}
+
+func hostOf(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
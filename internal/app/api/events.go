@@ -0,0 +1,112 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+// eventsKeepAlive is how often a comment is sent on idle streams, so that proxies do not close them
+const eventsKeepAlive = 15 * time.Second
+
+// WithEventBus enables the event stream at `GET /api/events`
+func WithEventBus(bus *events.Bus) HandlerOption {
+	return func(h *RequestHandler) {
+		h.bus = bus
+	}
+}
+
+// handleGetEvents streams the events of links as Server-Sent Events, i.e. `GET /api/events`.
+// Callers see the events of their own links unless their key has the events:all scope, which allows any `owner`
+// or none; `link` narrows the stream to a single link. Streams resume after `Last-Event-ID`, either the header
+// set by reconnecting EventSource clients or the `last_event_id` query parameter, as far as the buffer reaches.
+// The write deadline is extended by the write timeout before every write, so that streams outlive it
+func (h *RequestHandler) handleGetEvents(w http.ResponseWriter, r *http.Request, writeTimeout time.Duration) {
+	if h.bus == nil {
+		http.Error(w, "Event stream is disabled", http.StatusNotFound)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	identity, _ := auth.IdentityFromContext(r.Context())
+	owner := r.URL.Query().Get("owner")
+	if !identity.HasScope(auth.ScopeEventsAll) {
+		if owner != "" && owner != identity.UserID {
+			http.Error(w, "API key lacks scope "+string(auth.ScopeEventsAll), http.StatusForbidden)
+			return
+		}
+		owner = identity.UserID
+	}
+	linkID := r.URL.Query().Get("link")
+	domain, _ := h.hostDomain(r)
+	filter := func(event events.Event) bool {
+		if owner != "" && event.Link.UserID != owner {
+			return false
+		}
+		return linkID == "" || event.Link.ID == linkID && event.Link.Domain == domain
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	subscriber, backlog := h.bus.Subscribe(lastEventID, filter)
+	defer h.bus.Unsubscribe(subscriber)
+
+	extendWriteDeadline(r, writeTimeout)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, entry := range backlog {
+		if !h.writeEvent(w, r, entry) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case entry, ok := <-subscriber.Entries():
+			if !ok {
+				// the stream fell behind; the client reconnects and resumes from the buffer
+				return
+			}
+			extendWriteDeadline(r, writeTimeout)
+			if !h.writeEvent(w, r, entry) {
+				return
+			}
+		case <-keepAlive.C:
+			extendWriteDeadline(r, writeTimeout)
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (h *RequestHandler) writeEvent(w http.ResponseWriter, r *http.Request, entry events.Entry) bool {
+	data, err := json.Marshal(entry.Event)
+	if err != nil {
+		logger.Error(r.Context(), "could not marshal event", "event", entry.Event.ID, "error", err)
+		return true
+	}
+	message := "id: " + entry.ID + "\nevent: " + string(entry.Event.Type) + "\ndata: " + string(data) + "\n\n"
+	if _, err := w.Write([]byte(message)); err != nil {
+		return false
+	}
+	return true
+}
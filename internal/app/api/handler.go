@@ -2,26 +2,50 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/storage"
 	"github.com/tsupko/shortener/internal/app/util"
 
 	"github.com/tsupko/shortener/internal/app/service"
 )
 
 type RequestHandler struct {
-	service service.ShorteningService
-	baseURL string
+	service      service.ShorteningService
+	baseURL      string
+	primaryHost  string
+	domains      map[string]string
+	unknownHost  string
+	bus          *events.Bus
+	maxURLLength int
 }
 
-func NewRequestHandler(service *service.ShorteningService, baseURL string) *RequestHandler {
-	return &RequestHandler{
-		service: *service,
-		baseURL: baseURL,
+func NewRequestHandler(service *service.ShorteningService, baseURL string, opts ...HandlerOption) *RequestHandler {
+	h := &RequestHandler{
+		service:     *service,
+		baseURL:     baseURL,
+		primaryHost: hostOf(baseURL),
+		domains:     make(map[string]string),
+		unknownHost: UnknownHostPrimary,
+
+		maxURLLength: DefaultMaxURLLength,
 	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
 }
 
 // handlePostRequest handles POST requests without path parameters, i.e. `POST /`,
@@ -32,47 +56,105 @@ func (h *RequestHandler) handlePostRequest(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	originalURL, _ := util.ReadRequestBody(r)
+	originalURL, err := util.ReadRequestBody(r)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
 	if len(originalURL) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	id := h.service.Put(originalURL)
+	if err := h.checkURLLength(originalURL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, _ := h.creationDomain(r, "")
+	id, err := h.service.Put(r.Context(), storage.Link{UserID: userID(r), Domain: domain, URL: originalURL})
+	if err != nil {
+		writeNotStored(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusCreated)
-	_, err := w.Write([]byte(h.makeShortURL(id)))
+	_, err = w.Write([]byte(h.ShortURL(domain, id)))
 	if err != nil {
-		log.Printf("Error while writing body body: %v\n", err)
+		logger.Error(r.Context(), "could not write response body", "error", err)
 	}
 }
 
 // handleGetRequest handles GET requests with a path parameter `id`, i.e. `GET /{id}`,
-// and does not support other HTTP methods
-func (h *RequestHandler) handleGetRequest(w http.ResponseWriter, r *http.Request) {
+// and does not support other HTTP methods; the trusted proxies tell the client address of visitors without cookies
+func (h *RequestHandler) handleGetRequest(w http.ResponseWriter, r *http.Request, trustedProxies []*net.IPNet) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Requests other than GET are not allowed to `/{id}`", http.StatusMethodNotAllowed)
 		return
 	}
 
-	id := strings.TrimLeft(r.URL.Path, "/")
-	originalURL := h.service.Get(id)
+	domain, ok := h.hostDomain(r)
+	if !ok && h.handleUnknownHost(w, r) {
+		return
+	}
+	id, pathSuffix := splitIDPath(r.URL.EscapedPath())
+	if isPreview(r, id) {
+		h.handlePreview(w, r, domain, strings.TrimSuffix(id, "+"))
+		return
+	}
+	visitor, issued := visitorID(r, trustedProxies)
+	visit := service.Visit{
+		Header:     r.Header,
+		Time:       time.Now(),
+		PathSuffix: pathSuffix,
+		RawQuery:   r.URL.RawQuery,
+		Visitor:    visitor,
+	}
+	link, _ := h.service.Get(r.Context(), domain, id, visit)
+	if link.Deleted {
+		http.Error(w, "Link is deleted", http.StatusGone)
+		return
+	}
+	destination, err := service.Destination(link, visit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keepVisitorID(w, link, visitor, issued)
+	if link.Options.Interstitial && h.isExternal(destination) {
+		h.renderPreview(w, r, link, destination, true)
+		return
+	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.Header().Set("Location", originalURL)
+	w.Header().Set("Location", destination)
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
+// splitIDPath splits the escaped request path into the link ID and the escaped path following it
+func splitIDPath(escapedPath string) (string, string) {
+	escapedPath = strings.TrimLeft(escapedPath, "/")
+	escapedID := escapedPath
+	suffix := ""
+	if slash := strings.IndexByte(escapedPath, '/'); slash >= 0 {
+		escapedID, suffix = escapedPath[:slash], escapedPath[slash+1:]
+	}
+	id, err := url.PathUnescape(escapedID)
+	if err != nil {
+		id = escapedID
+	}
+	return id, suffix
+}
+
 func (h *RequestHandler) handleJSONPost(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		err := r.Body.Close()
 		if err != nil {
-			log.Printf("Error while closing request body: %v\n", err)
+			logger.Error(r.Context(), "could not close request body", "error", err)
 		}
 	}()
 	resBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error while reading request body: %v\n", err)
+		writeBodyError(w, err)
 		return
 	}
 
@@ -81,31 +163,268 @@ func (h *RequestHandler) handleJSONPost(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Could not unmarshal request: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	hash := h.service.Put(value.URL)
-	response := response{h.makeShortURL(hash)}
-	responseString, err := json.Marshal(response)
+	domain, ok := h.creationDomain(r, value.Domain)
+	if !ok {
+		http.Error(w, "Unknown domain: "+value.Domain, http.StatusBadRequest)
+		return
+	}
+	if err := service.ValidatePassQuery(value.PassQuery); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := service.ValidateRules(value.Rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := service.ValidateVariants(value.Variants); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if value.URL == "" && len(value.Variants) > 0 {
+		value.URL = value.Variants[0].Destination
+	}
+	if err := h.checkURLLength(linkURLs(value.URL, value.Rules, value.Variants)...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hash, err := h.service.Put(r.Context(), storage.Link{
+		UserID: userID(r),
+		Domain: domain,
+		URL:    value.URL,
+		Options: storage.LinkOptions{
+			Interstitial: value.Interstitial,
+			PassQuery:    value.PassQuery,
+			PassPath:     value.PassPath,
+		},
+		Rules:    value.Rules,
+		Variants: value.Variants,
+	})
+	if err != nil {
+		writeNotStored(w, r, err)
+		return
+	}
+	response := response{Result: h.ShortURL(domain, hash)}
+	if value.QR {
+		response.QR = h.makeQRURL(domain, hash)
+	}
+	h.writeJSON(w, r, http.StatusCreated, response)
+}
+
+// handleBatchPost shortens a JSON array of URLs at once, i.e. `POST /api/shorten/batch`;
+// nothing is created unless all of them are valid
+func (h *RequestHandler) handleBatchPost(w http.ResponseWriter, r *http.Request) {
+	var batch []batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if len(batch) == 0 || len(batch) > maxBatchSize {
+		http.Error(w, "A batch must have from 1 to "+strconv.Itoa(maxBatchSize)+" URLs", http.StatusBadRequest)
+		return
+	}
+	for _, item := range batch {
+		if err := service.ValidateURL(item.OriginalURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := h.checkURLLength(item.OriginalURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	domain, _ := h.creationDomain(r, "")
+	responses := make([]batchResponse, 0, len(batch))
+	for _, item := range batch {
+		id, err := h.service.Put(r.Context(), storage.Link{UserID: userID(r), Domain: domain, URL: item.OriginalURL})
+		if err != nil {
+			writeNotStored(w, r, err)
+			return
+		}
+		responses = append(responses, batchResponse{CorrelationID: item.CorrelationID, ShortURL: h.ShortURL(domain, id)})
+	}
+	h.writeJSON(w, r, http.StatusCreated, responses)
+}
+
+// handleGetUserURLs lists the links of the caller, i.e. `GET /api/user/urls`
+func (h *RequestHandler) handleGetUserURLs(w http.ResponseWriter, r *http.Request) {
+	links := h.service.GetUserLinks(r.Context(), userID(r))
+	if len(links) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	userURLs := make([]userURL, 0, len(links))
+	for _, link := range links {
+		userURLs = append(userURLs, userURL{ShortURL: h.ShortURL(link.Domain, link.ID), OriginalURL: link.URL})
+	}
+	h.writeJSON(w, r, http.StatusOK, userURLs)
+}
+
+// handleDeleteUserURLs deletes the links of the caller listed in a JSON array of IDs, i.e. `DELETE /api/user/urls`
+func (h *RequestHandler) handleDeleteUserURLs(w http.ResponseWriter, r *http.Request) {
+	var ids []string
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	domain, _ := h.hostDomain(r)
+	h.service.Delete(r.Context(), userID(r), domain, ids)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleGetStats reports the click statistics of a link owned by the caller, i.e. `GET /api/stats/{id}`
+func (h *RequestHandler) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	domain, _ := h.hostDomain(r)
+	link, ok := h.service.Stats(r.Context(), userID(r), domain, id)
+	if !ok {
+		http.Error(w, "Link is not found", http.StatusNotFound)
+		return
+	}
+	linkStats := stats{
+		ID:          link.ID,
+		ShortURL:    h.ShortURL(link.Domain, link.ID),
+		OriginalURL: link.URL,
+		CreatedAt:   link.CreatedAt,
+		Clicks:      link.Clicks,
+	}
+	for _, variant := range link.Variants {
+		linkStats.Variants = append(linkStats.Variants, variantStats{
+			Destination: variant.Destination,
+			Weight:      variant.Weight,
+			Clicks:      variant.Clicks,
+		})
+	}
+	h.writeJSON(w, r, http.StatusOK, linkStats)
+}
+
+// handleGetRules lists the redirect rules of a link owned by the caller, i.e. `GET /api/user/urls/{id}/rules`
+func (h *RequestHandler) handleGetRules(w http.ResponseWriter, r *http.Request) {
+	domain, _ := h.hostDomain(r)
+	link, ok := h.service.Stats(r.Context(), userID(r), domain, chi.URLParam(r, "id"))
+	if !ok {
+		http.Error(w, "Link is not found", http.StatusNotFound)
+		return
+	}
+	rules := link.Rules
+	if rules == nil {
+		rules = []storage.Rule{}
+	}
+	h.writeJSON(w, r, http.StatusOK, rules)
+}
+
+// handlePutRules replaces the redirect rules of a link owned by the caller, i.e. `PUT /api/user/urls/{id}/rules`
+func (h *RequestHandler) handlePutRules(w http.ResponseWriter, r *http.Request) {
+	var rules []storage.Rule
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	if err := h.checkURLLength(linkURLs("", rules, nil)...); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	domain, _ := h.hostDomain(r)
+	err := h.service.SetRules(r.Context(), userID(r), domain, chi.URLParam(r, "id"), rules)
+	switch {
+	case errors.Is(err, service.ErrNotFound):
+		http.Error(w, "Link is not found", http.StatusNotFound)
+	case errors.Is(err, service.ErrNotStored):
+		writeNotStored(w, r, err)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		h.writeJSON(w, r, http.StatusOK, rules)
+	}
+}
+
+// writeNotStored answers with `503 Service Unavailable` a request whose link the storage did not take,
+// which happens while the storage loads or once the request times out, so that clients retry it
+func writeNotStored(w http.ResponseWriter, r *http.Request, err error) {
+	logger.Warn(r.Context(), "link is not stored", "error", err)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(notStoredRetryAfter)))
+	http.Error(w, "Link could not be stored, retry later", http.StatusServiceUnavailable)
+}
+
+func (h *RequestHandler) writeJSON(w http.ResponseWriter, r *http.Request, statusCode int, value interface{}) {
+	responseString, err := json.Marshal(value)
 	if err != nil {
 		http.Error(w, "Could not marshal response: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	w.WriteHeader(statusCode)
 
 	_, err = w.Write(responseString)
 	if err != nil {
-		log.Printf("Error while writing response: %v\n", err)
+		logger.Error(r.Context(), "could not write response", "error", err)
 	}
 }
 
-func (h *RequestHandler) makeShortURL(id string) string {
-	return h.baseURL + "/" + id
+// linkURLs lists the destinations of a link
+func linkURLs(url string, rules []storage.Rule, variants []storage.Variant) []string {
+	urls := []string{url}
+	for _, rule := range rules {
+		urls = append(urls, rule.Destination)
+	}
+	for _, variant := range variants {
+		urls = append(urls, variant.Destination)
+	}
+	return urls
+}
+
+// userID returns the ID of the authenticated caller, or an empty string for anonymous ones
+func userID(r *http.Request) string {
+	identity, _ := auth.IdentityFromContext(r.Context())
+	return identity.UserID
 }
 
 type request struct {
-	URL string `json:"url"`
+	URL          string            `json:"url"`
+	Domain       string            `json:"domain,omitempty"`
+	Interstitial bool              `json:"interstitial,omitempty"`
+	PassQuery    string            `json:"pass_query,omitempty"`
+	PassPath     bool              `json:"pass_path,omitempty"`
+	Rules        []storage.Rule    `json:"rules,omitempty"`
+	Variants     []storage.Variant `json:"variants,omitempty"`
+	QR           bool              `json:"qr,omitempty"`
 }
 
 type response struct {
 	Result string `json:"result"`
+	QR     string `json:"qr,omitempty"`
+}
+
+// maxBatchSize bounds the URLs shortened by a single batch request
+const maxBatchSize = 1000
+
+type batchRequest struct {
+	CorrelationID string `json:"correlation_id"`
+	OriginalURL   string `json:"original_url"`
+}
+
+type batchResponse struct {
+	CorrelationID string `json:"correlation_id"`
+	ShortURL      string `json:"short_url"`
+}
+
+type userURL struct {
+	ShortURL    string `json:"short_url"`
+	OriginalURL string `json:"original_url"`
+}
+
+type stats struct {
+	ID          string    `json:"id"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	CreatedAt   time.Time `json:"created_at"`
+	Clicks      int64     `json:"clicks"`
+	// Variants break the clicks down by the variant they were served by
+	Variants []variantStats `json:"variants,omitempty"`
+}
+
+type variantStats struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+	Clicks      int64  `json:"clicks"`
 }
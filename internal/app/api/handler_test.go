@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -8,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/tsupko/shortener/internal/app/service"
 	"github.com/tsupko/shortener/internal/app/storage"
@@ -104,7 +107,7 @@ func TestHandlers(t *testing.T) {
 			w := httptest.NewRecorder()
 			switch tt.request.method {
 			case http.MethodGet:
-				h.handleGetRequest(w, request)
+				h.handleGetRequest(w, request, nil)
 			case http.MethodPost:
 				if tt.request.path == "/" {
 					h.handlePostRequest(w, request)
@@ -131,3 +134,100 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestDomains(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress,
+		WithDomains([]string{"https://a.example", "https://b.example/"}),
+		WithUnknownHost(UnknownHostNotFound),
+	)
+
+	w := httptest.NewRecorder()
+	h.handleJSONPost(w, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","domain":"a.example"}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	require.True(t, strings.HasPrefix(created.Result, "https://a.example/"))
+	id := strings.TrimPrefix(created.Result, "https://a.example/")
+
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("https://go.dev"))
+	request.Host = "b.example:443"
+	w = httptest.NewRecorder()
+	h.handlePostRequest(w, request)
+	assert.True(t, strings.HasPrefix(w.Body.String(), "https://b.example/"))
+
+	for host, want := range map[string]string{"a.example": "https://ya.ru", "b.example": "", "localhost:8080": ""} {
+		request := httptest.NewRequest(http.MethodGet, "/"+id, nil)
+		request.Host = host
+		w := httptest.NewRecorder()
+		h.handleGetRequest(w, request, nil)
+		assert.Equal(t, http.StatusTemporaryRedirect, w.Code, host)
+		assert.Equal(t, want, w.Header().Get("Location"), host)
+	}
+
+	request = httptest.NewRequest(http.MethodGet, "/"+id, nil)
+	request.Host = "unknown.example"
+	w = httptest.NewRecorder()
+	h.handleGetRequest(w, request, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	h.handleJSONPost(w, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","domain":"unknown.example"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestPreview(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+
+	w := httptest.NewRecorder()
+	h.handleJSONPost(w, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru/?q=<b>","interstitial":true}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := strings.TrimPrefix(created.Result, util.ServerAddress+"/")
+
+	for _, path := range []string{"/" + id + "+", "/" + id + "?preview"} {
+		w = httptest.NewRecorder()
+		h.handleGetRequest(w, httptest.NewRequest(http.MethodGet, path, nil), nil)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+		assert.Contains(t, w.Body.String(), "https://ya.ru/?q=&lt;b&gt;")
+		assert.Contains(t, w.Body.String(), "Continue to the destination")
+		assert.NotContains(t, w.Body.String(), "external website")
+	}
+
+	w = httptest.NewRecorder()
+	h.handleGetRequest(w, httptest.NewRequest(http.MethodGet, "/"+id, nil), nil)
+	assert.Equal(t, http.StatusOK, w.Code, "interstitial is shown instead of the redirect")
+	assert.Contains(t, w.Body.String(), "external website")
+
+	link, _ := h.service.Preview(context.Background(), "", id)
+	assert.Equal(t, int64(1), link.Clicks, "only the interstitial counts as a click")
+
+	w = httptest.NewRecorder()
+	h.handleGetRequest(w, httptest.NewRequest(http.MethodGet, "/missing+", nil), nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestPassthrough(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+
+	w := httptest.NewRecorder()
+	h.handleJSONPost(w, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://docs.example/base?lang=en","pass_query":"request","pass_path":true}`)))
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created response
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	id := strings.TrimPrefix(created.Result, util.ServerAddress+"/")
+
+	w = httptest.NewRecorder()
+	h.handleGetRequest(w, httptest.NewRequest(http.MethodGet, "/"+id+"/guide/some%20page?lang=de&utm_source=x", nil), nil)
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "https://docs.example/base/guide/some%20page?lang=de&utm_source=x", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	h.handleGetRequest(w, httptest.NewRequest(http.MethodGet, "/"+id+"/../admin", nil), nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	h.handleJSONPost(w, httptest.NewRequest(http.MethodPost, "/api/shorten", strings.NewReader(`{"url":"https://ya.ru","pass_query":"merge"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
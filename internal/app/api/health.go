@@ -0,0 +1,106 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+// readinessCheckTimeout bounds the checks of the storage, so that probes answer before they time out themselves
+const readinessCheckTimeout = 2 * time.Second
+
+const (
+	statusOK      = "ok"
+	statusReady   = "ready"
+	statusUnready = "not ready"
+
+	checkLoading  = "loading"
+	checkFailing  = "failing"
+	checkDraining = "shutting down"
+)
+
+// Readiness tells whether the instance can serve: its storage is loaded and works, and it is not shutting down
+type Readiness struct {
+	store    storage.Storage
+	draining int32
+}
+
+// NewReadiness checks the storage if it implements storage.Checker or storage.Loader; it may be nil
+func NewReadiness(store storage.Storage) *Readiness {
+	return &Readiness{store: store}
+}
+
+// WithReadiness reports the readiness at `GET /readyz`; by default only shutdown is reported
+func WithReadiness(readiness *Readiness) RouterOption {
+	return func(o *routerOptions) {
+		o.readiness = readiness
+	}
+}
+
+// Drain makes the instance not ready, so that it gets no new traffic while it shuts down
+func (r *Readiness) Drain() {
+	atomic.StoreInt32(&r.draining, 1)
+}
+
+type healthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+type checkResult struct {
+	Status   string                `json:"status"`
+	Error    string                `json:"error,omitempty"`
+	Progress *storage.LoadProgress `json:"progress,omitempty"`
+}
+
+// check runs all checks; the instance is ready when they all pass
+func (r *Readiness) check(ctx context.Context) (map[string]checkResult, bool) {
+	checks := map[string]checkResult{"shutdown": {Status: statusOK}}
+	if atomic.LoadInt32(&r.draining) != 0 {
+		checks["shutdown"] = checkResult{Status: checkDraining}
+	}
+	if loader, ok := r.store.(storage.Loader); ok {
+		progress := loader.Progress()
+		if progress.Loaded {
+			checks["load"] = checkResult{Status: statusOK, Progress: &progress}
+		} else {
+			checks["load"] = checkResult{Status: checkLoading, Progress: &progress}
+		}
+	}
+	if checker, ok := r.store.(storage.Checker); ok {
+		ctx, cancel := context.WithTimeout(ctx, readinessCheckTimeout)
+		defer cancel()
+		if err := checker.Check(ctx); err != nil {
+			checks["storage"] = checkResult{Status: checkFailing, Error: err.Error()}
+		} else {
+			checks["storage"] = checkResult{Status: statusOK}
+		}
+	}
+	for _, result := range checks {
+		if result.Status != statusOK {
+			return checks, false
+		}
+	}
+	return checks, true
+}
+
+// handleHealthz tells that the process is alive, i.e. `GET /healthz`
+func (h *RequestHandler) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	h.writeJSON(w, r, http.StatusOK, healthResponse{Status: statusOK})
+}
+
+// handleReadyz tells whether the instance can serve, i.e. `GET /readyz`, with the detail of every check;
+// it answers `503 Service Unavailable` while the storage loads, when it fails and once the instance shuts down
+func (h *RequestHandler) handleReadyz(w http.ResponseWriter, r *http.Request, readiness *Readiness) {
+	w.Header().Set("Cache-Control", "no-store")
+	checks, ready := readiness.check(r.Context())
+	if !ready {
+		h.writeJSON(w, r, http.StatusServiceUnavailable, healthResponse{Status: statusUnready, Checks: checks})
+		return
+	}
+	h.writeJSON(w, r, http.StatusOK, healthResponse{Status: statusReady, Checks: checks})
+}
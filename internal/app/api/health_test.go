@@ -0,0 +1,95 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+	"github.com/tsupko/shortener/internal/app/util"
+)
+
+// loadingStorage is still loading and fails its check
+type loadingStorage struct {
+	storage.TestStorage
+}
+
+func (loadingStorage) Progress() storage.LoadProgress {
+	return storage.LoadProgress{Records: 10, Bytes: 1000, TotalBytes: 4000}
+}
+
+func (loadingStorage) Check(context.Context) error {
+	return errors.New("disk is full")
+}
+
+func getReadyz(t *testing.T, ts *httptest.Server) (int, healthResponse) {
+	resp, body := testRequest(t, ts, "GET", "/readyz", "")
+	closeBody(t, resp)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	var got healthResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &got))
+	return resp.StatusCode, got
+}
+
+func TestHealthz(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "GET", "/healthz", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"status":"ok"}`, body)
+}
+
+func TestReadyz(t *testing.T) {
+	store := storage.NewFileStorage(filepath.Join(t.TempDir(), "links.log"))
+	defer store.Close()
+	store.Put(context.Background(), storage.Link{ID: "a", URL: "https://a.example"})
+	readiness := NewReadiness(store)
+	h := NewRequestHandler(service.NewShorteningService(store), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithReadiness(readiness)))
+	defer ts.Close()
+
+	status, got := getReadyz(t, ts)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "ready", got.Status)
+	assert.Equal(t, "ok", got.Checks["shutdown"].Status)
+	assert.Equal(t, "ok", got.Checks["storage"].Status)
+	assert.Equal(t, "ok", got.Checks["load"].Status)
+	require.NotNil(t, got.Checks["load"].Progress)
+	assert.True(t, got.Checks["load"].Progress.Loaded)
+
+	readiness.Drain()
+	status, got = getReadyz(t, ts)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "not ready", got.Status)
+	assert.Equal(t, "shutting down", got.Checks["shutdown"].Status)
+	assert.Equal(t, "ok", got.Checks["storage"].Status)
+
+	resp, _ := testRequest(t, ts, "GET", "/a", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "requests are still served while draining")
+}
+
+func TestReadyzWhileLoading(t *testing.T) {
+	store := loadingStorage{}
+	h := NewRequestHandler(service.NewShorteningService(store), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithReadiness(NewReadiness(store))))
+	defer ts.Close()
+
+	status, got := getReadyz(t, ts)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "loading", got.Checks["load"].Status)
+	assert.Equal(t, &storage.LoadProgress{Records: 10, Bytes: 1000, TotalBytes: 4000}, got.Checks["load"].Progress)
+	assert.Equal(t, "failing", got.Checks["storage"].Status)
+	assert.Equal(t, "disk is full", got.Checks["storage"].Error)
+	assert.Equal(t, "ok", got.Checks["shutdown"].Status)
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	maxIdempotentResponseSize = 1 << 20
+	// idempotencyWait is how long a repeat waits for the first request with the key to finish before `409 Conflict`
+	idempotencyWait = 5 * time.Second
+	// DefaultIdempotencyTTL is how long responses are kept by default
+	DefaultIdempotencyTTL = 24 * time.Hour
+)
+
+// replayedHeaders are the response headers stored with the response; others, such as rate limits, are fresh on replays.
+// Cookies are never stored, as they would hand the user of the caller to whoever repeats the request
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+// idempotency makes requests carrying an `Idempotency-Key` header safe to retry: the first response is stored
+// for the caller and the key and served again to repeats. Reusing a key for a different request is rejected
+// with `422 Unprocessable Entity`. Keys of anonymous callers are ignored, as they get a new user on every request
+// and could only be told apart by their address, which others may share
+type idempotency struct {
+	store    storage.IdempotencyStorage
+	ttl      time.Duration
+	wait     time.Duration
+	inflight map[string]chan struct{}
+	mtx      sync.Mutex
+}
+
+func idempotencyHandle(store storage.IdempotencyStorage, ttl time.Duration) func(http.Handler) http.Handler {
+	return (&idempotency{store: store, ttl: ttl, wait: idempotencyWait, inflight: make(map[string]chan struct{})}).handle
+}
+
+func (i *idempotency) handle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		identity, ok := auth.IdentityFromContext(r.Context())
+		if key == "" || !ok || isIssuedUser(r.Context()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		caller := "user:" + identity.UserID
+		if identity.KeyID != "" {
+			caller = "key:" + identity.KeyID
+		}
+		sum := sha256.Sum256([]byte(caller + "\n" + key))
+		i.serve(w, r, next, hex.EncodeToString(sum[:]))
+	})
+}
+
+func (i *idempotency) serve(w http.ResponseWriter, r *http.Request, next http.Handler, key string) {
+	body := newFingerprintBody(r)
+	wait := time.NewTimer(i.wait)
+	defer wait.Stop()
+	for {
+		if stored, ok := i.store.GetResponse(r.Context(), key); ok {
+			if stored.Fingerprint != body.sum() {
+				http.Error(w, "Idempotency-Key is already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			replay(w, stored)
+			return
+		}
+
+		i.mtx.Lock()
+		done, busy := i.inflight[key]
+		if !busy {
+			i.inflight[key] = make(chan struct{})
+			i.mtx.Unlock()
+			break
+		}
+		i.mtx.Unlock()
+		select {
+		case <-done:
+		case <-wait.C:
+			http.Error(w, "A request with the same Idempotency-Key is in progress", http.StatusConflict)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	defer func() {
+		i.mtx.Lock()
+		close(i.inflight[key])
+		delete(i.inflight, key)
+		i.mtx.Unlock()
+	}()
+
+	recorder := &responseRecorder{ResponseWriter: w}
+	r.Body = body
+	next.ServeHTTP(recorder, r)
+
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	// server errors are not stored, so that the request can be retried
+	if recorder.status >= http.StatusInternalServerError || recorder.tooLarge {
+		return
+	}
+	header := make(map[string][]string)
+	for _, name := range replayedHeaders {
+		if values := w.Header().Values(name); len(values) > 0 {
+			header[name] = values
+		}
+	}
+	err := i.store.PutResponse(r.Context(), storage.IdempotentResponse{
+		Key:         key,
+		Fingerprint: body.sum(),
+		Status:      recorder.status,
+		Header:      header,
+		Body:        recorder.body.Bytes(),
+		ExpiresAt:   time.Now().Add(i.ttl),
+	})
+	if err != nil {
+		logger.Error(r.Context(), "could not store idempotent response", "error", err)
+	}
+}
+
+func replay(w http.ResponseWriter, stored storage.IdempotentResponse) {
+	for name, values := range stored.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	_, _ = w.Write(stored.Body)
+}
+
+// fingerprintBody hashes the request line and the body as it is read; the rest of the body is read
+// when it is closed or summed, so that requests are compared as a whole even if handlers stop reading early
+type fingerprintBody struct {
+	io.ReadCloser
+	hash    hash.Hash
+	drained bool
+}
+
+func newFingerprintBody(r *http.Request) *fingerprintBody {
+	b := &fingerprintBody{ReadCloser: r.Body, hash: sha256.New()}
+	_, _ = io.WriteString(b.hash, r.Method+" "+r.URL.RequestURI()+"\n")
+	return b
+}
+
+func (b *fingerprintBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+func (b *fingerprintBody) Close() error {
+	b.drain()
+	return b.ReadCloser.Close()
+}
+
+func (b *fingerprintBody) sum() string {
+	b.drain()
+	return hex.EncodeToString(b.hash.Sum(nil))
+}
+
+func (b *fingerprintBody) drain() {
+	if !b.drained {
+		b.drained = true
+		_, _ = io.Copy(b.hash, b.ReadCloser)
+	}
+}
+
+// responseRecorder passes the response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	tooLarge bool
+}
+
+func (w *responseRecorder) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *responseRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(b) > maxIdempotentResponseSize {
+		w.tooLarge = true
+	} else if !w.tooLarge {
+		w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedSubnet parses the CIDR of the network served `GET /api/internal/stats`; an empty string is no network
+func ParseTrustedSubnet(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted subnet %q: %w", s, err)
+	}
+	return network, nil
+}
+
+// WithTrustedSubnet serves `GET /api/internal/stats` to clients from the network, nobody by default.
+// Clients are identified as for rate limits, see WithTrustedProxies
+func WithTrustedSubnet(subnet *net.IPNet) RouterOption {
+	return func(o *routerOptions) {
+		o.trustedSubnet = subnet
+	}
+}
+
+// trustedSubnetHandle answers clients outside the subnet with `403 Forbidden`; forwarding headers are only
+// believed from trusted proxies
+func trustedSubnetHandle(subnet *net.IPNet, trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(clientIP(r, trustedProxies))
+			if subnet == nil || ip == nil || !subnet.Contains(ip) {
+				http.Error(w, "Internal statistics are only served to the trusted subnet", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type internalStatsResponse struct {
+	URLs  int `json:"urls"`
+	Users int `json:"users"`
+}
+
+// handleGetInternalStats returns the number of links which are not deleted and of the users owning them,
+// i.e. `GET /api/internal/stats`
+func (h *RequestHandler) handleGetInternalStats(w http.ResponseWriter, r *http.Request) {
+	links, users := h.service.Totals(r.Context())
+	h.writeJSON(w, r, http.StatusOK, internalStatsResponse{URLs: links, Users: users})
+}
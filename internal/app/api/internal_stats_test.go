@@ -0,0 +1,73 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+	"github.com/tsupko/shortener/internal/app/util"
+)
+
+func TestInternalStats(t *testing.T) {
+	subnet, err := ParseTrustedSubnet("127.0.0.0/8")
+	require.NoError(t, err)
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithTrustedSubnet(subnet)))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`)
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/b"}`)
+	closeBody(t, resp)
+
+	resp, body := testRequest(t, ts, "GET", "/api/internal/stats", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"urls":2,"users":2}`, body)
+
+	resp, _ = testRequest(t, ts, "GET", "/api/internal/stats", "", "X-Real-IP", "192.0.2.1")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "X-Real-IP of untrusted peers is ignored")
+}
+
+func TestInternalStatsBehindTrustedProxy(t *testing.T) {
+	subnet, err := ParseTrustedSubnet("10.0.0.0/8")
+	require.NoError(t, err)
+	proxies, err := ParseTrustedProxies("127.0.0.1")
+	require.NoError(t, err)
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithTrustedSubnet(subnet), WithTrustedProxies(proxies)))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/api/internal/stats", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = testRequest(t, ts, "GET", "/api/internal/stats", "", "X-Real-IP", "10.1.2.3")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "X-Real-IP of trusted proxies identifies the client")
+	resp, _ = testRequest(t, ts, "GET", "/api/internal/stats", "", "X-Forwarded-For", "10.1.2.3, 192.0.2.1")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestInternalStatsWithoutSubnet(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/api/internal/stats", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestParseTrustedSubnet(t *testing.T) {
+	subnet, err := ParseTrustedSubnet("")
+	assert.NoError(t, err)
+	assert.Nil(t, subnet)
+	_, err = ParseTrustedSubnet("10.0.0.1")
+	assert.Error(t, err)
+}
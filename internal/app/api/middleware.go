@@ -2,86 +2,54 @@ package api
 
 import (
 	"compress/gzip"
+	"compress/zlib"
 	"io"
-	"log"
 	"net/http"
 	"strings"
-)
-
-var _ http.ResponseWriter = gzipWriter{}
-
-type gzipWriter struct {
-	http.ResponseWriter
-	Writer io.Writer
-}
 
-func (w gzipWriter) Write(b []byte) (int, error) {
-	return w.Writer.Write(b)
-}
+	"github.com/tsupko/shortener/internal/app/logger"
+)
 
-func gzipResponseHandle(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		acceptEncodingHeader := r.Header.Get("Accept-Encoding")
-		if !strings.Contains(acceptEncodingHeader, "gzip") {
-			next.ServeHTTP(w, r)
-			return
-		}
-		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		if err != nil {
-			_, err := io.WriteString(w, err.Error())
-			if err != nil {
-				http.Error(w, "Could not compress response: "+err.Error(), http.StatusInternalServerError)
+// decompressRequestHandle decompresses gzip and deflate request bodies up to the limit;
+// other encodings are answered with `415 Unsupported Media Type`
+func decompressRequestHandle(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contentEncodingHeader := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+			var newReader func(io.Reader) (io.ReadCloser, error)
+			switch contentEncodingHeader {
+			case "", "identity":
+				next.ServeHTTP(w, r)
+				return
+			case "gzip", "x-gzip":
+				newReader = func(body io.Reader) (io.ReadCloser, error) {
+					return gzip.NewReader(body)
+				}
+			case "deflate":
+				newReader = zlib.NewReader
+			default:
+				w.Header().Set("Accept-Encoding", "gzip, deflate")
+				http.Error(w, "Unsupported content encoding: "+contentEncodingHeader, http.StatusUnsupportedMediaType)
 				return
 			}
-			return
-		}
-		defer func(gz *gzip.Writer) {
-			err := gz.Close()
-			if err != nil {
-				log.Printf("Error while closing writer: %v\n", err)
-			}
-		}(gz)
-
-		w.Header().Set("Content-Encoding", "gzip")
-		next.ServeHTTP(gzipWriter{ResponseWriter: w, Writer: gz}, r)
-	})
-}
-
-var _ io.ReadCloser = gzipRequestBody{}
-
-type gzipRequestBody struct {
-	ReadCloser io.ReadCloser
-}
-
-func (g gzipRequestBody) Read(p []byte) (n int, err error) {
-	return g.ReadCloser.Read(p)
-}
+			logger.Debug(r.Context(), "encoded request is received", "content_encoding", contentEncodingHeader)
 
-func (g gzipRequestBody) Close() error {
-	return g.ReadCloser.Close()
-}
-
-func gzipRequestHandle(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		contentEncodingHeader := r.Header.Get("Content-Encoding")
-		if !strings.Contains(contentEncodingHeader, "gzip") {
-			next.ServeHTTP(w, r)
-			return
-		}
-		log.Println("Encoded request is received")
-
-		gz, err := gzip.NewReader(r.Body)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		defer func(gz *gzip.Reader) {
-			err := gz.Close()
+			decoder, err := newReader(r.Body)
 			if err != nil {
-				log.Printf("Error while closing reader: %v\n", err)
+				writeBodyError(w, err)
+				return
 			}
-		}(gz)
-		r.Body = gzipRequestBody{ReadCloser: gz}
-		next.ServeHTTP(w, r)
-	})
+			defer func() {
+				err := decoder.Close()
+				if err != nil {
+					logger.Error(r.Context(), "could not close decompressing reader", "error", err)
+				}
+			}()
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+			r.Body = &limitedBody{ReadCloser: decoder, remaining: limit}
+			next.ServeHTTP(w, r)
+		})
+	}
 }
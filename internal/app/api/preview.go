@@ -0,0 +1,81 @@
+package api
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+//go:embed templates/*.html
+var templateFS embed.FS
+
+var pageTemplates = template.Must(template.ParseFS(templateFS, "templates/*.html"))
+
+type previewPage struct {
+	ShortURL    string
+	Destination string
+	CreatedAt   time.Time
+	Clicks      int64
+	Warning     bool
+}
+
+// isPreview tells whether the request asks for the preview of a link rather than for the redirect,
+// i.e. `GET /{id}+` or `GET /{id}?preview`
+func isPreview(r *http.Request, id string) bool {
+	_, preview := r.URL.Query()["preview"]
+	return preview || strings.HasSuffix(id, "+")
+}
+
+// handlePreview renders the preview page of a link without counting a click
+func (h *RequestHandler) handlePreview(w http.ResponseWriter, r *http.Request, domain, id string) {
+	link, ok := h.service.Preview(r.Context(), domain, id)
+	if !ok {
+		http.Error(w, "Link is not found", http.StatusNotFound)
+		return
+	}
+	if link.Deleted {
+		http.Error(w, "Link is deleted", http.StatusGone)
+		return
+	}
+	h.renderPreview(w, r, link, link.URL, false)
+}
+
+func (h *RequestHandler) renderPreview(w http.ResponseWriter, r *http.Request, link storage.Link, destination string, warning bool) {
+	var page bytes.Buffer
+	err := pageTemplates.ExecuteTemplate(&page, "preview.html", previewPage{
+		ShortURL:    h.ShortURL(link.Domain, link.ID),
+		Destination: destination,
+		CreatedAt:   link.CreatedAt,
+		Clicks:      link.Clicks,
+		Warning:     warning,
+	})
+	if err != nil {
+		logger.Error(r.Context(), "could not render preview page", "error", err)
+		http.Error(w, "Could not render page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(page.Bytes()); err != nil {
+		logger.Error(r.Context(), "could not write response", "error", err)
+	}
+}
+
+// isExternal tells whether the destination is outside the domains links are served on
+func (h *RequestHandler) isExternal(destination string) bool {
+	u, err := url.Parse(destination)
+	if err != nil || u.Host == "" {
+		return true
+	}
+	_, ok := h.LookupDomain(u.Host)
+	return !ok
+}
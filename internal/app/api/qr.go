@@ -0,0 +1,101 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/qr"
+)
+
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// handleGetQR renders the short URL of a link as a QR code, i.e. `GET /{id}/qr?format=png|svg&size=256&ec=L|M|Q|H`
+func (h *RequestHandler) handleGetQR(w http.ResponseWriter, r *http.Request) {
+	domain, ok := h.hostDomain(r)
+	if !ok && h.handleUnknownHost(w, r) {
+		return
+	}
+	id := chi.URLParam(r, "id")
+	link, ok := h.service.Preview(r.Context(), domain, id)
+	if !ok || link.Deleted {
+		http.Error(w, "Link is not found", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	format := strings.ToLower(query.Get("format"))
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "Format must be png or svg", http.StatusBadRequest)
+		return
+	}
+	size := defaultQRSize
+	if s := query.Get("size"); s != "" {
+		var err error
+		size, err = strconv.Atoi(s)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			http.Error(w, "Size must be a number of pixels from "+strconv.Itoa(minQRSize)+" to "+strconv.Itoa(maxQRSize), http.StatusBadRequest)
+			return
+		}
+	}
+	level := qr.Medium
+	if s := query.Get("ec"); s != "" {
+		var err error
+		if level, err = qr.ParseLevel(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	shortURL := h.ShortURL(link.Domain, link.ID)
+	etag := qrETag(shortURL, format, size, level)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	if match := r.Header.Get("If-None-Match"); match != "" && (match == etag || match == "*") {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	code, err := qr.Encode(shortURL, level)
+	if err != nil {
+		http.Error(w, "Could not encode QR code: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var body []byte
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		body = code.SVG(size)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		if body, err = code.PNG(size); err != nil {
+			http.Error(w, "Could not render QR code: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body); err != nil {
+		logger.Error(r.Context(), "could not write response", "error", err)
+	}
+}
+
+// qrETag depends only on what the image is rendered from, so it can be checked without rendering
+func qrETag(shortURL, format string, size int, level qr.Level) string {
+	sum := sha256.Sum256([]byte(shortURL + "|" + format + "|" + strconv.Itoa(size) + "|" + level.String()))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+func (h *RequestHandler) makeQRURL(domain, id string) string {
+	return h.ShortURL(domain, id) + "/qr"
+}
@@ -0,0 +1,53 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/metrics"
+	"github.com/tsupko/shortener/internal/app/ratelimit"
+)
+
+// rateLimitHandle rejects requests exceeding the limiter budget with `429 Too Many Requests`;
+// a nil limiter lets every request through
+func rateLimitHandle(limiter *ratelimit.Limiter, trustedProxies []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limiter == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := rateLimitKey(r, trustedProxies)
+			result := limiter.Allow(key)
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+			if !result.Allowed {
+				metrics.Rejected(metrics.ReasonRateLimit)
+				logger.Warn(r.Context(), "rate limit exceeded", "client", key)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+				http.Error(w, "Too many requests", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey identifies the client by its API key, otherwise by its IP address. Only authenticated keys are used,
+// so forged ones do not grant fresh budgets; neither do user cookies, which the server hands out to anyone
+func rateLimitKey(r *http.Request, trustedProxies []*net.IPNet) string {
+	if identity, ok := auth.IdentityFromContext(r.Context()); ok && identity.KeyID != "" {
+		return "key:" + identity.KeyID
+	}
+	return "ip:" + clientIP(r, trustedProxies)
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
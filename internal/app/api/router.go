@@ -1,23 +1,190 @@
 package api
 
 import (
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/ratelimit"
+	"github.com/tsupko/shortener/internal/app/storage"
 )
 
-func NewRouter(m *RequestHandler) chi.Router {
+// RouterOption customizes the router built by NewRouter
+type RouterOption func(*routerOptions)
+
+type routerOptions struct {
+	authenticator   *auth.Authenticator
+	createLimiter   *ratelimit.Limiter
+	redirectLimiter *ratelimit.Limiter
+	trustedProxies  []*net.IPNet
+	idempotency     storage.IdempotencyStorage
+	idempotencyTTL  time.Duration
+	bodyLimits      BodyLimits
+	timeouts        Timeouts
+	readiness       *Readiness
+	trustedSubnet   *net.IPNet
+
+	maxConcurrentRequests int
+}
+
+// WithAuthenticator sets how API keys and user cookies are checked; by default API keys are rejected
+// and user cookies are signed with a random per-process secret
+func WithAuthenticator(authenticator *auth.Authenticator) RouterOption {
+	return func(o *routerOptions) {
+		o.authenticator = authenticator
+	}
+}
+
+// WithRateLimiters limits link creation and redirects with separate budgets; a nil limiter disables the corresponding limit
+func WithRateLimiters(create, redirect *ratelimit.Limiter) RouterOption {
+	return func(o *routerOptions) {
+		o.createLimiter = create
+		o.redirectLimiter = redirect
+	}
+}
+
+// WithTrustedProxies makes forwarding headers of requests coming from the given networks be trusted
+func WithTrustedProxies(trustedProxies []*net.IPNet) RouterOption {
+	return func(o *routerOptions) {
+		o.trustedProxies = trustedProxies
+	}
+}
+
+// WithIdempotency sets where responses to requests with an `Idempotency-Key` are kept and for how long;
+// by default they are kept in memory for DefaultIdempotencyTTL
+func WithIdempotency(store storage.IdempotencyStorage, ttl time.Duration) RouterOption {
+	return func(o *routerOptions) {
+		o.idempotency = store
+		o.idempotencyTTL = ttl
+	}
+}
+
+// WithBodyLimits bounds request bodies before and after decompression; see BodyLimits for the defaults
+func WithBodyLimits(limits BodyLimits) RouterOption {
+	return func(o *routerOptions) {
+		o.bodyLimits = limits
+	}
+}
+
+func NewRouter(m *RequestHandler, opts ...RouterOption) chi.Router {
+	var o routerOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.authenticator == nil {
+		o.authenticator = auth.NewAuthenticator(nil, auth.NewSecret())
+	}
+	if o.readiness == nil {
+		o.readiness = NewReadiness(nil)
+	}
+	if o.idempotency == nil {
+		o.idempotency = storage.NewMemoryIdempotencyStorage()
+	}
+	if o.idempotencyTTL <= 0 {
+		o.idempotencyTTL = DefaultIdempotencyTTL
+	}
+	o.bodyLimits = o.bodyLimits.withDefaults()
+
 	r := chi.NewRouter()
-	r.Use(gzipResponseHandle, gzipRequestHandle)
+	r.Use(requestIDHandle, accessLogHandle, compressResponseHandle, authenticate(o.authenticator))
+	// imports are streamed, so they are bounded apart from the bodies of other endpoints, which are read whole
+	bodies, imports := limitBodiesHandle(o.bodyLimits.Body, o.bodyLimits.Decompressed), limitBodiesHandle(o.bodyLimits.Import, o.bodyLimits.Import)
+	create := chi.Middlewares{
+		rateLimitHandle(o.createLimiter, o.trustedProxies),
+		issueUserCookie(o.authenticator),
+		requireScope(auth.ScopeLinksCreate),
+		idempotencyHandle(o.idempotency, o.idempotencyTTL),
+	}
+	// streams are neither shed nor timed out, as they last as long as the client listens
+	shedLoad, timeout := shedLoadHandle(o.maxConcurrentRequests), timeoutHandle(o.timeouts)
 	r.Route("/", func(r chi.Router) {
-		r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
-			m.handleGetRequest(w, r)
+		// probes are not shed, so that a busy instance is not taken for a dead one
+		r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			m.handleHealthz(w, r)
+		})
+		r.Get("/readyz", func(w http.ResponseWriter, r *http.Request) {
+			m.handleReadyz(w, r, o.readiness)
 		})
-		r.Post("/", func(w http.ResponseWriter, r *http.Request) {
-			m.handlePostRequest(w, r)
+		// the API is a router of its own, so that its unknown paths are not taken for deep links
+		r.Route("/api", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(shedLoad, timeout, bodies)
+				r.Group(func(r chi.Router) {
+					r.Use(create...)
+					r.Post("/shorten", func(w http.ResponseWriter, r *http.Request) {
+						m.handleJSONPost(w, r)
+					})
+					r.Post("/shorten/batch", func(w http.ResponseWriter, r *http.Request) {
+						m.handleBatchPost(w, r)
+					})
+				})
+				r.With(requireScope(auth.ScopeLinksRead)).Get("/user/urls", func(w http.ResponseWriter, r *http.Request) {
+					m.handleGetUserURLs(w, r)
+				})
+				r.With(requireScope(auth.ScopeLinksRead)).Get("/export", func(w http.ResponseWriter, r *http.Request) {
+					m.handleExport(w, r)
+				})
+				r.With(requireScope(auth.ScopeLinksDelete)).Delete("/user/urls", func(w http.ResponseWriter, r *http.Request) {
+					m.handleDeleteUserURLs(w, r)
+				})
+				r.With(requireScope(auth.ScopeLinksRead)).Get("/user/urls/{id}/rules", func(w http.ResponseWriter, r *http.Request) {
+					m.handleGetRules(w, r)
+				})
+				r.With(requireScope(auth.ScopeLinksUpdate)).Put("/user/urls/{id}/rules", func(w http.ResponseWriter, r *http.Request) {
+					m.handlePutRules(w, r)
+				})
+				r.With(requireScope(auth.ScopeStatsRead)).Get("/stats/{id}", func(w http.ResponseWriter, r *http.Request) {
+					m.handleGetStats(w, r)
+				})
+				r.With(trustedSubnetHandle(o.trustedSubnet, o.trustedProxies)).Get("/internal/stats", func(w http.ResponseWriter, r *http.Request) {
+					m.handleGetInternalStats(w, r)
+				})
+			})
+			// imports are streamed, so they are timed per read and per row rather than as a whole
+			r.Group(func(r chi.Router) {
+				r.Use(shedLoad, streamBodyHandle(o.timeouts), imports)
+				r.Use(create...)
+				r.Post("/import", func(w http.ResponseWriter, r *http.Request) {
+					m.handleImport(w, r, o.timeouts.Request)
+				})
+			})
+			r.With(bodies, requireScope(auth.ScopeStatsRead)).Get("/events", func(w http.ResponseWriter, r *http.Request) {
+				m.handleGetEvents(w, r, o.timeouts.Write)
+			})
 		})
-		r.Post("/api/shorten", func(w http.ResponseWriter, r *http.Request) {
-			m.handleJSONPost(w, r)
+		r.Group(func(r chi.Router) {
+			r.Use(shedLoad, timeout, bodies)
+			r.Group(func(r chi.Router) {
+				r.Use(rateLimitHandle(o.redirectLimiter, o.trustedProxies))
+				r.Get("/{id}", func(w http.ResponseWriter, r *http.Request) {
+					m.handleGetRequest(w, r, o.trustedProxies)
+				})
+				// the QR code and deep links take every method, so that the others get `404 Not Found`
+				// like unknown paths; the QR code is matched first, so a deep link cannot end in qr
+				r.HandleFunc("/{id}/qr", func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != http.MethodGet {
+						http.NotFound(w, r)
+						return
+					}
+					m.handleGetQR(w, r)
+				})
+				r.HandleFunc("/{id}/*", func(w http.ResponseWriter, r *http.Request) {
+					if r.Method != http.MethodGet {
+						http.NotFound(w, r)
+						return
+					}
+					m.handleGetRequest(w, r, o.trustedProxies)
+				})
+			})
+			r.Group(func(r chi.Router) {
+				r.Use(create...)
+				r.Post("/", func(w http.ResponseWriter, r *http.Request) {
+					m.handlePostRequest(w, r)
+				})
+			})
 		})
 	})
 	return r
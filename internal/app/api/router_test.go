@@ -1,18 +1,32 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image/png"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/bulk"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/qr"
+	"github.com/tsupko/shortener/internal/app/ratelimit"
 	"github.com/tsupko/shortener/internal/app/service"
 	"github.com/tsupko/shortener/internal/app/storage"
 	"github.com/tsupko/shortener/internal/app/util"
@@ -75,6 +89,26 @@ func TestRouterNotFound(t *testing.T) {
 	closeBody(t, resp)
 }
 
+func TestDeepLinkIsRouted(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/12345/docs/page", "")
+
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Equal(t, "https://ya.ru", resp.Header.Get("Location"), "links without passthrough ignore the suffix")
+	closeBody(t, resp)
+
+	resp, body := testRequest(t, ts, "GET", "/api/user/urlz/x", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "unknown API paths are not deep links")
+	assert.Equal(t, "404 page not found\n", body)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "DELETE", "/api/user/urls/12345/rules", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	closeBody(t, resp)
+}
+
 func TestPostApi(t *testing.T) {
 	ts := getServer()
 	defer ts.Close()
@@ -86,15 +120,54 @@ func TestPostApi(t *testing.T) {
 	closeBody(t, resp)
 }
 
+func TestPostBatch(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten/batch", `[{"correlation_id":"a","original_url":"https://ya.ru"},{"correlation_id":"b","original_url":"https://go.dev"}]`)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	closeBody(t, resp)
+	var created []batchResponse
+	require.NoError(t, json.Unmarshal([]byte(body), &created))
+	require.Len(t, created, 2)
+	assert.Equal(t, "a", created[0].CorrelationID)
+	assert.Equal(t, "b", created[1].CorrelationID)
+	assert.NotEqual(t, created[0].ShortURL, created[1].ShortURL)
+
+	for _, batch := range []string{`[]`, `[{"correlation_id":"a","original_url":"https://ya.ru"},{"correlation_id":"b","original_url":"not a url"}]`} {
+		resp, _ = testRequest(t, ts, "POST", "/api/shorten/batch", batch)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, batch)
+		closeBody(t, resp)
+	}
+}
+
 func TestAcceptEncodingGzip(t *testing.T) {
 	ts := getServer()
 	defer ts.Close()
 
-	resp, body := testRequest(t, ts, "POST", "/", "https://ya.ru", "Accept-Encoding", "gzip")
+	batch := make([]batchRequest, 50)
+	for i := range batch {
+		batch[i] = batchRequest{CorrelationID: strconv.Itoa(i), OriginalURL: "https://ya.ru/" + strconv.Itoa(i)}
+	}
+	requestBody, err := json.Marshal(batch)
+	require.NoError(t, err)
+	resp, body := testRequest(t, ts, "POST", "/api/shorten/batch", string(requestBody), "Accept-Encoding", "gzip")
 
 	assert.Equal(t, http.StatusCreated, resp.StatusCode)
-	assert.Equal(t, "http://localhost:8080/12345", unzip(body))
 	assert.Equal(t, "gzip", resp.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+	assert.Contains(t, unzip(body), `"short_url":"http://localhost:8080/12345"`)
+	closeBody(t, resp)
+
+	resp, body = testRequest(t, ts, "POST", "/", "https://ya.ru", "Accept-Encoding", "gzip")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "small bodies are not compressed")
+	assert.Equal(t, "http://localhost:8080/12345", body)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/12345", "", "Accept-Encoding", "gzip")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get("Content-Encoding"), "redirects have no body to compress")
 	closeBody(t, resp)
 }
 
@@ -110,18 +183,503 @@ func TestContentEncodingGzip(t *testing.T) {
 	closeBody(t, resp)
 }
 
-func getServer() *httptest.Server {
-	r := NewRouter(NewRequestHandler(service.NewShorteningService(storage.NewTestStorage()), util.ServerAddress))
+func TestRequestIDIsGenerated(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/12345", "")
+
+	assert.Len(t, resp.Header.Get("X-Request-ID"), 32)
+	closeBody(t, resp)
+}
+
+func TestRequestIDIsHonored(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/12345", "", "X-Request-ID", "upstream-42")
+
+	assert.Equal(t, "upstream-42", resp.Header.Get("X-Request-ID"))
+	closeBody(t, resp)
+}
+
+func TestRateLimitCreation(t *testing.T) {
+	ts := getServer(WithRateLimiters(ratelimit.NewLimiter(1, 1, 10, time.Minute), nil))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/", "https://ya.ru")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("RateLimit-Limit"))
+	assert.Equal(t, "0", resp.Header.Get("RateLimit-Remaining"))
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://ya.ru"}`)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/12345", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "redirects have their own budget")
+	closeBody(t, resp)
+}
+
+func TestRateLimitIgnoresUnauthenticatedIdentities(t *testing.T) {
+	ts := getServer(WithRateLimiters(ratelimit.NewLimiter(1, 1, 10, time.Minute), nil))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/", "https://ya.ru")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/", "https://ya.ru", "Cookie", userCookieName+"=forged")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "forged cookies do not grant fresh budgets")
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "POST", "/", "https://ya.ru", "Cookie", cookie)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode, "nor do the cookies handed out to anyone")
+	closeBody(t, resp)
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "203.0.113.7", clientIP(r, trusted), "untrusted peers cannot spoof their address")
+
+	r.RemoteAddr = "10.1.2.3:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1, 203.0.113.9, 192.168.1.1")
+	assert.Equal(t, "203.0.113.9", clientIP(r, trusted))
+
+	r.Header.Del("X-Forwarded-For")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+	assert.Equal(t, "198.51.100.2", clientIP(r, trusted))
+
+	_, err = ParseTrustedProxies("not-an-ip")
+	assert.Error(t, err)
+}
+
+func TestUserCookieOwnsLinks(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, shortURL := testRequest(t, ts, "POST", "/", "https://ya.ru")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Len(t, resp.Cookies(), 1)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	id := strings.TrimPrefix(shortURL, util.ServerAddress+"/")
+	closeBody(t, resp)
+
+	resp, body := testRequest(t, ts, "GET", "/api/user/urls", "", "Cookie", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `[{"short_url":"`+shortURL+`","original_url":"https://ya.ru"}]`, body)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/api/user/urls", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "")
+	assert.Equal(t, "https://ya.ru", resp.Header.Get("Location"))
+	closeBody(t, resp)
+	resp, body = testRequest(t, ts, "GET", "/api/stats/"+id, "", "Cookie", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `"clicks":1`)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "DELETE", "/api/user/urls", `["`+id+`"]`, "Cookie", cookie)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "")
+	assert.Equal(t, http.StatusGone, resp.StatusCode)
+	closeBody(t, resp)
+}
+
+func TestRulesAPI(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com"}`)
+	require.Len(t, resp.Cookies(), 1)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	id := strings.TrimSuffix(strings.TrimPrefix(body, `{"result":"`+util.ServerAddress+"/"), `"}`)
+	closeBody(t, resp)
+
+	rules := `[{"destination":"https://apps.apple.com/app","platforms":["ios"]}]`
+	resp, _ = testRequest(t, ts, "PUT", "/api/user/urls/"+id+"/rules", rules)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "PUT", "/api/user/urls/"+id+"/rules", `[{"destination":"/relative"}]`, "Cookie", cookie)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "PUT", "/api/user/urls/"+id+"/rules", rules, "Cookie", cookie)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, body = testRequest(t, ts, "GET", "/api/user/urls/"+id+"/rules", "", "Cookie", cookie)
+	assert.JSONEq(t, rules, body)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "", "User-Agent", "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X)")
+	assert.Equal(t, "https://apps.apple.com/app", resp.Header.Get("Location"))
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "")
+	assert.Equal(t, "https://example.com", resp.Header.Get("Location"))
+	closeBody(t, resp)
+}
+
+func TestVariantsAreSticky(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten", `{"variants":[{"destination":"https://a.example","weight":70},{"destination":"https://b.example","weight":30}]}`)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	id := strings.TrimSuffix(strings.TrimPrefix(body, `{"result":"`+util.ServerAddress+"/"), `"}`)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "")
+	first := resp.Header.Get("Location")
+	assert.Contains(t, []string{"https://a.example", "https://b.example"}, first)
+	var visitor *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == visitorCookieName {
+			visitor = c
+		}
+	}
+	require.NotNil(t, visitor)
+	closeBody(t, resp)
+	for i := 0; i < 5; i++ {
+		resp, _ = testRequest(t, ts, "GET", "/"+id, "", "Cookie", visitor.Name+"="+visitor.Value, "User-Agent", fmt.Sprint("agent", i))
+		assert.Equal(t, first, resp.Header.Get("Location"))
+		assert.Empty(t, resp.Cookies(), "the visitor cookie is issued once")
+		closeBody(t, resp)
+	}
+
+	resp, body = testRequest(t, ts, "GET", "/api/stats/"+id, "", "Cookie", cookie)
+	var got struct {
+		Clicks   int64 `json:"clicks"`
+		Variants []struct {
+			Destination string `json:"destination"`
+			Clicks      int64  `json:"clicks"`
+		} `json:"variants"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &got))
+	closeBody(t, resp)
+	assert.Equal(t, int64(6), got.Clicks)
+	require.Len(t, got.Variants, 2)
+	for _, variant := range got.Variants {
+		if variant.Destination == first {
+			assert.Equal(t, int64(6), variant.Clicks)
+		} else {
+			assert.Zero(t, variant.Clicks)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	bus := events.NewBus(16)
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage(), service.WithPublisher(bus)), util.ServerAddress, WithEventBus(bus))
+	ts := httptest.NewServer(NewRouter(h, WithAuthenticator(auth.NewAuthenticator(nil, []byte("secret")))))
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com"}`)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	id := strings.TrimSuffix(strings.TrimPrefix(body, `{"result":"`+util.ServerAddress+"/"), `"}`)
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://other.example"}`)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/api/events", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	closeBody(t, resp)
+
+	// the stream goes through the gzip middleware, which must flush every event
+	req, err := http.NewRequest("GET", ts.URL+"/api/events?last_event_id=none", nil)
+	require.NoError(t, err)
+	req.Header.Set("Cookie", cookie)
+	req.Header.Set("Accept-Encoding", "gzip")
+	stream, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer closeBody(t, stream)
+	assert.Equal(t, "text/event-stream", stream.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", stream.Header.Get("Content-Encoding"))
+	gz, err := gzip.NewReader(stream.Body)
+	require.NoError(t, err)
+	lines := bufio.NewScanner(gz)
+	readEvent := func() map[string]string {
+		fields := map[string]string{}
+		for lines.Scan() && lines.Text() != "" {
+			name, value, _ := strings.Cut(lines.Text(), ": ")
+			fields[name] = value
+		}
+		return fields
+	}
+
+	created := readEvent()
+	assert.Equal(t, "link.created", created["event"], "the buffer is replayed for unknown IDs, without events of other users")
+	assert.Contains(t, created["data"], `"id":"`+id+`"`)
+
+	resp, _ = testRequest(t, ts, "GET", "/"+id, "")
+	closeBody(t, resp)
+	clicked := readEvent()
+	assert.Equal(t, "link.clicked", clicked["event"])
+	assert.NotEqual(t, created["id"], clicked["id"])
+
+	req.Header.Del("Accept-Encoding")
+	req.Header.Set("Last-Event-ID", created["id"])
+	req.URL.RawQuery = "link=" + id
+	resumed, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer closeBody(t, resumed)
+	lines = bufio.NewScanner(resumed.Body)
+	assert.Equal(t, clicked["id"], readEvent()["id"])
+
+	resp, _ = testRequest(t, ts, "GET", "/api/events?owner=someone", "", "Cookie", cookie)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	closeBody(t, resp)
+}
+
+func TestImportExport(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	csvBody := "\ufeffURL,alias,notes\n" +
+		"https://example.com/a,docs,first\n" +
+		"not a url,,broken\n" +
+		"https://example.com/b,docs,taken\n" +
+		"https://example.com/c,api,reserved\n" +
+		"https://example.com/d\n"
+	resp, body := testRequest(t, ts, "POST", "/api/import", csvBody, "Content-Type", "text/csv")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	closeBody(t, resp)
+	var report bulk.Report
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, 3, report.Imported)
+	assert.Equal(t, 2, report.Failed)
+	require.Len(t, report.Rows, 3)
+	assert.Equal(t, 2, report.Rows[0].Row)
+	assert.Contains(t, report.Rows[0].Error, "absolute URL")
+	assert.Equal(t, 3, report.Rows[1].Row)
+	assert.Equal(t, "docs", report.Rows[1].Alias)
+	assert.NotEqual(t, util.ServerAddress+"/docs", report.Rows[1].ShortURL)
+	assert.Contains(t, report.Rows[2].Error, "reserved")
+
+	resp, _ = testRequest(t, ts, "GET", "/docs", "")
+	assert.Equal(t, "https://example.com/a", resp.Header.Get("Location"))
+	closeBody(t, resp)
+
+	ndjsonBody := `{"url":"https://example.com/e","alias":"e"}` + "\n\n" + `{"original_url":"https://example.com/f","id":"f"}` + "\n" + `{broken` + "\n"
+	resp, body = testRequest(t, ts, "POST", "/api/import", ndjsonBody, "Content-Type", "application/x-ndjson", "Cookie", cookie)
+	closeBody(t, resp)
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, 2, report.Imported)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, 3, report.Rows[0].Row)
+
+	resp, _ = testRequest(t, ts, "POST", "/api/import", "url\n", "Content-Type", "application/json", "Cookie", cookie)
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, body = testRequest(t, ts, "GET", "/api/export", "", "Cookie", cookie)
+	assert.Equal(t, "text/csv; charset=utf-8", resp.Header.Get("Content-Type"))
+	closeBody(t, resp)
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+	assert.Equal(t, bulk.Columns, records[0])
+	assert.Equal(t, []string{"docs", util.ServerAddress + "/docs", "https://example.com/a"}, records[1][:3])
+
+	resp, body = testRequest(t, ts, "GET", "/api/export", "", "Cookie", cookie, "Accept", "application/x-ndjson")
+	closeBody(t, resp)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	require.Len(t, lines, 5)
+	var exported bulk.Record
+	require.NoError(t, json.Unmarshal([]byte(lines[4]), &exported))
+	assert.Equal(t, "f", exported.ID)
+
+	// the export imports back, keeping the IDs which are free in another account
+	resp, body = testRequest(t, ts, "POST", "/api/import", body, "Content-Type", "application/x-ndjson")
+	closeBody(t, resp)
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Equal(t, 5, report.Imported)
+	assert.Len(t, report.Rows, 5, "all IDs are taken")
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/", "https://example.com")
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	closeBody(t, resp)
+
+	resp, first := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`, "Cookie", cookie, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(idempotentReplayedHeader))
+	closeBody(t, resp)
+	resp, repeated := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`, "Cookie", cookie, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "true", resp.Header.Get(idempotentReplayedHeader))
+	assert.Equal(t, first, repeated)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/b"}`, "Cookie", cookie, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusUnprocessableEntity, resp.StatusCode)
+	closeBody(t, resp)
+	resp, other := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.NotEqual(t, first, other, "keys are scoped by caller")
+	closeBody(t, resp)
+
+	resp, body := testRequest(t, ts, "GET", "/api/user/urls", "", "Cookie", cookie)
+	assert.Equal(t, 2, strings.Count(body, "short_url"))
+	closeBody(t, resp)
+}
+
+func TestIdempotencyKeyOfAnonymousCaller(t *testing.T) {
+	ts := getMemoryServer(nil)
+	defer ts.Close()
+
+	resp, first := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	cookie := resp.Header.Get("Set-Cookie")
+	require.NotEmpty(t, cookie)
+	closeBody(t, resp)
+
+	resp, repeated := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/a"}`, "Idempotency-Key", "k1")
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Header.Get(idempotentReplayedHeader), "keys of anonymous callers are ignored")
+	assert.NotEqual(t, first, repeated)
+	assert.NotEqual(t, cookie, resp.Header.Get("Set-Cookie"), "the cookie of another caller is never handed out")
+	closeBody(t, resp)
+}
+
+func TestIdempotencyConcurrentRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	var calls int32
+	i := &idempotency{store: storage.NewMemoryIdempotencyStorage(), ttl: time.Minute, wait: 200 * time.Millisecond, inflight: make(map[string]chan struct{})}
+	h := i.handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	serve := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		r.Header.Set(idempotencyKeyHeader, "key")
+		r = r.WithContext(auth.WithIdentity(r.Context(), auth.Identity{UserID: "user"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- serve() }()
+	<-started
+	assert.Equal(t, http.StatusConflict, serve().Code, "a repeat gives up waiting for a slow first request")
+
+	waiting := make(chan *httptest.ResponseRecorder)
+	go func() { waiting <- serve() }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.Equal(t, http.StatusCreated, (<-first).Code)
+	replayed := <-waiting
+	assert.Equal(t, http.StatusCreated, replayed.Code)
+	assert.Equal(t, "created", replayed.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	keys := storage.NewMemoryKeyStorage()
+	token, _, err := auth.CreateKey(context.Background(), keys, "ci", "", []auth.Scope{auth.ScopeLinksCreate})
+	require.NoError(t, err)
+	ts := getMemoryServer(keys)
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://ya.ru"}`, "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Empty(t, resp.Cookies(), "API key callers do not need cookies")
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/api/user/urls", "", "Authorization", "Bearer "+token)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/", "https://ya.ru", "Authorization", "Bearer shk_forged")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	closeBody(t, resp)
+}
+
+func TestQRCode(t *testing.T) {
+	ts := getServer()
+	defer ts.Close()
+
+	resp, body := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://ya.ru","qr":true}`)
+	assert.Equal(t, `{"result":"http://localhost:8080/12345","qr":"http://localhost:8080/12345/qr"}`, body)
+	closeBody(t, resp)
+
+	resp, body = testRequest(t, ts, "GET", "/12345/qr?size=128", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	img, err := png.Decode(strings.NewReader(body))
+	require.NoError(t, err)
+	assert.Equal(t, 3*(29+2*qr.QuietZone), img.Bounds().Dx(), "3 pixels per module of the 29 modules of the code come nearest to 128 pixels")
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/12345/qr?size=128", "", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, body = testRequest(t, ts, "GET", "/12345/qr?format=svg&ec=H", "")
+	assert.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	assert.Contains(t, body, "<svg")
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"))
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/12345/qr?ec=X", "")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "GET", "/98765/qr", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	closeBody(t, resp)
+
+	resp, _ = testRequest(t, ts, "POST", "/12345/qr", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	closeBody(t, resp)
+	resp, _ = testRequest(t, ts, "GET", "/12345/qr/more", "")
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode, "longer paths are deep links")
+	closeBody(t, resp)
+}
+
+func getMemoryServer(keys storage.KeyStorage) *httptest.Server {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+	return httptest.NewServer(NewRouter(h, WithAuthenticator(auth.NewAuthenticator(keys, []byte("secret")))))
+}
+
+func getServer(opts ...RouterOption) *httptest.Server {
+	r := NewRouter(NewRequestHandler(service.NewShorteningService(storage.NewTestStorage()), util.ServerAddress), opts...)
 	ts := httptest.NewServer(r)
 	return ts
 }
 
 func testRequest(t *testing.T, ts *httptest.Server, method, path string, body string, headers ...string) (*http.Response, string) {
 	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
-	if len(headers) == 2 {
-		req.Header.Set(headers[0], headers[1])
-	}
 	require.NoError(t, err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
 
 	client := http.DefaultClient
 	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/metrics"
+)
+
+const (
+	// overloadRetryAfter is suggested to clients whose requests are shed
+	overloadRetryAfter = time.Second
+	// notStoredRetryAfter is suggested to clients whose links are not stored, e.g. while the storage loads
+	notStoredRetryAfter = time.Second
+)
+
+// Timeouts bound how long requests may take; zero fields disable the corresponding bound
+type Timeouts struct {
+	// Request is the deadline of the request context, which is passed down to storage calls;
+	// imports, whose bodies are streamed, have it for every row instead
+	Request time.Duration
+	// Write bounds writing the response; streamed responses extend it with every message instead.
+	// It needs the server to be set up with ConnContext
+	Write time.Duration
+	// Read bounds reading every chunk of streamed request bodies, i.e. of imports, which would not fit
+	// the read timeout of the server as a whole. It needs the server to be set up with ConnContext
+	Read time.Duration
+}
+
+// WithTimeouts bounds the time requests may take
+func WithTimeouts(timeouts Timeouts) RouterOption {
+	return func(o *routerOptions) {
+		o.timeouts = timeouts
+	}
+}
+
+// WithMaxConcurrentRequests sheds requests beyond the limit with `503 Service Unavailable`;
+// streams are not counted. Zero disables the limit
+func WithMaxConcurrentRequests(limit int) RouterOption {
+	return func(o *routerOptions) {
+		o.maxConcurrentRequests = limit
+	}
+}
+
+type connContextKey struct{}
+
+// ConnContext keeps the connection in the context, so that the router can set write deadlines per request;
+// it is meant for http.Server.ConnContext
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+func connFromContext(ctx context.Context) (net.Conn, bool) {
+	c, ok := ctx.Value(connContextKey{}).(net.Conn)
+	return c, ok
+}
+
+// shedLoadHandle serves at most the limit of requests at once and answers the others right away
+// with `503 Service Unavailable`, so that the server degrades instead of queueing requests until they time out;
+// a zero limit lets every request through. The handlers the middleware is applied to share the limit
+func shedLoadHandle(limit int) func(http.Handler) http.Handler {
+	var slots chan struct{}
+	if limit > 0 {
+		slots = make(chan struct{}, limit)
+	}
+	return func(next http.Handler) http.Handler {
+		if slots == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+				next.ServeHTTP(w, r)
+			default:
+				metrics.Rejected(metrics.ReasonOverload)
+				logger.Warn(r.Context(), "request is shed", "limit", limit)
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(overloadRetryAfter)))
+				http.Error(w, "Server is overloaded", http.StatusServiceUnavailable)
+			}
+		})
+	}
+}
+
+// timeoutHandle sets the write deadline of the connection and the deadline of the request context
+func timeoutHandle(timeouts Timeouts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := connFromContext(r.Context()); ok && timeouts.Write > 0 {
+				_ = c.SetWriteDeadline(time.Now().Add(timeouts.Write))
+			}
+			if timeouts.Request <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx, cancel := context.WithTimeout(r.Context(), timeouts.Request)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				metrics.Rejected(metrics.ReasonTimeout)
+				logger.Warn(r.Context(), "request timed out", "timeout", timeouts.Request)
+			}
+		})
+	}
+}
+
+// streamBodyHandle lets the request body be streamed for as long as the client keeps sending it:
+// the read deadline of the connection is extended before every read of the body, and the write deadline
+// with it, as the response follows the body
+func streamBodyHandle(timeouts Timeouts) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if c, ok := connFromContext(r.Context()); ok && r.Body != nil {
+				r.Body = &deadlineBody{ReadCloser: r.Body, conn: c, timeouts: timeouts}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// deadlineBody extends the deadlines of the connection as the body is read
+type deadlineBody struct {
+	io.ReadCloser
+	conn     net.Conn
+	timeouts Timeouts
+	read     bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.read {
+		return b.ReadCloser.Read(p)
+	}
+	now := time.Now()
+	if b.timeouts.Read > 0 {
+		_ = b.conn.SetReadDeadline(now.Add(b.timeouts.Read))
+	}
+	if b.timeouts.Write > 0 {
+		_ = b.conn.SetWriteDeadline(now.Add(b.timeouts.Write))
+	}
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.timeouts.Read > 0 {
+		// the server watches the connection once the body is read, which must not time out meanwhile
+		b.read = true
+		_ = b.conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// extendWriteDeadline gives every message of a streamed response a write timeout of its own,
+// so that streams last as long as clients keep reading them
+func extendWriteDeadline(r *http.Request, writeTimeout time.Duration) {
+	c, ok := connFromContext(r.Context())
+	if !ok || writeTimeout <= 0 {
+		return
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(writeTimeout))
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/auth"
+	"github.com/tsupko/shortener/internal/app/bulk"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/metrics"
+	"github.com/tsupko/shortener/internal/app/service"
+	"github.com/tsupko/shortener/internal/app/storage"
+	"github.com/tsupko/shortener/internal/app/util"
+)
+
+func TestShedLoad(t *testing.T) {
+	started, release := make(chan struct{}, 1), make(chan struct{})
+	handler := shedLoadHandle(1)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+
+	rejected := metrics.RejectedCount(metrics.ReasonOverload)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "1", w.Header().Get("Retry-After"))
+	assert.Equal(t, rejected+1, metrics.RejectedCount(metrics.ReasonOverload))
+
+	close(release)
+	<-done
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "the slot is freed once the request is served")
+}
+
+// deadlineStorage remembers whether lookups are bounded by a deadline
+type deadlineStorage struct {
+	storage.TestStorage
+	bounded bool
+}
+
+func (s *deadlineStorage) Get(ctx context.Context, key string) (storage.Link, bool) {
+	_, s.bounded = ctx.Deadline()
+	return s.TestStorage.Get(ctx, key)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	store := &deadlineStorage{}
+	h := NewRequestHandler(service.NewShorteningService(store), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h, WithTimeouts(Timeouts{Request: time.Minute})))
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "GET", "/12345", "")
+	closeBody(t, resp)
+	assert.Equal(t, http.StatusTemporaryRedirect, resp.StatusCode)
+	assert.True(t, store.bounded, "the deadline of the request reaches the storage")
+
+	rejected := metrics.RejectedCount(metrics.ReasonTimeout)
+	handler := timeoutHandle(Timeouts{Request: time.Millisecond})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		http.Error(w, r.Context().Err().Error(), http.StatusServiceUnavailable)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, rejected+1, metrics.RejectedCount(metrics.ReasonTimeout))
+}
+
+// replayingStorage stands for a storage which is still loading, like a file storage replaying its log:
+// calls wait for the end of the request and then give up
+type replayingStorage struct {
+	storage.TestStorage
+}
+
+func (s replayingStorage) Put(ctx context.Context, _ storage.Link) string {
+	<-ctx.Done()
+	return ""
+}
+
+func (s replayingStorage) Get(ctx context.Context, _ string) (storage.Link, bool) {
+	<-ctx.Done()
+	return storage.Link{}, false
+}
+
+func TestCreateWhileStorageLoads(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(replayingStorage{}), util.ServerAddress)
+	ts := httptest.NewServer(NewRouter(h,
+		WithAuthenticator(auth.NewAuthenticator(nil, []byte("secret"))),
+		WithTimeouts(Timeouts{Request: 50 * time.Millisecond}),
+	))
+	defer ts.Close()
+
+	for _, tt := range []struct{ path, body string }{
+		{"/", "https://ya.ru"},
+		{"/api/shorten", `{"url":"https://ya.ru"}`},
+		{"/api/shorten/batch", `[{"correlation_id":"1","original_url":"https://ya.ru"}]`},
+	} {
+		for i := 0; i < 2; i++ {
+			resp, body := testRequest(t, ts, "POST", tt.path, tt.body, "Idempotency-Key", "k1")
+			assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, tt.path)
+			assert.Equal(t, "1", resp.Header.Get("Retry-After"), tt.path)
+			assert.Empty(t, resp.Header.Get(idempotentReplayedHeader), "%s: failures are not replayed", tt.path)
+			assert.NotContains(t, body, util.ServerAddress, tt.path)
+			closeBody(t, resp)
+		}
+	}
+
+	resp, body := testRequest(t, ts, "POST", "/api/import", "url,alias\nhttps://ya.ru,\nhttps://go.dev,go\n", "Content-Type", "text/csv")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var report bulk.Report
+	require.NoError(t, json.Unmarshal([]byte(body), &report))
+	assert.Zero(t, report.Imported)
+	assert.Equal(t, 2, report.Failed, "rows which are not stored are failed")
+	closeBody(t, resp)
+}
+
+func TestEventStreamOutlivesTimeouts(t *testing.T) {
+	bus := events.NewBus(16)
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage(), service.WithPublisher(bus)), util.ServerAddress, WithEventBus(bus))
+	ts := httptest.NewUnstartedServer(NewRouter(h,
+		WithAuthenticator(auth.NewAuthenticator(nil, []byte("secret"))),
+		WithTimeouts(Timeouts{Request: 100 * time.Millisecond, Write: 100 * time.Millisecond}),
+	))
+	ts.Config.ReadTimeout = 100 * time.Millisecond
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	resp, _ := testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com"}`)
+	cookie := resp.Cookies()[0].Name + "=" + resp.Cookies()[0].Value
+	closeBody(t, resp)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/events", nil)
+	require.NoError(t, err)
+	req.Header.Set("Cookie", cookie)
+	stream, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer closeBody(t, stream)
+	require.Equal(t, http.StatusOK, stream.StatusCode)
+
+	lines := bufio.NewScanner(stream.Body)
+	for _, path := range []string{"later", "last"} {
+		time.Sleep(300 * time.Millisecond)
+		resp, _ = testRequest(t, ts, "POST", "/api/shorten", `{"url":"https://example.com/`+path+`"}`, "Cookie", cookie)
+		closeBody(t, resp)
+
+		var received []string
+		for lines.Scan() {
+			if strings.HasPrefix(lines.Text(), "event: ") {
+				received = append(received, lines.Text())
+			}
+			if strings.Contains(lines.Text(), "example.com/"+path) {
+				break
+			}
+		}
+		require.NoError(t, lines.Err(), "the stream is not cut off by the timeouts of ordinary requests")
+		assert.Equal(t, []string{"event: link.created"}, received)
+	}
+}
+
+func TestImportOutlivesTimeouts(t *testing.T) {
+	h := NewRequestHandler(service.NewShorteningService(storage.NewMemoryStorage()), util.ServerAddress)
+	ts := httptest.NewUnstartedServer(NewRouter(h,
+		WithAuthenticator(auth.NewAuthenticator(nil, []byte("secret"))),
+		WithTimeouts(Timeouts{Request: 50 * time.Millisecond, Write: 100 * time.Millisecond, Read: 100 * time.Millisecond}),
+	))
+	ts.Config.ReadTimeout = 100 * time.Millisecond
+	ts.Config.ConnContext = ConnContext
+	ts.Start()
+	defer ts.Close()
+
+	body, rows := io.Pipe()
+	go func() {
+		_, _ = io.WriteString(rows, "url\n")
+		for i := 0; i < 5; i++ {
+			time.Sleep(60 * time.Millisecond)
+			_, _ = fmt.Fprintf(rows, "https://example.com/%d\n", i)
+		}
+		_ = rows.Close()
+	}()
+	req, err := http.NewRequest("POST", ts.URL+"/api/import", body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "text/csv")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer closeBody(t, resp)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var report bulk.Report
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 5, report.Imported, "the import is not cut off by the timeouts of ordinary requests")
+	assert.Zero(t, report.Failed)
+}
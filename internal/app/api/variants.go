@@ -0,0 +1,45 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const (
+	visitorCookieName   = "visitor_id"
+	visitorCookieMaxAge = 365 * 24 * time.Hour
+	maxVisitorIDLength  = 64
+)
+
+// visitorID identifies the visitor for sticky variants: by the visitor cookie if it was issued before,
+// otherwise by the authenticated user or by a hash of the client address and the User-Agent
+func visitorID(r *http.Request, trustedProxies []*net.IPNet) (string, bool) {
+	if cookie, err := r.Cookie(visitorCookieName); err == nil && cookie.Value != "" && len(cookie.Value) <= maxVisitorIDLength {
+		return cookie.Value, true
+	}
+	if userID := userID(r); userID != "" {
+		return "user:" + userID, false
+	}
+	sum := sha256.Sum256([]byte(clientIP(r, trustedProxies) + "\x00" + r.UserAgent()))
+	return hex.EncodeToString(sum[:16]), false
+}
+
+// keepVisitorID issues the visitor cookie, so that the visitor keeps its variant when its address changes
+func keepVisitorID(w http.ResponseWriter, link storage.Link, visitor string, issued bool) {
+	if issued || len(link.Variants) == 0 {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     visitorCookieName,
+		Value:    visitor,
+		Path:     "/",
+		MaxAge:   int(visitorCookieMaxAge / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
@@ -0,0 +1,161 @@
+package auth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+type Scope string
+
+const (
+	ScopeLinksCreate Scope = "links:create"
+	ScopeLinksRead   Scope = "links:read"
+	ScopeLinksUpdate Scope = "links:update"
+	ScopeLinksDelete Scope = "links:delete"
+	ScopeStatsRead   Scope = "stats:read"
+	// ScopeEventsAll lets operators stream the events of all users; it is never granted to cookie users
+	ScopeEventsAll Scope = "events:all"
+)
+
+// AllScopes are granted to users authenticated by cookie, who always act on their own links only
+var AllScopes = []Scope{ScopeLinksCreate, ScopeLinksRead, ScopeLinksUpdate, ScopeLinksDelete, ScopeStatsRead}
+
+// KeyScopes can be granted to API keys
+var KeyScopes = append(append([]Scope{}, AllScopes...), ScopeEventsAll)
+
+var ErrInvalidKey = errors.New("invalid API key")
+
+// ParseScopes parses a comma-separated list of scopes
+func ParseScopes(s string) ([]Scope, error) {
+	var scopes []Scope
+	for _, part := range strings.Split(s, ",") {
+		scope := Scope(strings.TrimSpace(part))
+		if scope == "" {
+			continue
+		}
+		if !isKnownScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		}
+		scopes = append(scopes, scope)
+	}
+	if len(scopes) == 0 {
+		return nil, errors.New("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+func isKnownScope(scope Scope) bool {
+	for _, known := range KeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Identity is the authenticated caller: a user, optionally acting through one of its API keys
+type Identity struct {
+	UserID string
+	KeyID  string
+	Scopes []Scope
+}
+
+func (i Identity) HasScope(scope Scope) bool {
+	for _, granted := range i.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(Identity)
+	return identity, ok
+}
+
+type Authenticator struct {
+	keys   storage.KeyStorage
+	secret []byte
+}
+
+// NewAuthenticator checks API keys against keys, which may be nil to reject every key,
+// and signs user cookies with secret
+func NewAuthenticator(keys storage.KeyStorage, secret []byte) *Authenticator {
+	return &Authenticator{keys: keys, secret: secret}
+}
+
+// AuthenticateKey resolves a bearer token into the identity of its owner
+func (a *Authenticator) AuthenticateKey(ctx context.Context, token string) (Identity, error) {
+	if a.keys == nil || token == "" {
+		return Identity{}, ErrInvalidKey
+	}
+	key, ok := a.keys.GetKeyByHash(ctx, HashKey(token))
+	if !ok || key.Revoked {
+		return Identity{}, ErrInvalidKey
+	}
+	scopes := make([]Scope, 0, len(key.Scopes))
+	for _, scope := range key.Scopes {
+		scopes = append(scopes, Scope(scope))
+	}
+	return Identity{UserID: key.UserID, KeyID: key.ID, Scopes: scopes}, nil
+}
+
+// SignUserID returns the value of the user cookie: the user ID followed by its HMAC-SHA256 signature
+func (a *Authenticator) SignUserID(userID string) string {
+	return userID + "." + a.sign(userID)
+}
+
+// VerifyUserCookie returns the user ID from a cookie value produced by SignUserID
+func (a *Authenticator) VerifyUserCookie(value string) (string, bool) {
+	dot := strings.LastIndexByte(value, '.')
+	if dot <= 0 {
+		return "", false
+	}
+	userID, signature := value[:dot], value[dot+1:]
+	if !hmac.Equal([]byte(signature), []byte(a.sign(userID))) {
+		return "", false
+	}
+	return userID, true
+}
+
+func (a *Authenticator) sign(userID string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(userID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func NewUserID() string {
+	return randomHex(16)
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand is unavailable: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+// NewSecret returns a random key for signing user cookies
+func NewSecret() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand is unavailable: %v", err))
+	}
+	return b
+}
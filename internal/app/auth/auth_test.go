@@ -0,0 +1,92 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+func TestCreateAndAuthenticateKey(t *testing.T) {
+	ctx := context.Background()
+	keys := storage.NewMemoryKeyStorage()
+	a := NewAuthenticator(keys, []byte("secret"))
+
+	token, key, err := CreateKey(ctx, keys, "ci", "user-1", []Scope{ScopeLinksCreate})
+	require.NoError(t, err)
+	assert.NotContains(t, key.Hash, token)
+
+	identity, err := a.AuthenticateKey(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "user-1", identity.UserID)
+	assert.Equal(t, key.ID, identity.KeyID)
+	assert.True(t, identity.HasScope(ScopeLinksCreate))
+	assert.False(t, identity.HasScope(ScopeLinksDelete))
+
+	_, err = a.AuthenticateKey(ctx, token+"x")
+	assert.ErrorIs(t, err, ErrInvalidKey)
+
+	revoked, err := keys.RevokeKey(ctx, key.ID)
+	require.NoError(t, err)
+	assert.True(t, revoked)
+	_, err = a.AuthenticateKey(ctx, token)
+	assert.ErrorIs(t, err, ErrInvalidKey)
+}
+
+func TestUserCookie(t *testing.T) {
+	a := NewAuthenticator(nil, []byte("secret"))
+
+	userID, ok := a.VerifyUserCookie(a.SignUserID("user-1"))
+	assert.True(t, ok)
+	assert.Equal(t, "user-1", userID)
+
+	_, ok = a.VerifyUserCookie("user-2." + a.sign("user-1"))
+	assert.False(t, ok)
+	_, ok = NewAuthenticator(nil, []byte("other")).VerifyUserCookie(a.SignUserID("user-1"))
+	assert.False(t, ok)
+}
+
+func TestParseScopes(t *testing.T) {
+	scopes, err := ParseScopes("links:create, stats:read")
+	require.NoError(t, err)
+	assert.Equal(t, []Scope{ScopeLinksCreate, ScopeStatsRead}, scopes)
+
+	_, err = ParseScopes("links:everything")
+	assert.Error(t, err)
+	_, err = ParseScopes("")
+	assert.Error(t, err)
+}
+
+// collidingKeyStorage reports the first IDs it is given as taken
+type collidingKeyStorage struct {
+	storage.KeyStorage
+	collisions int
+	ids        []string
+}
+
+func (s *collidingKeyStorage) PutKey(ctx context.Context, key storage.APIKey) error {
+	s.ids = append(s.ids, key.ID)
+	if len(s.ids) <= s.collisions {
+		return storage.ErrKeyExists
+	}
+	return s.KeyStorage.PutKey(ctx, key)
+}
+
+func TestCreateKeyRetriesTakenIDs(t *testing.T) {
+	ctx := context.Background()
+	keys := &collidingKeyStorage{KeyStorage: storage.NewMemoryKeyStorage(), collisions: keyIDAttempts - 1}
+
+	_, key, err := CreateKey(ctx, keys, "ci", "user-1", []Scope{ScopeLinksCreate})
+	require.NoError(t, err)
+	assert.Len(t, keys.ids, keyIDAttempts)
+	assert.Equal(t, keys.ids[len(keys.ids)-1], key.ID)
+	assert.Len(t, key.ID, 2*keyIDBytes)
+
+	keys = &collidingKeyStorage{KeyStorage: storage.NewMemoryKeyStorage(), collisions: keyIDAttempts}
+	_, _, err = CreateKey(ctx, keys, "ci", "user-1", []Scope{ScopeLinksCreate})
+	assert.ErrorIs(t, err, storage.ErrKeyExists)
+	assert.Empty(t, keys.ListKeys(ctx))
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const (
+	keyPrefix = "shk_"
+	// keyIDBytes makes IDs of 64 random bits, so that they practically never collide
+	keyIDBytes = 8
+	// keyIDAttempts is how many IDs are tried before a collision is reported
+	keyIDAttempts = 3
+)
+
+// HashKey returns the form in which API key tokens are stored
+func HashKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateKey generates a new API key for the user, creating a new user when userID is empty.
+// The returned token is the only place the secret appears, it cannot be recovered later
+func CreateKey(ctx context.Context, keys storage.KeyStorage, name, userID string, scopes []Scope) (string, storage.APIKey, error) {
+	if userID == "" {
+		userID = NewUserID()
+	}
+	scopeNames := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		scopeNames = append(scopeNames, string(scope))
+	}
+	var err error
+	for attempt := 0; attempt < keyIDAttempts; attempt++ {
+		id := randomHex(keyIDBytes)
+		token := keyPrefix + id + "_" + randomHex(32)
+		key := storage.APIKey{
+			ID:        id,
+			Hash:      HashKey(token),
+			Name:      name,
+			UserID:    userID,
+			Scopes:    scopeNames,
+			CreatedAt: time.Now().UTC(),
+		}
+		if err = keys.PutKey(ctx, key); err == nil {
+			return token, key, nil
+		}
+		if !errors.Is(err, storage.ErrKeyExists) {
+			break
+		}
+	}
+	return "", storage.APIKey{}, err
+}
@@ -0,0 +1,78 @@
+// Package bloom implements a Bloom filter of strings: it tells for sure that a string was never added,
+// and that it might have been added with a bounded false positive rate
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// Filter is a Bloom filter sized for an expected number of strings; it is safe for concurrent use.
+// More strings than expected can be added, at the cost of a higher false positive rate
+type Filter struct {
+	bits  []uint64
+	m     uint64
+	k     uint64
+	count uint64
+	mtx   sync.RWMutex
+}
+
+// New sizes a filter for the expected number of strings and the false positive rate, e.g. 0.01
+func New(expected int, falsePositiveRate float64) *Filter {
+	if expected < 1 {
+		expected = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 0.01
+	}
+	n := float64(expected)
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+	words := (uint64(m) + 63) / 64
+	return &Filter{bits: make([]uint64, words), m: words * 64, k: uint64(k)}
+}
+
+// Add adds the string
+func (f *Filter) Add(s string) {
+	h1, h2 := hashes(s)
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+// MayContain returns false when the string was never added; true may be a false positive
+func (f *Filter) MayContain(s string) bool {
+	h1, h2 := hashes(s)
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	for i := uint64(0); i < f.k; i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns how many times strings were added, repeats included
+func (f *Filter) Count() uint64 {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+	return f.count
+}
+
+// hashes derives the positions of a string from two hashes, as in "Less Hashing, Same Performance"
+// by Kirsch and Mitzenmacher
+func hashes(s string) (uint64, uint64) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+	// a zero second hash would put all the positions of the string in one
+	return h1, h2 | 1
+}
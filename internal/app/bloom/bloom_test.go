@@ -0,0 +1,35 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilter(t *testing.T) {
+	const expected = 10000
+	f := New(expected, 0.01)
+	for i := 0; i < expected; i++ {
+		f.Add("added-" + strconv.Itoa(i))
+	}
+	for i := 0; i < expected; i++ {
+		assert.True(t, f.MayContain("added-"+strconv.Itoa(i)), "there are no false negatives")
+	}
+	assert.Equal(t, uint64(expected), f.Count())
+
+	falsePositives := 0
+	for i := 0; i < expected; i++ {
+		if f.MayContain("missing-" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, expected*2/100, "the false positive rate is about the configured one")
+}
+
+func TestNewSanitizesParameters(t *testing.T) {
+	f := New(0, 2)
+	f.Add("a")
+	assert.True(t, f.MayContain("a"))
+	assert.False(t, f.MayContain("b"))
+}
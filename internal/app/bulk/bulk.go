@@ -0,0 +1,236 @@
+// Package bulk reads and writes links in the CSV and NDJSON formats of imports and exports
+package bulk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+
+	maxNDJSONLine = 1 << 20
+)
+
+// Row is a link to import
+type Row struct {
+	URL    string
+	Alias  string
+	Domain string
+}
+
+// Record is an exported link; exports can be imported back, their ID being the alias
+type Record struct {
+	ID          string    `json:"id"`
+	ShortURL    string    `json:"short_url"`
+	OriginalURL string    `json:"original_url"`
+	Domain      string    `json:"domain,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Clicks      int64     `json:"clicks"`
+}
+
+// Columns is the header row of CSV exports
+var Columns = []string{"id", "short_url", "original_url", "domain", "created_at", "clicks"}
+
+// ValidateFormat checks that the format is FormatCSV or FormatNDJSON
+func ValidateFormat(format string) error {
+	if format != FormatCSV && format != FormatNDJSON {
+		return fmt.Errorf("unknown format %q, expected %s or %s", format, FormatCSV, FormatNDJSON)
+	}
+	return nil
+}
+
+// Read calls fn for every row, numbered from 1 and not counting the CSV header row. Rows which cannot be parsed
+// are passed with an error and reading goes on; the returned error stops reading.
+// CSV files need a header row with `url` or `original_url`, optional `alias` or `id` and optional `domain` columns,
+// other columns are ignored. NDJSON objects have the same fields
+func Read(r io.Reader, format string, fn func(row int, value Row, err error)) error {
+	switch format {
+	case FormatCSV:
+		return readCSV(r, fn)
+	case FormatNDJSON:
+		return readNDJSON(r, fn)
+	}
+	return ValidateFormat(format)
+}
+
+func readCSV(r io.Reader, fn func(int, Row, error)) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("could not read the header row: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	field := func(record []string, names ...string) string {
+		for _, name := range names {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+		}
+		return ""
+	}
+	if _, ok := columns["url"]; !ok {
+		if _, ok := columns["original_url"]; !ok {
+			return errors.New("the header row has no url column")
+		}
+	}
+
+	for row := 1; ; row++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			fn(row, Row{}, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fn(row, Row{
+			URL:    field(record, "url", "original_url"),
+			Alias:  field(record, "alias", "id"),
+			Domain: field(record, "domain"),
+		}, nil)
+	}
+}
+
+// ndjsonRow accepts the fields of Record besides the ones of Row
+type ndjsonRow struct {
+	URL         string `json:"url"`
+	OriginalURL string `json:"original_url"`
+	Alias       string `json:"alias"`
+	ID          string `json:"id"`
+	Domain      string `json:"domain"`
+}
+
+func readNDJSON(r io.Reader, fn func(int, Row, error)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64<<10), maxNDJSONLine)
+	row := 0
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		row++
+		var value ndjsonRow
+		if err := json.Unmarshal(line, &value); err != nil {
+			fn(row, Row{}, err)
+			continue
+		}
+		if value.URL == "" {
+			value.URL = value.OriginalURL
+		}
+		if value.Alias == "" {
+			value.Alias = value.ID
+		}
+		fn(row, Row{URL: value.URL, Alias: value.Alias, Domain: value.Domain}, nil)
+	}
+	if errors.Is(scanner.Err(), bufio.ErrTooLong) {
+		return errors.New("a line is longer than " + strconv.Itoa(maxNDJSONLine) + " bytes")
+	}
+	return scanner.Err()
+}
+
+// Writer writes records one at a time, so that exports are streamed
+type Writer struct {
+	csv  *csv.Writer
+	json *json.Encoder
+}
+
+// NewWriter starts an export, writing the header row of CSV ones
+func NewWriter(w io.Writer, format string) (*Writer, error) {
+	switch format {
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		return &Writer{csv: writer}, writer.Write(Columns)
+	case FormatNDJSON:
+		return &Writer{json: json.NewEncoder(w)}, nil
+	}
+	return nil, ValidateFormat(format)
+}
+
+func (w *Writer) Write(record Record) error {
+	if w.json != nil {
+		return w.json.Encode(record)
+	}
+	return w.csv.Write([]string{
+		record.ID,
+		record.ShortURL,
+		record.OriginalURL,
+		record.Domain,
+		record.CreatedAt.Format(time.RFC3339),
+		strconv.FormatInt(record.Clicks, 10),
+	})
+}
+
+// Flush writes out buffered records
+func (w *Writer) Flush() error {
+	if w.csv == nil {
+		return nil
+	}
+	w.csv.Flush()
+	return w.csv.Error()
+}
+
+// maxReportedRows bounds the rows listed in a report, the counters cover all of them
+const maxReportedRows = 1000
+
+// Report sums up an import
+type Report struct {
+	Imported int `json:"imported"`
+	Failed   int `json:"failed"`
+	// Rows are the failed rows and the rows imported under a new ID because their alias is taken
+	Rows      []ReportRow `json:"rows,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	// Error stops the import, the rows before it are imported
+	Error string `json:"error,omitempty"`
+}
+
+// ReportRow is a row of an import worth reporting
+type ReportRow struct {
+	Row      int    `json:"row"`
+	Alias    string `json:"alias,omitempty"`
+	ShortURL string `json:"short_url,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Fail counts a row which is not imported
+func (r *Report) Fail(row int, err error) {
+	r.Failed++
+	r.add(ReportRow{Row: row, Error: err.Error()})
+}
+
+// Renamed counts a row imported under a new short URL because its alias is taken
+func (r *Report) Renamed(row int, alias, shortURL string) {
+	r.Imported++
+	r.add(ReportRow{Row: row, Alias: alias, ShortURL: shortURL})
+}
+
+func (r *Report) add(row ReportRow) {
+	if len(r.Rows) >= maxReportedRows {
+		r.Truncated = true
+		return
+	}
+	r.Rows = append(r.Rows, row)
+}
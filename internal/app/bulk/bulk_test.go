@@ -0,0 +1,80 @@
+package bulk
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, input, format string) ([]Row, map[int]error) {
+	var rows []Row
+	failed := make(map[int]error)
+	err := Read(strings.NewReader(input), format, func(row int, value Row, err error) {
+		if err != nil {
+			failed[row] = err
+			return
+		}
+		rows = append(rows, value)
+	})
+	require.NoError(t, err)
+	return rows, failed
+}
+
+func TestReadCSV(t *testing.T) {
+	rows, failed := readAll(t, "\ufeffAlias, URL ,extra\ndocs,https://go.dev,x\n,https://ya.ru\n\"broken,https://x\n", FormatCSV)
+	assert.Equal(t, []Row{{URL: "https://go.dev", Alias: "docs"}, {URL: "https://ya.ru"}}, rows)
+	assert.Len(t, failed, 1)
+
+	err := Read(strings.NewReader("alias,domain\nx,y\n"), FormatCSV, func(int, Row, error) {})
+	assert.Error(t, err, "the url column is required")
+}
+
+func TestReadNDJSON(t *testing.T) {
+	rows, failed := readAll(t, `{"url":"https://go.dev","alias":"docs"}
+
+{"original_url":"https://ya.ru","id":"ya","domain":"a.example"}
+not json
+`, FormatNDJSON)
+	assert.Equal(t, []Row{{URL: "https://go.dev", Alias: "docs"}, {URL: "https://ya.ru", Alias: "ya", Domain: "a.example"}}, rows)
+	assert.Contains(t, failed, 3, "blank lines are not counted")
+}
+
+func TestExportCanBeImported(t *testing.T) {
+	records := []Record{
+		{ID: "docs", ShortURL: "http://localhost:8080/docs", OriginalURL: "https://go.dev", CreatedAt: time.Unix(0, 0).UTC(), Clicks: 3},
+		{ID: "ya", ShortURL: "https://a.example/ya", OriginalURL: "https://ya.ru", Domain: "a.example"},
+	}
+	for _, format := range []string{FormatCSV, FormatNDJSON} {
+		var buf bytes.Buffer
+		writer, err := NewWriter(&buf, format)
+		require.NoError(t, err)
+		for _, record := range records {
+			require.NoError(t, writer.Write(record))
+		}
+		require.NoError(t, writer.Flush())
+
+		rows, failed := readAll(t, buf.String(), format)
+		assert.Empty(t, failed, format)
+		assert.Equal(t, []Row{{URL: "https://go.dev", Alias: "docs"}, {URL: "https://ya.ru", Alias: "ya", Domain: "a.example"}}, rows, format)
+	}
+
+	_, err := NewWriter(&bytes.Buffer{}, "xml")
+	assert.Error(t, err)
+}
+
+func TestReportIsBounded(t *testing.T) {
+	var report Report
+	for row := 1; row <= maxReportedRows+1; row++ {
+		report.Fail(row, errors.New("invalid"))
+	}
+	report.Renamed(maxReportedRows+2, "taken", "http://localhost:8080/abc")
+	assert.Equal(t, maxReportedRows+1, report.Failed)
+	assert.Equal(t, 1, report.Imported)
+	assert.Len(t, report.Rows, maxReportedRows)
+	assert.True(t, report.Truncated)
+}
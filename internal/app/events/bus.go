@@ -0,0 +1,131 @@
+package events
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// subscriberBuffer bounds the entries a subscriber can lag behind before it is dropped
+const subscriberBuffer = 64
+
+// Entry is an event numbered by the bus
+type Entry struct {
+	// ID is unique within the lifetime of the bus and orders the entries, see Bus.Subscribe
+	ID    string
+	Event Event
+}
+
+// Bus fans events out to live subscribers and keeps the latest ones in a bounded ring buffer,
+// so that subscribers reconnecting shortly after a disconnect can resume without gaps.
+// Events are also forwarded to other publishers, such as webhooks
+type Bus struct {
+	forward     []Publisher
+	epoch       string
+	ring        []Entry
+	seq         uint64
+	subscribers map[*Subscriber]struct{}
+	mtx         sync.Mutex
+}
+
+var _ Publisher = &Bus{}
+
+// Subscriber receives the entries matching its filter until it is unsubscribed or falls behind
+type Subscriber struct {
+	ch     chan Entry
+	filter func(Event) bool
+}
+
+// Entries is closed when the subscriber is unsubscribed or dropped for falling behind
+func (s *Subscriber) Entries() <-chan Entry {
+	return s.ch
+}
+
+// NewBus keeps up to capacity latest events for resumption
+func NewBus(capacity int, forward ...Publisher) *Bus {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Bus{
+		forward:     forward,
+		epoch:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		ring:        make([]Entry, 0, capacity),
+		subscribers: make(map[*Subscriber]struct{}),
+	}
+}
+
+func (b *Bus) Publish(ctx context.Context, event Event) {
+	b.mtx.Lock()
+	b.seq++
+	entry := Entry{ID: b.epoch + "." + strconv.FormatUint(b.seq, 10), Event: event}
+	if len(b.ring) < cap(b.ring) {
+		b.ring = append(b.ring, entry)
+	} else {
+		b.ring[(b.seq-1)%uint64(cap(b.ring))] = entry
+	}
+	for s := range b.subscribers {
+		if !s.filter(event) {
+			continue
+		}
+		select {
+		case s.ch <- entry:
+		default:
+			delete(b.subscribers, s)
+			close(s.ch)
+		}
+	}
+	b.mtx.Unlock()
+
+	for _, publisher := range b.forward {
+		publisher.Publish(ctx, event)
+	}
+}
+
+// Subscribe starts receiving the events matching the filter. The buffered entries following lastEntryID
+// are returned for replay; an ID from before a restart replays the whole buffer and an empty one replays nothing
+func (b *Bus) Subscribe(lastEntryID string, filter func(Event) bool) (*Subscriber, []Entry) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	var backlog []Entry
+	if lastEntryID != "" {
+		after := uint64(0)
+		if epoch, seq, ok := strings.Cut(lastEntryID, "."); ok && epoch == b.epoch {
+			after, _ = strconv.ParseUint(seq, 10, 64)
+		}
+		for i := range b.ring {
+			// the oldest entry is at the write position once the ring is full
+			entry := b.ring[(int(b.seq)-len(b.ring)+i)%cap(b.ring)]
+			if b.seq-uint64(len(b.ring))+uint64(i)+1 > after && filter(entry.Event) {
+				backlog = append(backlog, entry)
+			}
+		}
+	}
+
+	s := &Subscriber{ch: make(chan Entry, subscriberBuffer), filter: filter}
+	b.subscribers[s] = struct{}{}
+	return s, backlog
+}
+
+// Unsubscribe stops the subscriber, which may already be dropped
+func (b *Bus) Unsubscribe(s *Subscriber) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
+
+// DropSubscribers drops all subscribers, which ends their streams; meant for shutdown, so that clients
+// reconnect to another instance instead of holding this one up
+func (b *Bus) DropSubscribers() {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.ch)
+	}
+}
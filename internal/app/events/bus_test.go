@@ -0,0 +1,104 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+type recordingPublisher struct {
+	events []Event
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, event Event) {
+	p.events = append(p.events, event)
+}
+
+func all(Event) bool { return true }
+
+func publish(b *Bus, ids ...string) {
+	for _, id := range ids {
+		b.Publish(context.Background(), New(LinkClicked, storage.Link{ID: id}))
+	}
+}
+
+func linkIDs(entries []Entry) []string {
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.Event.Link.ID)
+	}
+	return ids
+}
+
+func TestBusDeliversAndForwards(t *testing.T) {
+	forwarded := &recordingPublisher{}
+	b := NewBus(10, forwarded)
+	s, backlog := b.Subscribe("", func(event Event) bool { return event.Link.ID != "skipped" })
+	assert.Empty(t, backlog)
+
+	publish(b, "a", "skipped", "b")
+	assert.Equal(t, "a", (<-s.Entries()).Event.Link.ID)
+	assert.Equal(t, "b", (<-s.Entries()).Event.Link.ID)
+	assert.Len(t, forwarded.events, 3)
+
+	b.Unsubscribe(s)
+	_, ok := <-s.Entries()
+	assert.False(t, ok)
+}
+
+func TestBusResumesFromRingBuffer(t *testing.T) {
+	b := NewBus(3)
+	publish(b, "a", "b")
+	s, _ := b.Subscribe("", all)
+	publish(b, "c", "d", "e")
+	<-s.Entries()
+	second := <-s.Entries()
+
+	_, backlog := b.Subscribe(second.ID, all)
+	assert.Equal(t, []string{"e"}, linkIDs(backlog))
+
+	_, backlog = b.Subscribe("unknown.1", all)
+	assert.Equal(t, []string{"c", "d", "e"}, linkIDs(backlog), "IDs of another bus replay the whole buffer")
+}
+
+func TestBusDropsLaggingSubscribers(t *testing.T) {
+	b := NewBus(1)
+	s, _ := b.Subscribe("", all)
+	for i := 0; i <= subscriberBuffer; i++ {
+		publish(b, fmt.Sprint(i))
+	}
+
+	received := 0
+	for range s.Entries() {
+		received++
+	}
+	assert.Equal(t, subscriberBuffer, received)
+	b.Unsubscribe(s)
+}
+
+func TestBusDropsSubscribersOnShutdown(t *testing.T) {
+	b := NewBus(1)
+	s, _ := b.Subscribe("", all)
+	publish(b, "a")
+	b.DropSubscribers()
+
+	received := 0
+	for range s.Entries() {
+		received++
+	}
+	assert.Equal(t, 1, received, "entries sent before are still delivered")
+	b.Unsubscribe(s)
+}
+
+func TestParseType(t *testing.T) {
+	eventType, err := ParseType("link.created")
+	require.NoError(t, err)
+	assert.Equal(t, LinkCreated, eventType)
+	_, err = ParseType("link.renamed")
+	assert.Error(t, err)
+}
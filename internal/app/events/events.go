@@ -0,0 +1,83 @@
+// Package events describes what happens to links, so that other systems can react to it
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+type Type string
+
+const (
+	LinkCreated Type = "link.created"
+	LinkUpdated Type = "link.updated"
+	LinkDeleted Type = "link.deleted"
+	LinkClicked Type = "link.clicked"
+	// LinkExpired is published when a storage bounded by a TTL drops a link unused for it
+	LinkExpired Type = "link.expired"
+)
+
+// Types lists all event types
+var Types = []Type{LinkCreated, LinkUpdated, LinkDeleted, LinkClicked, LinkExpired}
+
+// ParseType checks that the name is one of Types
+func ParseType(name string) (Type, error) {
+	for _, t := range Types {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event type %q", name)
+}
+
+type Event struct {
+	ID   string    `json:"id"`
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Link Link      `json:"link"`
+}
+
+// Link is the part of a link events carry
+type Link struct {
+	ID        string    `json:"id"`
+	Domain    string    `json:"domain,omitempty"`
+	URL       string    `json:"url"`
+	UserID    string    `json:"user_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// Variant is the index of the variant a click was served by
+	Variant *int `json:"variant,omitempty"`
+}
+
+// Publisher accepts events; implementations must not block the caller
+type Publisher interface {
+	Publish(ctx context.Context, event Event)
+}
+
+// New makes an event of the link happening now
+func New(eventType Type, link storage.Link) Event {
+	return Event{
+		ID:   newID(),
+		Type: eventType,
+		Time: time.Now().UTC(),
+		Link: Link{
+			ID:        link.ID,
+			Domain:    link.Domain,
+			URL:       link.URL,
+			UserID:    link.UserID,
+			CreatedAt: link.CreatedAt,
+		},
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("crypto/rand is unavailable: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLevel converts a level name such as `info` or `WARN` into a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+var (
+	mtx   sync.Mutex
+	out   io.Writer = os.Stderr
+	level           = int32(LevelInfo)
+)
+
+func SetOutput(w io.Writer) {
+	mtx.Lock()
+	defer mtx.Unlock()
+	out = w
+}
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func Enabled(l Level) bool {
+	return int32(l) >= atomic.LoadInt32(&level)
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID, which is then added to every line logged with it
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+func Debug(ctx context.Context, msg string, keyvals ...interface{}) {
+	write(ctx, LevelDebug, msg, keyvals)
+}
+
+func Info(ctx context.Context, msg string, keyvals ...interface{}) {
+	write(ctx, LevelInfo, msg, keyvals)
+}
+
+func Warn(ctx context.Context, msg string, keyvals ...interface{}) {
+	write(ctx, LevelWarn, msg, keyvals)
+}
+
+func Error(ctx context.Context, msg string, keyvals ...interface{}) {
+	write(ctx, LevelError, msg, keyvals)
+}
+
+// write encodes a single JSON line; keyvals are alternating keys and values, like `"id", id, "error", err`
+func write(ctx context.Context, l Level, msg string, keyvals []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	writeField(&b, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeField(&b, "level", l.String(), false)
+	writeField(&b, "msg", msg, false)
+	if requestID := RequestID(ctx); requestID != "" {
+		writeField(&b, "request_id", requestID, false)
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		var value interface{} = "!MISSING"
+		if i+1 < len(keyvals) {
+			value = keyvals[i+1]
+		}
+		writeField(&b, key, value, false)
+	}
+	b.WriteString("}\n")
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	_, _ = out.Write(b.Bytes())
+}
+
+func writeField(b *bytes.Buffer, key string, value interface{}, first bool) {
+	if !first {
+		b.WriteByte(',')
+	}
+	encodedKey, _ := json.Marshal(key)
+	b.Write(encodedKey)
+	b.WriteByte(':')
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case time.Duration:
+		value = v.String()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(encodedValue)
+}
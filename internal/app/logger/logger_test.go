@@ -0,0 +1,58 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInfoWithRequestID(t *testing.T) {
+	var b bytes.Buffer
+	SetOutput(&b)
+	defer SetOutput(&bytes.Buffer{})
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	Info(ctx, "link created", "id", "12345", "error", errors.New("boom"))
+
+	line := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(b.Bytes(), &line))
+	assert.Equal(t, "info", line["level"])
+	assert.Equal(t, "link created", line["msg"])
+	assert.Equal(t, "req-1", line["request_id"])
+	assert.Equal(t, "12345", line["id"])
+	assert.Equal(t, "boom", line["error"])
+	assert.NotEmpty(t, line["time"])
+}
+
+func TestLevelFiltering(t *testing.T) {
+	var b bytes.Buffer
+	SetOutput(&b)
+	defer SetOutput(&bytes.Buffer{})
+	SetLevel(LevelWarn)
+	defer SetLevel(LevelInfo)
+
+	Debug(context.Background(), "debug")
+	Info(context.Background(), "info")
+	assert.Empty(t, b.String())
+
+	Warn(context.Background(), "warn")
+	assert.Contains(t, b.String(), `"level":"warn"`)
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := ParseLevel("DEBUG")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelDebug, l)
+
+	l, err = ParseLevel("")
+	assert.NoError(t, err)
+	assert.Equal(t, LevelInfo, l)
+
+	_, err = ParseLevel("verbose")
+	assert.Error(t, err)
+}
@@ -0,0 +1,40 @@
+// Package metrics publishes the counters of the service through expvar, which serves them as JSON
+package metrics
+
+import (
+	"expvar"
+	"net/http"
+)
+
+// Reasons requests are rejected for
+const (
+	ReasonOverload     = "overload"
+	ReasonRateLimit    = "rate_limit"
+	ReasonBodyTooLarge = "body_too_large"
+	ReasonTimeout      = "timeout"
+)
+
+var rejectedRequests = expvar.NewMap("rejected_requests")
+
+// Rejected counts a request which is not served, or not served in time, for the reason
+func Rejected(reason string) {
+	rejectedRequests.Add(reason, 1)
+}
+
+// RejectedCount returns the number of requests rejected for the reason so far
+func RejectedCount(reason string) int64 {
+	if v, ok := rejectedRequests.Get(reason).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// Publish publishes a value computed whenever the metrics are served, such as the statistics of a cache
+func Publish(name string, value func() interface{}) {
+	expvar.Publish(name, expvar.Func(value))
+}
+
+// Handler serves all published variables, including the memory statistics of the runtime
+func Handler() http.Handler {
+	return expvar.Handler()
+}
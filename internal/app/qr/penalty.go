@@ -0,0 +1,96 @@
+package qr
+
+const (
+	penaltyN1 = 3
+	penaltyN2 = 3
+	penaltyN3 = 40
+	penaltyN4 = 10
+)
+
+// penaltyScore rates how hard the symbol is to scan, the mask with the lowest score is used
+func (c *Code) penaltyScore() int {
+	result := 0
+
+	for y := 0; y < c.Size; y++ {
+		result += c.linePenalty(func(i int) bool { return c.modules[y][i] })
+	}
+	for x := 0; x < c.Size; x++ {
+		result += c.linePenalty(func(i int) bool { return c.modules[i][x] })
+	}
+
+	for y := 0; y < c.Size-1; y++ {
+		for x := 0; x < c.Size-1; x++ {
+			color := c.modules[y][x]
+			if color == c.modules[y][x+1] && color == c.modules[y+1][x] && color == c.modules[y+1][x+1] {
+				result += penaltyN2
+			}
+		}
+	}
+
+	dark := 0
+	for _, row := range c.modules {
+		for _, module := range row {
+			if module {
+				dark++
+			}
+		}
+	}
+	total := c.Size * c.Size
+	k := (absInt(dark*20-total*10)+total-1)/total - 1
+	result += k * penaltyN4
+	return result
+}
+
+// linePenalty scores runs of same-colored modules and finder-like patterns in a row or a column
+func (c *Code) linePenalty(module func(i int) bool) int {
+	result := 0
+	runColor := false
+	runLength := 0
+	var runHistory [7]int
+	for i := 0; i < c.Size; i++ {
+		if module(i) == runColor {
+			runLength++
+			if runLength == 5 {
+				result += penaltyN1
+			} else if runLength > 5 {
+				result++
+			}
+			continue
+		}
+		c.addRunHistory(runLength, &runHistory)
+		if !runColor {
+			result += countFinderPatterns(&runHistory) * penaltyN3
+		}
+		runColor = module(i)
+		runLength = 1
+	}
+	if runColor {
+		c.addRunHistory(runLength, &runHistory)
+		runLength = 0
+	}
+	runLength += c.Size // the light quiet zone after the line
+	c.addRunHistory(runLength, &runHistory)
+	return result + countFinderPatterns(&runHistory)*penaltyN3
+}
+
+func (c *Code) addRunHistory(runLength int, runHistory *[7]int) {
+	if runHistory[0] == 0 {
+		runLength += c.Size // the light quiet zone before the line
+	}
+	copy(runHistory[1:], runHistory[:6])
+	runHistory[0] = runLength
+}
+
+// countFinderPatterns counts 1:1:3:1:1 patterns with light margins on either side in the latest runs
+func countFinderPatterns(runHistory *[7]int) int {
+	n := runHistory[1]
+	core := n > 0 && runHistory[2] == n && runHistory[3] == n*3 && runHistory[4] == n && runHistory[5] == n
+	result := 0
+	if core && runHistory[0] >= n*4 && runHistory[6] >= n {
+		result++
+	}
+	if core && runHistory[6] >= n*4 && runHistory[0] >= n {
+		result++
+	}
+	return result
+}
@@ -0,0 +1,77 @@
+package qr
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodePicksSmallestVersion(t *testing.T) {
+	c, err := Encode("http://localhost:8080/abcdEFGH", Medium)
+	require.NoError(t, err)
+	assert.Equal(t, 3, c.version)
+	assert.Equal(t, 29, c.Size)
+
+	c, err = Encode("http://localhost:8080/abcdEFGH", High)
+	require.NoError(t, err)
+	assert.Equal(t, 4, c.version)
+}
+
+func TestFunctionPatterns(t *testing.T) {
+	c, err := Encode(strings.Repeat("https://example.com/", 10), Low)
+	require.NoError(t, err)
+
+	for _, corner := range [][2]int{{0, 0}, {c.Size - 7, 0}, {0, c.Size - 7}} {
+		x, y := corner[0], corner[1]
+		assert.True(t, c.Dark(x, y))
+		assert.False(t, c.Dark(x+1, y+1))
+		assert.True(t, c.Dark(x+3, y+3))
+	}
+	assert.True(t, c.Dark(8, c.Size-8), "dark module")
+	for i := 8; i < c.Size-8; i++ {
+		assert.Equal(t, i%2 == 0, c.Dark(i, 6))
+		assert.Equal(t, i%2 == 0, c.Dark(6, i))
+	}
+}
+
+func TestReedSolomon(t *testing.T) {
+	// the example of the specification: "01234567" at level M in version 1
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	ecc := reedSolomonRemainder(data, reedSolomonDivisor(10))
+	assert.Equal(t, []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}, ecc)
+}
+
+func TestTooLong(t *testing.T) {
+	_, err := Encode(strings.Repeat("x", 3000), High)
+	assert.ErrorIs(t, err, ErrTooLong)
+}
+
+func TestRender(t *testing.T) {
+	c, err := Encode("https://ya.ru", Medium)
+	require.NoError(t, err)
+
+	assert.Equal(t, 21, c.Size)
+	total := c.Size + 2*QuietZone
+	for size, scale := range map[int]int{256: 9, 128: 4, 130: 4, 131: 5, 29: 1, 10: 1} {
+		b, err := c.PNG(size)
+		require.NoError(t, err)
+		img, err := png.Decode(bytes.NewReader(b))
+		require.NoError(t, err)
+		assert.Equal(t, scale*total, img.Bounds().Dx(), size)
+		assert.Equal(t, scale*total, img.Bounds().Dy(), size)
+		// the quiet zone is light and the first module of the finder pattern, wholly dark
+		assert.Equal(t, color.Gray16{Y: 0xffff}, color.Gray16Model.Convert(img.At(QuietZone*scale-1, QuietZone*scale-1)), size)
+		for _, p := range []int{QuietZone * scale, (QuietZone+1)*scale - 1} {
+			assert.Equal(t, color.Gray16{Y: 0}, color.Gray16Model.Convert(img.At(p, p)), size)
+		}
+	}
+
+	svg := string(c.SVG(256))
+	assert.Contains(t, svg, `width="256"`)
+	assert.Contains(t, svg, `viewBox="0 0 29 29"`)
+}
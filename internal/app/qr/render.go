@@ -0,0 +1,72 @@
+package qr
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// QuietZone is the width of the light border required around the symbol, in modules
+const QuietZone = 4
+
+// PNG renders the code with its quiet zone as a black and white image of about size pixels along each side:
+// every module takes the whole number of pixels which comes nearest to the size, at least one, so that all
+// modules are as wide
+func (c *Code) PNG(size int) ([]byte, error) {
+	total := c.Size + 2*QuietZone
+	scale := (size + total/2) / total
+	if scale < 1 {
+		scale = 1
+	}
+
+	palette := color.Palette{color.White, color.Black}
+	img := image.NewPaletted(image.Rect(0, 0, total*scale, total*scale), palette)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				offset := img.PixOffset((x+QuietZone)*scale, (y+QuietZone)*scale+dy)
+				for dx := 0; dx < scale; dx++ {
+					img.Pix[offset+dx] = 1
+				}
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&b, img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// SVG renders the code with its quiet zone as a scalable image displayed size pixels wide
+func (c *Code) SVG(size int) []byte {
+	total := c.Size + 2*QuietZone
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" version="1.1" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n", size, size, total, total)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#FFFFFF"/>`+"\n")
+	b.WriteString(`<path fill="#000000" d="`)
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			// merge horizontal runs of dark modules into a single rectangle
+			run := 1
+			for x+run < c.Size && c.modules[y][x+run] {
+				run++
+			}
+			fmt.Fprintf(&b, "M%d,%dh%dv1h-%dz", x+QuietZone, y+QuietZone, run, run)
+			x += run - 1
+		}
+	}
+	b.WriteString(`"/>` + "\n</svg>\n")
+	return b.Bytes()
+}
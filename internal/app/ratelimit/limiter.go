@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"container/list"
+	"math"
+	"sync"
+	"time"
+)
+
+// Limiter is a set of token buckets, one per key, refilled at a constant rate.
+// The number of buckets is bounded: idle buckets are evicted first, then the least recently used ones
+type Limiter struct {
+	rate       float64
+	burst      float64
+	maxBuckets int
+	idleTTL    time.Duration
+	now        func() time.Time
+
+	mtx     sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// Result describes the outcome of a single Allow call
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// NewLimiter returns a limiter allowing `rate` requests per second with bursts of up to `burst` requests per key,
+// or nil if rate is not positive, which disables limiting
+func NewLimiter(rate float64, burst int, maxBuckets int, idleTTL time.Duration) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if maxBuckets < 1 {
+		maxBuckets = 1
+	}
+	return &Limiter{
+		rate:       rate,
+		burst:      float64(burst),
+		maxBuckets: maxBuckets,
+		idleTTL:    idleTTL,
+		now:        time.Now,
+		buckets:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Allow takes a token from the bucket of the key if there is one
+func (l *Limiter) Allow(key string) Result {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	now := l.now()
+	l.evictIdle(now)
+
+	var b *bucket
+	if element, ok := l.buckets[key]; ok {
+		b = element.Value.(*bucket)
+		b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+		b.last = now
+		l.lru.MoveToFront(element)
+	} else {
+		for len(l.buckets) >= l.maxBuckets {
+			l.removeElement(l.lru.Back())
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+	}
+
+	result := Result{Limit: int(l.burst)}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = l.durationFor(1 - b.tokens)
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = l.durationFor(l.burst - b.tokens)
+	return result
+}
+
+// Len returns the number of buckets currently kept in memory
+func (l *Limiter) Len() int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return len(l.buckets)
+}
+
+func (l *Limiter) durationFor(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// evictIdle drops buckets not touched for idleTTL, starting from the least recently used one
+func (l *Limiter) evictIdle(now time.Time) {
+	if l.idleTTL <= 0 {
+		return
+	}
+	for element := l.lru.Back(); element != nil; element = l.lru.Back() {
+		if now.Sub(element.Value.(*bucket).last) < l.idleTTL {
+			return
+		}
+		l.removeElement(element)
+	}
+}
+
+func (l *Limiter) removeElement(element *list.Element) {
+	l.lru.Remove(element)
+	delete(l.buckets, element.Value.(*bucket).key)
+}
@@ -0,0 +1,62 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestLimiter(rate float64, burst int, maxBuckets int, idleTTL time.Duration) (*Limiter, *time.Time) {
+	now := time.Date(2022, 8, 1, 0, 0, 0, 0, time.UTC)
+	l := NewLimiter(rate, burst, maxBuckets, idleTTL)
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestAllowBurstThenRefill(t *testing.T) {
+	l, now := newTestLimiter(1, 2, 10, time.Minute)
+
+	assert.True(t, l.Allow("a").Allowed)
+	r := l.Allow("a")
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 0, r.Remaining)
+	assert.Equal(t, 2, r.Limit)
+
+	r = l.Allow("a")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+
+	assert.True(t, l.Allow("b").Allowed)
+
+	*now = now.Add(time.Second)
+	assert.True(t, l.Allow("a").Allowed)
+	assert.False(t, l.Allow("a").Allowed)
+}
+
+func TestBucketsAreBounded(t *testing.T) {
+	l, _ := newTestLimiter(1, 1, 2, time.Minute)
+
+	l.Allow("a")
+	l.Allow("b")
+	l.Allow("a")
+	l.Allow("c")
+
+	assert.Equal(t, 2, l.Len())
+	assert.True(t, l.Allow("b").Allowed, "least recently used bucket should have been evicted")
+}
+
+func TestIdleBucketsAreEvicted(t *testing.T) {
+	l, now := newTestLimiter(1, 1, 10, time.Minute)
+
+	l.Allow("a")
+	l.Allow("b")
+	*now = now.Add(2 * time.Minute)
+	l.Allow("c")
+
+	assert.Equal(t, 1, l.Len())
+}
+
+func TestDisabledLimiter(t *testing.T) {
+	assert.Nil(t, NewLimiter(0, 10, 10, time.Minute))
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const maxAliasLength = 64
+
+var (
+	ErrInvalidAlias = errors.New("invalid alias")
+	ErrInvalidURL   = errors.New("invalid URL")
+)
+
+// reservedAliases would be shadowed by the routes of the API
+var reservedAliases = map[string]bool{"api": true, "healthz": true, "readyz": true}
+
+// ValidateAlias checks that a custom ID can be used in short URLs as is
+func ValidateAlias(alias string) error {
+	if alias == "" || len(alias) > maxAliasLength {
+		return fmt.Errorf("%w %q: length must be from 1 to %d", ErrInvalidAlias, alias, maxAliasLength)
+	}
+	for _, c := range alias {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return fmt.Errorf("%w %q: only letters, digits, `-` and `_` are allowed", ErrInvalidAlias, alias)
+		}
+	}
+	if reservedAliases[alias] {
+		return fmt.Errorf("%w %q: reserved", ErrInvalidAlias, alias)
+	}
+	return nil
+}
+
+// ValidateURL checks that a URL can be redirected to
+func ValidateURL(originalURL string) error {
+	if !redirectable(originalURL) {
+		return fmt.Errorf("%w %q: must be an absolute URL of http or https", ErrInvalidURL, originalURL)
+	}
+	return nil
+}
+
+// redirectable tells whether visitors can be sent to the URL; schemes like javascript: and data: are refused,
+// so that short links cannot run scripts in the browsers of their visitors
+func redirectable(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// PutAlias shortens the URL of the link under the alias if it is free, otherwise under a generated ID like Put;
+// it tells whether the alias is kept
+func (s *ShorteningService) PutAlias(ctx context.Context, link storage.Link, alias string) (string, bool, error) {
+	if err := ValidateAlias(alias); err != nil {
+		return "", false, err
+	}
+	aliased := link
+	aliased.ID = alias
+	aliased.CreatedAt = time.Now().UTC()
+	id, ok := s.putIfAbsent(ctx, aliased)
+	if !ok {
+		generated, err := s.Put(ctx, link)
+		return generated, false, err
+	}
+	if id == "" {
+		return "", false, notStored(ctx)
+	}
+	logger.Debug(ctx, "service: put original URL under alias", "id", aliased.ID, "domain", aliased.Domain)
+	s.publish(ctx, events.New(events.LinkCreated, aliased))
+	return alias, true, nil
+}
+
+// Import shortens the URL of the link under the alias when it is given and free, otherwise under a generated ID;
+// it tells whether the alias is kept
+func (s *ShorteningService) Import(ctx context.Context, link storage.Link, alias string) (string, bool, error) {
+	if err := ValidateURL(link.URL); err != nil {
+		return "", false, err
+	}
+	if alias == "" {
+		id, err := s.Put(ctx, link)
+		return id, false, err
+	}
+	return s.PutAlias(ctx, link, alias)
+}
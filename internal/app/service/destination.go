@@ -0,0 +1,127 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+var ErrInvalidPassthrough = errors.New("invalid passthrough")
+
+// ValidatePassQuery checks a query passthrough policy, the empty one disables passthrough
+func ValidatePassQuery(policy string) error {
+	switch policy {
+	case "", storage.PassQueryLink, storage.PassQueryRequest, storage.PassQueryAppend:
+		return nil
+	}
+	return fmt.Errorf("%w: unknown query policy %q", ErrInvalidPassthrough, policy)
+}
+
+// Destination returns the URL to redirect the visit to: the destination of the first matching rule, of the variant
+// of the visitor or the original URL of the link, extended with the escaped path suffix following the ID
+// and with the request query as allowed by the link options
+func Destination(link storage.Link, visit Visit) (string, error) {
+	base, _ := target(link, visit)
+	passPath := link.Options.PassPath && visit.PathSuffix != ""
+	passQuery := link.Options.PassQuery != "" && visit.RawQuery != ""
+	if !passPath && !passQuery {
+		return base, nil
+	}
+
+	destination, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidPassthrough, err)
+	}
+	if passPath {
+		if err := appendPath(destination, visit.PathSuffix); err != nil {
+			return "", err
+		}
+	}
+	if passQuery {
+		destination.RawQuery = mergeQuery(destination.RawQuery, visit.RawQuery, link.Options.PassQuery)
+	}
+	return destination.String(), nil
+}
+
+// appendPath joins the suffix to the destination path keeping its escaping,
+// dot segments are rejected so that the suffix cannot climb above the destination path
+func appendPath(destination *url.URL, escapedSuffix string) error {
+	for _, segment := range strings.Split(escapedSuffix, "/") {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPassthrough, err)
+		}
+		if unescaped == "." || unescaped == ".." {
+			return fmt.Errorf("%w: dot segments are not allowed", ErrInvalidPassthrough)
+		}
+	}
+
+	escapedPath := strings.TrimRight(destination.EscapedPath(), "/") + "/" + escapedSuffix
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPassthrough, err)
+	}
+	destination.Path = path
+	destination.RawPath = escapedPath
+	return nil
+}
+
+// mergeQuery merges the raw queries parameter by parameter as the policy says, keeping their order and escaping
+func mergeQuery(stored, incoming string, policy string) string {
+	storedParams, incomingParams := splitQuery(stored), splitQuery(incoming)
+	var merged []string
+	switch policy {
+	case storage.PassQueryLink:
+		merged = storedParams
+		keys := queryKeys(storedParams)
+		for _, param := range incomingParams {
+			if !keys[queryKey(param)] {
+				merged = append(merged, param)
+			}
+		}
+	case storage.PassQueryRequest:
+		keys := queryKeys(incomingParams)
+		for _, param := range storedParams {
+			if !keys[queryKey(param)] {
+				merged = append(merged, param)
+			}
+		}
+		merged = append(merged, incomingParams...)
+	case storage.PassQueryAppend:
+		merged = append(storedParams, incomingParams...)
+	}
+	return strings.Join(merged, "&")
+}
+
+func splitQuery(rawQuery string) []string {
+	var params []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param != "" {
+			params = append(params, param)
+		}
+	}
+	return params
+}
+
+// queryKey is the unescaped name of the raw parameter, so that `a%20b=1` and `a+b=2` are the same parameter
+func queryKey(param string) string {
+	key := param
+	if i := strings.IndexByte(param, '='); i >= 0 {
+		key = param[:i]
+	}
+	if unescaped, err := url.QueryUnescape(key); err == nil {
+		return unescaped
+	}
+	return key
+}
+
+func queryKeys(params []string) map[string]bool {
+	keys := make(map[string]bool, len(params))
+	for _, param := range params {
+		keys[queryKey(param)] = true
+	}
+	return keys
+}
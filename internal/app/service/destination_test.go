@@ -0,0 +1,46 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+func TestDestination(t *testing.T) {
+	link := func(rawURL string, options storage.LinkOptions) storage.Link {
+		return storage.Link{URL: rawURL, Options: options}
+	}
+	query := "utm_source=x&page=2"
+
+	tests := []struct {
+		name   string
+		link   storage.Link
+		suffix string
+		query  string
+		want   string
+	}{
+		{"no passthrough", link("https://ya.ru/?page=1", storage.LinkOptions{}), "docs", query, "https://ya.ru/?page=1"},
+		{"link wins", link("https://ya.ru/?page=1", storage.LinkOptions{PassQuery: storage.PassQueryLink}), "", query, "https://ya.ru/?page=1&utm_source=x"},
+		{"request wins", link("https://ya.ru/?page=1", storage.LinkOptions{PassQuery: storage.PassQueryRequest}), "", query, "https://ya.ru/?utm_source=x&page=2"},
+		{"append", link("https://ya.ru/?page=1", storage.LinkOptions{PassQuery: storage.PassQueryAppend}), "", query, "https://ya.ru/?page=1&utm_source=x&page=2"},
+		{"path", link("https://docs.example/base?v=1", storage.LinkOptions{PassPath: true}), "guide/page", "", "https://docs.example/base/guide/page?v=1"},
+		{"path with trailing slash", link("https://docs.example/base/", storage.LinkOptions{PassPath: true}), "a%20b/c%2Fd", "", "https://docs.example/base/a%20b/c%2Fd"},
+		{"path and query", link("https://docs.example", storage.LinkOptions{PassPath: true, PassQuery: storage.PassQueryLink}), "x", "q=a%20b", "https://docs.example/x?q=a%20b"},
+		{"flags and escaping are kept", link("https://ya.ru/?b=1&a=%2F", storage.LinkOptions{PassQuery: storage.PassQueryRequest}), "", "flag&a+b=2&b=3", "https://ya.ru/?a=%2F&flag&a+b=2&b=3"},
+		{"escaped names are the same parameter", link("https://ya.ru/?a%20b=1", storage.LinkOptions{PassQuery: storage.PassQueryLink}), "", "a+b=2&c=3", "https://ya.ru/?a%20b=1&c=3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Destination(tt.link, Visit{PathSuffix: tt.suffix, RawQuery: tt.query})
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := Destination(link("https://docs.example/base", storage.LinkOptions{PassPath: true}), Visit{PathSuffix: "a/%2E%2E/b"})
+	assert.True(t, errors.Is(err, ErrInvalidPassthrough))
+	assert.Error(t, ValidatePassQuery("merge"))
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const maxRules = 50
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+var platforms = []string{"ios", "android", "windows", "macos", "linux", "other"}
+
+// Visit is what a redirect depends on besides the link itself
+type Visit struct {
+	Header     http.Header
+	Time       time.Time
+	PathSuffix string
+	// RawQuery is the query of the request as it is received
+	RawQuery string
+	// Visitor identifies the visitor, so that it sticks to the same variant of a split link
+	Visitor string
+}
+
+// ValidateRules checks that rules can be evaluated, so that broken ones are not stored
+func ValidateRules(rules []storage.Rule) error {
+	if len(rules) > maxRules {
+		return fmt.Errorf("%w: a link can have at most %d rules", ErrInvalidRule, maxRules)
+	}
+	for i, rule := range rules {
+		if !redirectable(rule.Destination) {
+			return fmt.Errorf("%w %d: destination must be an absolute URL of http or https", ErrInvalidRule, i)
+		}
+		for _, platform := range rule.Platforms {
+			if !containsFold(platforms, platform) {
+				return fmt.Errorf("%w %d: unknown platform %q, expected one of %s", ErrInvalidRule, i, platform, strings.Join(platforms, ", "))
+			}
+		}
+		for _, language := range rule.Languages {
+			if language == "" || strings.ContainsAny(language, " ,;") {
+				return fmt.Errorf("%w %d: invalid language %q", ErrInvalidRule, i, language)
+			}
+		}
+		if rule.After != nil && rule.Before != nil && !rule.After.Before(*rule.Before) {
+			return fmt.Errorf("%w %d: time window is empty", ErrInvalidRule, i)
+		}
+		for name := range rule.Headers {
+			if name == "" {
+				return fmt.Errorf("%w %d: header name is empty", ErrInvalidRule, i)
+			}
+		}
+	}
+	return nil
+}
+
+// matchRule returns the destination of the first rule matching the visit
+func matchRule(rules []storage.Rule, visit Visit) (string, bool) {
+	if len(rules) == 0 {
+		return "", false
+	}
+	platform := detectPlatform(visit.Header.Get("User-Agent"))
+	languages := acceptedLanguages(visit.Header.Get("Accept-Language"))
+	for _, rule := range rules {
+		if len(rule.Platforms) > 0 && !containsFold(rule.Platforms, platform) {
+			continue
+		}
+		if len(rule.Languages) > 0 && !matchLanguages(rule.Languages, languages) {
+			continue
+		}
+		if rule.After != nil && visit.Time.Before(*rule.After) {
+			continue
+		}
+		if rule.Before != nil && !visit.Time.Before(*rule.Before) {
+			continue
+		}
+		if !matchHeaders(rule.Headers, visit.Header) {
+			continue
+		}
+		return rule.Destination, true
+	}
+	return "", false
+}
+
+func detectPlatform(userAgent string) string {
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"), strings.Contains(userAgent, "iPod"):
+		return "ios"
+	case strings.Contains(userAgent, "Android"):
+		return "android"
+	case strings.Contains(userAgent, "Windows"):
+		return "windows"
+	case strings.Contains(userAgent, "Macintosh"), strings.Contains(userAgent, "Mac OS X"):
+		return "macos"
+	case strings.Contains(userAgent, "Linux"), strings.Contains(userAgent, "X11"):
+		return "linux"
+	}
+	return "other"
+}
+
+// acceptedLanguages returns the lowercased language tags of the Accept-Language header which are not refused with q=0,
+// most preferred first
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	result := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		result = append(result, tag.tag)
+	}
+	return result
+}
+
+func matchLanguages(wanted []string, accepted []string) bool {
+	for _, language := range wanted {
+		language = strings.ToLower(language)
+		for _, tag := range accepted {
+			if tag == language || strings.HasPrefix(tag, language+"-") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchHeaders(wanted map[string]string, header http.Header) bool {
+	for name, value := range wanted {
+		actual := header.Values(name)
+		if len(actual) == 0 {
+			return false
+		}
+		if value != "*" && !containsFold(actual, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
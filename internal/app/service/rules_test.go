@@ -0,0 +1,78 @@
+package service
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const (
+	iPhoneUserAgent  = "Mozilla/5.0 (iPhone; CPU iPhone OS 16_0 like Mac OS X) AppleWebKit/605.1.15 Mobile/15E148"
+	androidUserAgent = "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 Chrome/116.0 Mobile Safari/537.36"
+	desktopUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 Chrome/116.0 Safari/537.36"
+)
+
+func TestRulesByPlatform(t *testing.T) {
+	link := storage.Link{URL: "https://example.com", Rules: []storage.Rule{
+		{Destination: "https://apps.apple.com/app", Platforms: []string{"ios"}},
+		{Destination: "https://play.google.com/app", Platforms: []string{"android"}},
+	}}
+
+	for userAgent, want := range map[string]string{
+		iPhoneUserAgent:  "https://apps.apple.com/app",
+		androidUserAgent: "https://play.google.com/app",
+		desktopUserAgent: "https://example.com",
+	} {
+		got, err := Destination(link, Visit{Header: http.Header{"User-Agent": {userAgent}}})
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, userAgent)
+	}
+}
+
+func TestRulesByLanguageTimeAndHeaders(t *testing.T) {
+	start := time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	link := storage.Link{URL: "https://example.com", Rules: []storage.Rule{
+		{Destination: "https://beta.example.com", Headers: map[string]string{"X-Beta": "yes"}},
+		{Destination: "https://example.de/sale", Languages: []string{"de"}, After: &start, Before: &end},
+		{Destination: "https://example.de", Languages: []string{"de"}},
+	}}
+	visit := func(acceptLanguage string, at time.Time, extra ...string) Visit {
+		header := http.Header{"Accept-Language": {acceptLanguage}}
+		if len(extra) == 2 {
+			header.Set(extra[0], extra[1])
+		}
+		return Visit{Header: header, Time: at}
+	}
+
+	got, _ := Destination(link, visit("de-AT,de;q=0.9,en;q=0.5", start.Add(time.Hour)))
+	assert.Equal(t, "https://example.de/sale", got)
+	got, _ = Destination(link, visit("de-AT", end))
+	assert.Equal(t, "https://example.de", got, "the window excludes its end")
+	got, _ = Destination(link, visit("en-US, de;q=0", start))
+	assert.Equal(t, "https://example.com", got, "q=0 refuses the language")
+	got, _ = Destination(link, visit("en", start, "X-Beta", "YES"))
+	assert.Equal(t, "https://beta.example.com", got)
+}
+
+func TestValidateRules(t *testing.T) {
+	start := time.Now()
+	assert.NoError(t, ValidateRules([]storage.Rule{{Destination: "https://ya.ru", Platforms: []string{"iOS"}}}))
+	for _, rule := range []storage.Rule{
+		{Destination: "ya.ru"},
+		{Destination: "javascript:alert(1)"},
+		{Destination: "data:text/html,<script>alert(1)</script>"},
+		{Destination: "https:///path"},
+		{Destination: "ftp://ya.ru"},
+		{Destination: "https://ya.ru", Platforms: []string{"symbian"}},
+		{Destination: "https://ya.ru", Languages: []string{"de, en"}},
+		{Destination: "https://ya.ru", After: &start, Before: &start},
+	} {
+		assert.True(t, errors.Is(ValidateRules([]storage.Rule{rule}), ErrInvalidRule), rule)
+	}
+}
@@ -1,36 +1,233 @@
 package service
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/tsupko/shortener/internal/app/bloom"
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
 	"github.com/tsupko/shortener/internal/app/storage"
 	"github.com/tsupko/shortener/internal/app/util"
 )
 
+var (
+	ErrNotFound = errors.New("link is not found")
+	// ErrNotStored is returned when the storage could not take a link, e.g. as the request ended
+	// before the storage was loaded; it is worth retrying
+	ErrNotStored = errors.New("link is not stored")
+)
+
 type ShorteningService struct {
-	storage storage.Storage
+	storage   storage.Storage
+	publisher events.Publisher
+	// filter rules out unknown keys once filled is set, i.e. it holds all the keys of the storage
+	filter *bloom.Filter
+	filled int32
+}
+
+// Option customizes the service built by NewShorteningService
+type Option func(*ShorteningService)
+
+// WithPublisher makes the service publish the events of links
+func WithPublisher(publisher events.Publisher) Option {
+	return func(s *ShorteningService) {
+		s.publisher = publisher
+	}
+}
+
+// WithBloomFilter spares the storage lookups of keys the filter rules out. The filter is filled with the keys
+// of the storage in the background, if the storage can list them, and consulted once it is filled.
+// Links created by other instances sharing the storage are unknown to the filter, so it is not meant for them
+func WithBloomFilter(filter *bloom.Filter) Option {
+	return func(s *ShorteningService) {
+		s.filter = filter
+	}
+}
+
+func NewShorteningService(storage storage.Storage, opts ...Option) *ShorteningService {
+	s := &ShorteningService{storage: storage}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.filter != nil {
+		go s.fillFilter(context.Background())
+	}
+	if s.publisher != nil {
+		s.publishExpirations()
+	}
+	return s
+}
+
+// publishExpirations publishes the links expiring in storages bounded by a TTL
+func (s *ShorteningService) publishExpirations() {
+	if expirer, ok := s.storage.(storage.Expirer); ok {
+		expirer.OnExpire(func(link storage.Link) {
+			s.publish(context.Background(), events.New(events.LinkExpired, link))
+		})
+	}
+}
+
+func (s *ShorteningService) fillFilter(ctx context.Context) {
+	walker, ok := s.storage.(storage.KeyWalker)
+	if !ok {
+		logger.Warn(ctx, "the Bloom filter is disabled, as the storage cannot list its keys")
+		return
+	}
+	start := time.Now()
+	// links put meanwhile are added by Put too
+	if err := walker.WalkKeys(ctx, s.filter.Add); err != nil {
+		logger.Warn(ctx, "the Bloom filter is disabled", "error", err)
+		return
+	}
+	atomic.StoreInt32(&s.filled, 1)
+	logger.Info(ctx, "the Bloom filter is filled", "keys", s.filter.Count(), "duration", time.Since(start))
+}
+
+// ruledOut tells that the storage has no link under the key, without looking it up
+func (s *ShorteningService) ruledOut(key string) bool {
+	return s.filter != nil && atomic.LoadInt32(&s.filled) != 0 && !s.filter.MayContain(key)
+}
+
+// put stores the link, adding its key to the filter first so that it is never ruled out
+func (s *ShorteningService) put(ctx context.Context, link storage.Link) string {
+	if s.filter != nil {
+		s.filter.Add(link.Key())
+	}
+	return s.storage.Put(ctx, link)
 }
 
-func NewShorteningService(storage storage.Storage) *ShorteningService {
-	return &ShorteningService{storage: storage}
+// putIfAbsent stores the link unless its key is taken, adding the key to the filter first like put
+func (s *ShorteningService) putIfAbsent(ctx context.Context, link storage.Link) (string, bool) {
+	if s.filter != nil {
+		s.filter.Add(link.Key())
+	}
+	return storage.PutIfAbsent(ctx, s.storage, link)
+}
+
+// Put shortens the URL of the link on behalf of its user under its domain, which is empty for the primary one;
+// the ID and the creation time are assigned here. It fails with ErrNotStored if the storage does not take the link
+func (s *ShorteningService) Put(ctx context.Context, link storage.Link) (string, error) {
+	link.CreatedAt = time.Now().UTC()
+	id, ok := "", false
+	// IDs are claimed rather than looked up, so that the IDs of links evicted by bounded storages are not reissued
+	for !ok {
+		if ctx.Err() != nil {
+			return "", notStored(ctx)
+		}
+		link.ID = util.GenerateUniqueID()
+		if s.ruledOut(link.Key()) {
+			id, ok = s.put(ctx, link), true
+		} else {
+			id, ok = s.putIfAbsent(ctx, link)
+		}
+	}
+	if id == "" {
+		return "", notStored(ctx)
+	}
+	logger.Debug(ctx, "service: put original URL", "id", link.ID, "domain", link.Domain)
+	s.publish(ctx, events.New(events.LinkCreated, link))
+	return id, nil
+}
+
+// notStored tells why the storage did not take a link; storages give up on links once the context is done
+func notStored(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotStored, err)
+	}
+	return ErrNotStored
+}
+
+// Get resolves the shortening identifier of the domain for a redirect and counts the click,
+// attributing it to the variant the visit is served by
+func (s *ShorteningService) Get(ctx context.Context, domain string, shorteningIdentifier string, visit Visit) (storage.Link, bool) {
+	key := storage.Key(domain, shorteningIdentifier)
+	if s.ruledOut(key) {
+		logger.Debug(ctx, "service: ruled out by the Bloom filter", "id", shorteningIdentifier, "domain", domain)
+		return storage.Link{}, false
+	}
+	link, ok := s.storage.Get(ctx, key)
+	logger.Debug(ctx, "service: got original URL", "id", shorteningIdentifier, "domain", domain, "found", ok)
+	if ok && !link.Deleted {
+		_, variant := target(link, visit)
+		s.storage.AddClick(ctx, key, variant)
+		event := events.New(events.LinkClicked, link)
+		if variant != storage.NoVariant {
+			event.Link.Variant = &variant
+		}
+		s.publish(ctx, event)
+	}
+	return link, ok
+}
+
+// Preview resolves the shortening identifier of the domain without counting a click
+func (s *ShorteningService) Preview(ctx context.Context, domain string, shorteningIdentifier string) (storage.Link, bool) {
+	return s.storage.Get(ctx, storage.Key(domain, shorteningIdentifier))
+}
+
+// GetUserLinks returns the links created by the user which are not deleted
+func (s *ShorteningService) GetUserLinks(ctx context.Context, userID string) []storage.Link {
+	return s.storage.GetByUser(ctx, userID)
 }
 
-func (s *ShorteningService) Put(originalURL string) string {
-	shorteningIdentifier := s.generateShorteningIdentifier()
-	log.Printf("storage: put original URL %s identified by its shortening ID %s\n", originalURL, shorteningIdentifier)
-	return s.storage.Put(shorteningIdentifier, originalURL)
+// Stats returns the link with its click counter if the user owns it
+func (s *ShorteningService) Stats(ctx context.Context, userID string, domain string, shorteningIdentifier string) (storage.Link, bool) {
+	link, ok := s.storage.Get(ctx, storage.Key(domain, shorteningIdentifier))
+	if !ok || link.Deleted || link.UserID != userID {
+		return storage.Link{}, false
+	}
+	return link, true
 }
 
-func (s *ShorteningService) Get(shorteningIdentifier string) string {
-	originalURL, _ := s.storage.Get(shorteningIdentifier)
-	log.Printf("storage: got original URL %s identified by its shortening ID %s\n", originalURL, shorteningIdentifier)
-	return originalURL
+// Totals returns the number of links which are not deleted and of the users owning them
+func (s *ShorteningService) Totals(ctx context.Context) (links int, users int) {
+	return s.storage.CountLinks(ctx), s.storage.CountUsers(ctx)
+}
+
+// SetRules replaces the redirect rules of a link owned by the user
+func (s *ShorteningService) SetRules(ctx context.Context, userID string, domain string, shorteningIdentifier string, rules []storage.Rule) error {
+	if err := ValidateRules(rules); err != nil {
+		return err
+	}
+	link, ok := s.Stats(ctx, userID, domain, shorteningIdentifier)
+	if !ok {
+		return ErrNotFound
+	}
+	link.Rules = rules
+	if s.storage.Put(ctx, link) == "" {
+		return notStored(ctx)
+	}
+	logger.Debug(ctx, "service: set redirect rules", "id", shorteningIdentifier, "domain", domain, "count", len(rules))
+	s.publish(ctx, events.New(events.LinkUpdated, link))
+	return nil
+}
+
+// Delete marks the links of the domain as deleted; links owned by other users are left untouched
+func (s *ShorteningService) Delete(ctx context.Context, userID string, domain string, shorteningIdentifiers []string) {
+	logger.Debug(ctx, "service: delete links", "count", len(shorteningIdentifiers), "domain", domain)
+	keys := make([]string, 0, len(shorteningIdentifiers))
+	var deleted []storage.Link
+	for _, id := range shorteningIdentifiers {
+		key := storage.Key(domain, id)
+		keys = append(keys, key)
+		if s.publisher == nil {
+			continue
+		}
+		if link, ok := s.storage.Get(ctx, key); ok && link.UserID == userID && !link.Deleted {
+			deleted = append(deleted, link)
+		}
+	}
+	s.storage.Delete(ctx, userID, keys)
+	for _, link := range deleted {
+		s.publish(ctx, events.New(events.LinkDeleted, link))
+	}
 }
 
-func (s *ShorteningService) generateShorteningIdentifier() string {
-	id := util.GenerateUniqueID()
-	if _, ok := s.storage.Get(id); !ok {
-		return id
+func (s *ShorteningService) publish(ctx context.Context, event events.Event) {
+	if s.publisher != nil {
+		s.publisher.Publish(ctx, event)
 	}
-	return s.generateShorteningIdentifier()
 }
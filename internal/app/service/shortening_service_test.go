@@ -1,10 +1,19 @@
 package service
 
 import (
+	"context"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
+	"github.com/tsupko/shortener/internal/app/bloom"
+	"github.com/tsupko/shortener/internal/app/events"
 	"github.com/tsupko/shortener/internal/app/storage"
 	"github.com/tsupko/shortener/internal/app/storage/mocks"
 )
@@ -12,15 +21,236 @@ import (
 func TestShorteningServicePutGet(t *testing.T) {
 	s := NewShorteningService(storage.NewMemoryStorage())
 
-	id := s.Put("https://ya.ru")
+	id, _ := s.Put(context.Background(), storage.Link{UserID: "user", URL: "https://ya.ru"})
 	assert.Len(t, id, 8)
-	url := s.Get(id)
-	assert.Equal(t, "https://ya.ru", url)
-	assert.Equal(t, "", s.Get("idDoesNotExist"))
+	link, ok := s.Get(context.Background(), "", id, Visit{})
+	assert.True(t, ok)
+	assert.Equal(t, "https://ya.ru", link.URL)
+	link, ok = s.Get(context.Background(), "", "idDoesNotExist", Visit{})
+	assert.False(t, ok)
+	assert.Equal(t, "", link.URL)
 }
 
 func TestShorteningServiceDuplicateID(t *testing.T) {
 	s := NewShorteningService(&mocks.MockStorage{})
-	id := s.Put("https://ya.ru")
+	id, _ := s.Put(context.Background(), storage.Link{UserID: "user", URL: "https://ya.ru"})
 	assert.Len(t, id, 8)
 }
+
+func TestShorteningServicePutFailsOnceContextIsDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := NewShorteningService(storage.NewMemoryStorage())
+
+	id, err := s.Put(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"})
+	assert.ErrorIs(t, err, ErrNotStored)
+	assert.Empty(t, id)
+	assert.Zero(t, s.storage.CountLinks(context.Background()))
+}
+
+func TestShorteningServiceUserLinks(t *testing.T) {
+	ctx := context.Background()
+	s := NewShorteningService(storage.NewMemoryStorage())
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"})
+	other, _ := s.Put(ctx, storage.Link{UserID: "another user", URL: "https://go.dev"})
+	s.Get(ctx, "", id, Visit{})
+	s.Get(ctx, "", id, Visit{})
+
+	links := s.GetUserLinks(ctx, "user")
+	assert.Len(t, links, 1)
+	link, ok := s.Stats(ctx, "user", "", id)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), link.Clicks)
+	_, ok = s.Stats(ctx, "user", "", other)
+	assert.False(t, ok)
+
+	s.Delete(ctx, "user", "", []string{id, other})
+	assert.Empty(t, s.GetUserLinks(ctx, "user"))
+	assert.Len(t, s.GetUserLinks(ctx, "another user"), 1)
+	link, _ = s.Get(ctx, "", id, Visit{})
+	assert.True(t, link.Deleted)
+}
+
+func TestShorteningServiceDomainsAreNamespaced(t *testing.T) {
+	ctx := context.Background()
+	s := NewShorteningService(storage.NewMemoryStorage())
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", Domain: "a.example", URL: "https://ya.ru"})
+	link, ok := s.Get(ctx, "a.example", id, Visit{})
+	assert.True(t, ok)
+	assert.Equal(t, "a.example", link.Domain)
+	_, ok = s.Get(ctx, "b.example", id, Visit{})
+	assert.False(t, ok)
+	_, ok = s.Get(ctx, "", id, Visit{})
+	assert.False(t, ok)
+}
+
+func TestShorteningServiceSetRules(t *testing.T) {
+	ctx := context.Background()
+	s := NewShorteningService(storage.NewMemoryStorage())
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"})
+	rules := []storage.Rule{{Destination: "https://m.ya.ru", Platforms: []string{"android"}}}
+
+	assert.ErrorIs(t, s.SetRules(ctx, "another user", "", id, rules), ErrNotFound)
+	assert.ErrorIs(t, s.SetRules(ctx, "user", "", id, []storage.Rule{{Destination: "relative"}}), ErrInvalidRule)
+	assert.NoError(t, s.SetRules(ctx, "user", "", id, rules))
+
+	link, _ := s.Stats(ctx, "user", "", id)
+	assert.Equal(t, rules, link.Rules)
+}
+
+type recordingPublisher struct {
+	events []events.Event
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, event events.Event) {
+	p.events = append(p.events, event)
+}
+
+func TestShorteningServicePublishesEvents(t *testing.T) {
+	ctx := context.Background()
+	publisher := &recordingPublisher{}
+	s := NewShorteningService(storage.NewMemoryStorage(), WithPublisher(publisher))
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"})
+	s.Get(ctx, "", id, Visit{})
+	assert.NoError(t, s.SetRules(ctx, "user", "", id, nil))
+	s.Delete(ctx, "another user", "", []string{id})
+	s.Delete(ctx, "user", "", []string{id})
+	s.Get(ctx, "", id, Visit{})
+
+	var types []events.Type
+	for _, event := range publisher.events {
+		types = append(types, event.Type)
+		assert.Equal(t, id, event.Link.ID)
+		assert.NotEmpty(t, event.ID)
+	}
+	assert.Equal(t, []events.Type{events.LinkCreated, events.LinkClicked, events.LinkUpdated, events.LinkDeleted}, types)
+}
+
+func TestShorteningServicePublishesExpirations(t *testing.T) {
+	ctx := context.Background()
+	publisher := &recordingPublisher{}
+	s := NewShorteningService(storage.NewMemoryStorage(storage.WithTTL(time.Millisecond)), WithPublisher(publisher))
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"})
+	time.Sleep(10 * time.Millisecond)
+	_, ok := s.Get(ctx, "", id, Visit{})
+	assert.False(t, ok)
+
+	require.Len(t, publisher.events, 2)
+	assert.Equal(t, events.LinkExpired, publisher.events[1].Type)
+	assert.Equal(t, id, publisher.events[1].Link.ID)
+}
+
+func TestShorteningServicePutAlias(t *testing.T) {
+	ctx := context.Background()
+	s := NewShorteningService(storage.NewMemoryStorage())
+
+	id, kept, err := s.PutAlias(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"}, "docs")
+	assert.NoError(t, err)
+	assert.True(t, kept)
+	assert.Equal(t, "docs", id)
+
+	id, kept, err = s.PutAlias(ctx, storage.Link{UserID: "user", URL: "https://go.dev"}, "docs")
+	assert.NoError(t, err)
+	assert.False(t, kept)
+	assert.Len(t, id, 8)
+	link, _ := s.Get(ctx, "", "docs", Visit{})
+	assert.Equal(t, "https://ya.ru", link.URL)
+
+	_, kept, err = s.PutAlias(ctx, storage.Link{UserID: "user", Domain: "a.example", URL: "https://go.dev"}, "docs")
+	assert.NoError(t, err)
+	assert.True(t, kept, "aliases are namespaced by domain")
+
+	for _, alias := range []string{"api", "with space", "slash/ed", strings.Repeat("a", 65)} {
+		_, _, err = s.PutAlias(ctx, storage.Link{URL: "https://go.dev"}, alias)
+		assert.ErrorIs(t, err, ErrInvalidAlias, alias)
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	assert.NoError(t, ValidateURL("https://ya.ru/path?q=1"))
+	assert.NoError(t, ValidateURL("http://localhost:8080"))
+	for _, rawURL := range []string{"ya.ru", "/relative", "javascript:alert(1)", "data:text/html,hi", "https:///path", "ftp://ya.ru"} {
+		assert.ErrorIs(t, ValidateURL(rawURL), ErrInvalidURL, rawURL)
+	}
+}
+
+func TestShorteningServicePutAliasConcurrently(t *testing.T) {
+	ctx := context.Background()
+	fileStorage := storage.NewFileStorage(filepath.Join(t.TempDir(), "links.log"))
+	defer fileStorage.Close()
+	for name, store := range map[string]storage.Storage{
+		"memory": storage.NewMemoryStorage(),
+		"file":   fileStorage,
+		"cached": storage.NewCachedStorage(storage.NewMemoryStorage()),
+	} {
+		s := NewShorteningService(store)
+		var kept int32
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, ok, _ := s.PutAlias(ctx, storage.Link{UserID: "user", URL: "https://ya.ru"}, "docs"); ok {
+					atomic.AddInt32(&kept, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), kept, name)
+		assert.Equal(t, 20, s.storage.CountLinks(ctx), name)
+	}
+}
+
+// countingStorage counts lookups
+type countingStorage struct {
+	*storage.MemoryStorage
+	gets int32
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) (storage.Link, bool) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.MemoryStorage.Get(ctx, key)
+}
+
+// opaqueStorage cannot list its keys
+type opaqueStorage struct {
+	storage.Storage
+}
+
+func TestShorteningServiceBloomFilter(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{MemoryStorage: storage.NewMemoryStorage()}
+	backend.Put(ctx, storage.Link{ID: "known", URL: "https://ya.ru"})
+	s := NewShorteningService(backend, WithBloomFilter(bloom.New(100, 0.01)))
+	for atomic.LoadInt32(&s.filled) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	_, ok := s.Get(ctx, "", "unknown", Visit{})
+	assert.False(t, ok)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&backend.gets), "ruled out keys are not looked up")
+	_, ok = s.Get(ctx, "", "known", Visit{})
+	assert.True(t, ok)
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://go.dev"})
+	gets := atomic.LoadInt32(&backend.gets)
+	_, ok = s.Get(ctx, "", id, Visit{})
+	assert.True(t, ok, "put links are added to the filter")
+	assert.Equal(t, gets+1, atomic.LoadInt32(&backend.gets))
+}
+
+func TestShorteningServiceBloomFilterNeedsKeys(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{MemoryStorage: storage.NewMemoryStorage()}
+	backend.Put(ctx, storage.Link{ID: "known", URL: "https://ya.ru"})
+	s := NewShorteningService(opaqueStorage{backend}, WithBloomFilter(bloom.New(100, 0.01)))
+
+	link, ok := s.Get(ctx, "", "known", Visit{})
+	assert.True(t, ok, "the filter is not consulted unless it is filled")
+	assert.Equal(t, "https://ya.ru", link.URL)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.filled))
+}
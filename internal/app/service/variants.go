@@ -0,0 +1,74 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+const (
+	maxVariants = 20
+	// maxVariantWeight keeps the total weight of the variants far from overflowing
+	maxVariantWeight = 1000000
+)
+
+var ErrInvalidVariant = errors.New("invalid variant")
+
+// ValidateVariants checks that the weights of the variants can be split, so that broken ones are not stored
+func ValidateVariants(variants []storage.Variant) error {
+	if len(variants) > maxVariants {
+		return fmt.Errorf("%w: a link can have at most %d variants", ErrInvalidVariant, maxVariants)
+	}
+	total := 0
+	for i, variant := range variants {
+		if !redirectable(variant.Destination) {
+			return fmt.Errorf("%w %d: destination must be an absolute URL of http or https", ErrInvalidVariant, i)
+		}
+		if variant.Weight < 0 || variant.Weight > maxVariantWeight {
+			return fmt.Errorf("%w %d: weight must be from 0 to %d", ErrInvalidVariant, i, maxVariantWeight)
+		}
+		total += variant.Weight
+	}
+	if len(variants) > 0 && total == 0 {
+		return fmt.Errorf("%w: total weight must be positive", ErrInvalidVariant)
+	}
+	return nil
+}
+
+// pickVariant returns the index of the variant of the visitor. The pick is a hash of the link and the visitor,
+// so the visitor keeps getting the same variant as long as the variants of the link stay the same
+func pickVariant(link storage.Link, visitor string) int {
+	total := 0
+	for _, variant := range link.Variants {
+		total += variant.Weight
+	}
+	if total <= 0 {
+		return storage.NoVariant
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(link.Key()))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(visitor))
+	point := int(h.Sum64() % uint64(total))
+	for i, variant := range link.Variants {
+		if point < variant.Weight {
+			return i
+		}
+		point -= variant.Weight
+	}
+	return storage.NoVariant
+}
+
+// target returns where the visit goes before passthrough is applied together with the index of the variant serving it:
+// a matching rule wins over the variants, which win over the original URL
+func target(link storage.Link, visit Visit) (string, int) {
+	if destination, ok := matchRule(link.Rules, visit); ok {
+		return destination, storage.NoVariant
+	}
+	if variant := pickVariant(link, visit.Visitor); variant != storage.NoVariant {
+		return link.Variants[variant].Destination, variant
+	}
+	return link.URL, storage.NoVariant
+}
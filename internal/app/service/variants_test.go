@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+func TestVariantsAreSplitByWeight(t *testing.T) {
+	link := storage.Link{ID: "abc", URL: "https://example.com", Variants: []storage.Variant{
+		{Destination: "https://a.example.com", Weight: 70},
+		{Destination: "https://b.example.com", Weight: 30},
+	}}
+
+	served := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		destination, err := Destination(link, Visit{Visitor: fmt.Sprint("visitor", i)})
+		assert.NoError(t, err)
+		served[destination]++
+	}
+	assert.InDelta(t, 7000, served["https://a.example.com"], 300)
+	assert.InDelta(t, 3000, served["https://b.example.com"], 300)
+
+	first, _ := Destination(link, Visit{Visitor: "sticky"})
+	for i := 0; i < 10; i++ {
+		again, _ := Destination(link, Visit{Visitor: "sticky"})
+		assert.Equal(t, first, again)
+	}
+}
+
+func TestRulesWinOverVariants(t *testing.T) {
+	link := storage.Link{ID: "abc", URL: "https://example.com",
+		Rules:    []storage.Rule{{Destination: "https://apps.apple.com/app", Platforms: []string{"ios"}}},
+		Variants: []storage.Variant{{Destination: "https://a.example.com", Weight: 1}},
+	}
+
+	destination, variant := target(link, Visit{Header: http.Header{"User-Agent": {iPhoneUserAgent}}})
+	assert.Equal(t, "https://apps.apple.com/app", destination)
+	assert.Equal(t, storage.NoVariant, variant)
+	destination, variant = target(link, Visit{Header: http.Header{"User-Agent": {desktopUserAgent}}})
+	assert.Equal(t, "https://a.example.com", destination)
+	assert.Equal(t, 0, variant)
+}
+
+func TestValidateVariants(t *testing.T) {
+	assert.NoError(t, ValidateVariants(nil))
+	assert.NoError(t, ValidateVariants([]storage.Variant{{Destination: "https://a.example.com", Weight: 1}, {Destination: "https://b.example.com"}}))
+	for _, variants := range [][]storage.Variant{
+		{{Destination: "/relative", Weight: 1}},
+		{{Destination: "javascript:alert(1)", Weight: 1}},
+		{{Destination: "data:text/html,hi", Weight: 1}},
+		{{Destination: "https:///path", Weight: 1}},
+		{{Destination: "https://a.example.com", Weight: maxVariantWeight + 1}},
+		{{Destination: "https://a.example.com", Weight: math.MaxInt}, {Destination: "https://b.example.com", Weight: 1}},
+		{{Destination: "https://a.example.com", Weight: -1}, {Destination: "https://b.example.com", Weight: 2}},
+		{{Destination: "https://a.example.com"}},
+	} {
+		assert.True(t, errors.Is(ValidateVariants(variants), ErrInvalidVariant), variants)
+	}
+}
+
+func TestShorteningServiceCountsVariantClicks(t *testing.T) {
+	ctx := context.Background()
+	s := NewShorteningService(storage.NewMemoryStorage())
+
+	id, _ := s.Put(ctx, storage.Link{UserID: "user", URL: "https://example.com", Variants: []storage.Variant{
+		{Destination: "https://a.example.com", Weight: 1},
+		{Destination: "https://b.example.com", Weight: 1},
+	}})
+	for i := 0; i < 20; i++ {
+		s.Get(ctx, "", id, Visit{Visitor: fmt.Sprint("visitor", i)})
+	}
+
+	link, _ := s.Stats(ctx, "user", "", id)
+	assert.Equal(t, int64(20), link.Clicks)
+	assert.Equal(t, link.Clicks, link.Variants[0].Clicks+link.Variants[1].Clicks)
+	assert.NotZero(t, link.Variants[0].Clicks)
+	assert.NotZero(t, link.Variants[1].Clicks)
+}
@@ -0,0 +1,317 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultCacheSize        = 10000
+	DefaultCacheTTL         = time.Minute
+	DefaultCacheNegativeTTL = 5 * time.Second
+)
+
+// CachedStorage keeps the results of Get of another storage in a bounded LRU cache, misses included,
+// so that redirects of hot links do not reach slow backends. Concurrent lookups of a key missing
+// from the cache make a single call of the backend. Links changed through the cache are invalidated;
+// changes made by other instances sharing the backend are seen once the entries expire
+type CachedStorage struct {
+	backend     Storage
+	size        int
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mtx      sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*lookup
+
+	hits      uint64
+	misses    uint64
+	collapsed uint64
+	evictions uint64
+}
+
+var (
+	_ Storage       = &CachedStorage{}
+	_ Checker       = &CachedStorage{}
+	_ Loader        = &CachedStorage{}
+	_ StatsReporter = &CachedStorage{}
+	_ KeyWalker     = &CachedStorage{}
+	_ Expirer       = &CachedStorage{}
+	_ io.Closer     = &CachedStorage{}
+)
+
+// ErrCannotWalkKeys is returned by decorators of storages which cannot list their keys
+var ErrCannotWalkKeys = errors.New("storage cannot list its keys")
+
+type cacheEntry struct {
+	key       string
+	link      Link
+	found     bool
+	expiresAt time.Time
+}
+
+// lookup is a call of the backend which concurrent lookups of the same key wait for
+type lookup struct {
+	done  chan struct{}
+	link  Link
+	found bool
+	// stale is set when the link changes during the call, whose result is then not cached
+	stale bool
+}
+
+// CacheOption customizes the cache built by NewCachedStorage
+type CacheOption func(*CachedStorage)
+
+// WithCacheSize bounds the number of cached links and misses; DefaultCacheSize by default
+func WithCacheSize(size int) CacheOption {
+	return func(s *CachedStorage) {
+		s.size = size
+	}
+}
+
+// WithCacheTTL sets how long found links and misses are cached; DefaultCacheTTL and DefaultCacheNegativeTTL
+// by default. A zero negative TTL disables caching misses
+func WithCacheTTL(ttl, negativeTTL time.Duration) CacheOption {
+	return func(s *CachedStorage) {
+		s.ttl = ttl
+		s.negativeTTL = negativeTTL
+	}
+}
+
+func NewCachedStorage(backend Storage, opts ...CacheOption) *CachedStorage {
+	s := &CachedStorage{
+		backend:     backend,
+		size:        DefaultCacheSize,
+		ttl:         DefaultCacheTTL,
+		negativeTTL: DefaultCacheNegativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+		inflight:    make(map[string]*lookup),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.size < 1 {
+		s.size = 1
+	}
+	return s
+}
+
+func (s *CachedStorage) Get(ctx context.Context, key string) (Link, bool) {
+	s.mtx.Lock()
+	if element, ok := s.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if s.now().Before(entry.expiresAt) {
+			s.lru.MoveToFront(element)
+			s.mtx.Unlock()
+			atomic.AddUint64(&s.hits, 1)
+			return entry.link, entry.found
+		}
+		s.remove(element)
+	}
+	atomic.AddUint64(&s.misses, 1)
+	if l, ok := s.inflight[key]; ok {
+		s.mtx.Unlock()
+		atomic.AddUint64(&s.collapsed, 1)
+		select {
+		case <-l.done:
+			return l.link, l.found
+		case <-ctx.Done():
+			return Link{}, false
+		}
+	}
+	l := &lookup{done: make(chan struct{})}
+	s.inflight[key] = l
+	s.mtx.Unlock()
+
+	l.link, l.found = s.backend.Get(ctx, key)
+
+	s.mtx.Lock()
+	delete(s.inflight, key)
+	// lookups cut short by the context may have missed links which exist
+	if !l.stale && ctx.Err() == nil {
+		s.store(key, l.link, l.found)
+	}
+	s.mtx.Unlock()
+	close(l.done)
+	return l.link, l.found
+}
+
+func (s *CachedStorage) GetByUser(ctx context.Context, userID string) []Link {
+	return s.backend.GetByUser(ctx, userID)
+}
+
+func (s *CachedStorage) CountLinks(ctx context.Context) int {
+	return s.backend.CountLinks(ctx)
+}
+
+func (s *CachedStorage) CountUsers(ctx context.Context) int {
+	return s.backend.CountUsers(ctx)
+}
+
+func (s *CachedStorage) Put(ctx context.Context, link Link) string {
+	id := s.backend.Put(ctx, link)
+	s.invalidate(link.Key())
+	return id
+}
+
+func (s *CachedStorage) PutIfAbsent(ctx context.Context, link Link) bool {
+	if _, ok := PutIfAbsent(ctx, s.backend, link); !ok {
+		return false
+	}
+	s.invalidate(link.Key())
+	return true
+}
+
+func (s *CachedStorage) Delete(ctx context.Context, userID string, keys []string) {
+	s.backend.Delete(ctx, userID, keys)
+	s.invalidate(keys...)
+}
+
+// AddClick counts the click in the cached link too, as invalidating it would leave hot links uncached
+func (s *CachedStorage) AddClick(ctx context.Context, key string, variant int) {
+	s.backend.AddClick(ctx, key, variant)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if l, ok := s.inflight[key]; ok {
+		l.stale = true
+	}
+	element, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+	if !entry.found {
+		return
+	}
+	// the link is copied, as it may have been handed out already
+	link := entry.link
+	link.Clicks++
+	if variant >= 0 && variant < len(link.Variants) {
+		link.Variants = append([]Variant(nil), link.Variants...)
+		link.Variants[variant].Clicks++
+	}
+	entry.link = link
+}
+
+func (s *CachedStorage) invalidate(keys ...string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, key := range keys {
+		if element, ok := s.entries[key]; ok {
+			s.remove(element)
+		}
+		if l, ok := s.inflight[key]; ok {
+			l.stale = true
+		}
+	}
+}
+
+// store caches the result of a lookup, evicting the least recently used entries beyond the size
+func (s *CachedStorage) store(key string, link Link, found bool) {
+	ttl := s.ttl
+	if !found {
+		ttl = s.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&cacheEntry{key: key, link: link, found: found, expiresAt: s.now().Add(ttl)})
+	for s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+func (s *CachedStorage) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.entries, element.Value.(*cacheEntry).key)
+}
+
+// CacheStats tell how well the cache works, for tuning its size and TTLs
+type CacheStats struct {
+	Size      int     `json:"size"`
+	Hits      uint64  `json:"hits"`
+	Misses    uint64  `json:"misses"`
+	Collapsed uint64  `json:"collapsed"`
+	Evictions uint64  `json:"evictions"`
+	HitRatio  float64 `json:"hit_ratio"`
+}
+
+// CacheStats counts the lookups since the cache is made; collapsed misses waited for a concurrent lookup
+// instead of calling the backend
+func (s *CachedStorage) CacheStats() CacheStats {
+	s.mtx.Lock()
+	size := s.lru.Len()
+	s.mtx.Unlock()
+	stats := CacheStats{
+		Size:      size,
+		Hits:      atomic.LoadUint64(&s.hits),
+		Misses:    atomic.LoadUint64(&s.misses),
+		Collapsed: atomic.LoadUint64(&s.collapsed),
+		Evictions: atomic.LoadUint64(&s.evictions),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+	return stats
+}
+
+// Check checks the backend if it can be checked
+// OnExpire passes the links expiring in the backend to fn once they are dropped from the cache
+func (s *CachedStorage) OnExpire(fn func(link Link)) {
+	if expirer, ok := s.backend.(Expirer); ok {
+		expirer.OnExpire(func(link Link) {
+			s.invalidate(link.Key())
+			fn(link)
+		})
+	}
+}
+
+func (s *CachedStorage) Check(ctx context.Context) error {
+	if checker, ok := s.backend.(Checker); ok {
+		return checker.Check(ctx)
+	}
+	return nil
+}
+
+// Progress reports the loading of the backend if it loads at all
+func (s *CachedStorage) Progress() LoadProgress {
+	if loader, ok := s.backend.(Loader); ok {
+		return loader.Progress()
+	}
+	return LoadProgress{Loaded: true}
+}
+
+// Stats describe the backend if it reports statistics
+func (s *CachedStorage) Stats(ctx context.Context) Stats {
+	if reporter, ok := s.backend.(StatsReporter); ok {
+		return reporter.Stats(ctx)
+	}
+	return Stats{Links: s.backend.CountLinks(ctx)}
+}
+
+// WalkKeys lists the keys of the backend if it can list them
+func (s *CachedStorage) WalkKeys(ctx context.Context, fn func(key string)) error {
+	if walker, ok := s.backend.(KeyWalker); ok {
+		return walker.WalkKeys(ctx, fn)
+	}
+	return ErrCannotWalkKeys
+}
+
+// Close closes the backend if it can be closed
+func (s *CachedStorage) Close() error {
+	if closer, ok := s.backend.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStorage counts lookups, which wait for release when it is set
+type countingStorage struct {
+	*MemoryStorage
+	gets    int32
+	release chan struct{}
+}
+
+func (s *countingStorage) Get(ctx context.Context, key string) (Link, bool) {
+	atomic.AddInt32(&s.gets, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	return s.MemoryStorage.Get(ctx, key)
+}
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{MemoryStorage: NewMemoryStorage()}
+	now := time.Now()
+	cache := NewCachedStorage(backend, WithCacheTTL(time.Minute, time.Second))
+	cache.now = func() time.Time { return now }
+
+	cache.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	link, ok := cache.Get(ctx, "a")
+	require.True(t, ok)
+	link, _ = cache.Get(ctx, "a")
+	assert.Equal(t, "https://a.example", link.URL)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.gets))
+
+	cache.AddClick(ctx, "a", NoVariant)
+	link, _ = cache.Get(ctx, "a")
+	assert.Equal(t, int64(1), link.Clicks, "clicks are counted in the cached link")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.gets))
+
+	// misses are cached until the negative TTL passes
+	_, ok = cache.Get(ctx, "b")
+	assert.False(t, ok)
+	backend.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	_, ok = cache.Get(ctx, "b")
+	assert.False(t, ok)
+	now = now.Add(2 * time.Second)
+	_, ok = cache.Get(ctx, "b")
+	assert.True(t, ok)
+
+	cache.Put(ctx, Link{ID: "a", URL: "https://a2.example", UserID: "user"})
+	link, _ = cache.Get(ctx, "a")
+	assert.Equal(t, "https://a2.example", link.URL, "puts invalidate the link")
+	cache.Delete(ctx, "user", []string{"a"})
+	link, _ = cache.Get(ctx, "a")
+	assert.True(t, link.Deleted, "deletes invalidate the link")
+
+	now = now.Add(2 * time.Minute)
+	gets := atomic.LoadInt32(&backend.gets)
+	cache.Get(ctx, "a")
+	assert.Equal(t, gets+1, atomic.LoadInt32(&backend.gets), "links expire")
+
+	stats := cache.CacheStats()
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, uint64(6), stats.Misses)
+	assert.InDelta(t, 1.0/3, stats.HitRatio, 1e-9)
+	assert.Equal(t, 2, stats.Size)
+}
+
+func TestCachedStorageEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{MemoryStorage: NewMemoryStorage()}
+	cache := NewCachedStorage(backend, WithCacheSize(2))
+	for _, id := range []string{"a", "b", "c"} {
+		backend.Put(ctx, Link{ID: id, URL: "https://" + id + ".example"})
+	}
+
+	cache.Get(ctx, "a")
+	cache.Get(ctx, "b")
+	cache.Get(ctx, "a")
+	cache.Get(ctx, "c")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&backend.gets))
+	cache.Get(ctx, "a")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&backend.gets))
+	cache.Get(ctx, "b")
+	assert.Equal(t, int32(4), atomic.LoadInt32(&backend.gets), "b is evicted as the least recently used")
+	assert.Equal(t, uint64(2), cache.CacheStats().Evictions)
+}
+
+func TestCachedStorageCollapsesConcurrentLookups(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStorage{MemoryStorage: NewMemoryStorage(), release: make(chan struct{})}
+	backend.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	cache := NewCachedStorage(backend)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			link, ok := cache.Get(ctx, "a")
+			assert.True(t, ok)
+			assert.Equal(t, "https://a.example", link.URL)
+		}()
+	}
+	for atomic.LoadUint64(&cache.collapsed) < 9 {
+		time.Sleep(time.Millisecond)
+	}
+	close(backend.release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.gets))
+}
+
+func TestCachedStorageForwardsOptionalInterfaces(t *testing.T) {
+	cache := NewCachedStorage(NewMemoryStorage())
+	assert.NoError(t, cache.Check(context.Background()))
+	assert.True(t, cache.Progress().Loaded)
+	assert.NoError(t, cache.Close())
+}
@@ -0,0 +1,82 @@
+package storage
+
+import "sync/atomic"
+
+// linkCounter counts the links which are not deleted and the users owning them; storages keep it up to date
+// as links change, so that counting does not scan them
+type linkCounter struct {
+	links int
+	users map[string]int
+}
+
+// add counts the link in, or out for a negative delta, unless it is deleted
+func (c *linkCounter) add(link Link, delta int) {
+	if link.Deleted {
+		return
+	}
+	c.links += delta
+	if link.UserID == "" {
+		return
+	}
+	if c.users == nil {
+		c.users = make(map[string]int)
+	}
+	c.users[link.UserID] += delta
+	if c.users[link.UserID] <= 0 {
+		delete(c.users, link.UserID)
+	}
+}
+
+// replace counts the link in instead of the one it replaces
+func (c *linkCounter) replace(old Link, link Link) {
+	c.add(old, -1)
+	c.add(link, 1)
+}
+
+// clickCounters count clicks of a link and of its variants by index; they are incremented atomically,
+// so that counting clicks does not take the write lock of a storage
+type clickCounters struct {
+	clicks   int64
+	variants []int64
+}
+
+func newClickCounters(variants int) *clickCounters {
+	return &clickCounters{variants: make([]int64, variants)}
+}
+
+func (c *clickCounters) add(variant int) {
+	atomic.AddInt64(&c.clicks, 1)
+	if variant >= 0 && variant < len(c.variants) {
+		atomic.AddInt64(&c.variants[variant], 1)
+	}
+}
+
+// addTo returns the link with the counted clicks added to its own; its variants are copied
+func (c *clickCounters) addTo(link Link) Link {
+	link.Clicks += atomic.LoadInt64(&c.clicks)
+	if len(link.Variants) > 0 {
+		link.Variants = append([]Variant(nil), link.Variants...)
+		for i := range link.Variants {
+			if i < len(c.variants) {
+				link.Variants[i].Clicks += atomic.LoadInt64(&c.variants[i])
+			}
+		}
+	}
+	return link
+}
+
+// keepClicks gives the link the clicks of the link it replaces, as clicks are counted by AddClick only
+// and the link may be read before the latest ones; variants are matched by index
+func keepClicks(link Link, old Link) Link {
+	link.Clicks = old.Clicks
+	if len(link.Variants) > 0 {
+		link.Variants = append([]Variant(nil), link.Variants...)
+		for i := range link.Variants {
+			link.Variants[i].Clicks = 0
+			if i < len(old.Variants) {
+				link.Variants[i].Clicks = old.Variants[i].Clicks
+			}
+		}
+	}
+	return link
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountLinksAndUsers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	storages := map[string]func() Storage{
+		"memory": func() Storage { return NewMemoryStorage() },
+		"file":   func() Storage { return NewFileStorage(path) },
+	}
+	for name, newStorage := range storages {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStorage()
+			s.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "alice"})
+			s.Put(ctx, Link{ID: "b", URL: "https://b.example", UserID: "alice"})
+			s.Put(ctx, Link{ID: "c", URL: "https://c.example", UserID: "bob"})
+			s.Put(ctx, Link{ID: "d", URL: "https://d.example"})
+			// a link put again is counted once, under its new owner
+			s.Put(ctx, Link{ID: "b", URL: "https://b.example", UserID: "carol"})
+			assert.Equal(t, 4, s.CountLinks(ctx))
+			assert.Equal(t, 3, s.CountUsers(ctx))
+
+			s.Delete(ctx, "bob", []string{"c"})
+			s.Delete(ctx, "bob", []string{"c", "a"})
+			s.AddClick(ctx, "a", NoVariant)
+			assert.Equal(t, 3, s.CountLinks(ctx))
+			assert.Equal(t, 2, s.CountUsers(ctx))
+		})
+	}
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	assert.Equal(t, 3, reopened.CountLinks(context.Background()), "counts are rebuilt from the log")
+	assert.Equal(t, 2, reopened.CountUsers(context.Background()))
+}
@@ -3,16 +3,98 @@ package storage
 import (
 	"encoding/json"
 	"os"
+	"strings"
+	"time"
 )
 
+const (
+	opPut    = ""
+	opDelete = "delete"
+	opClick  = "click"
+	opClicks = "clicks"
+	// opEvict records the key of a link evicted from a memory storage, so that it is not reissued
+	opEvict = "evict"
+)
+
+// record is a single line of the storage log; records without an operation are link puts,
+// which keeps logs written before operations were introduced readable.
+// Hash is the storage key of the link, see Key
 type record struct {
-	Hash string `json:"hash"`
-	URL  string `json:"url"`
+	Op        string       `json:"op,omitempty"`
+	Hash      string       `json:"hash"`
+	Domain    string       `json:"domain,omitempty"`
+	URL       string       `json:"url,omitempty"`
+	UserID    string       `json:"user_id,omitempty"`
+	CreatedAt *time.Time   `json:"created_at,omitempty"`
+	Clicks    int64        `json:"clicks,omitempty"`
+	Deleted   bool         `json:"deleted,omitempty"`
+	Options   *LinkOptions `json:"options,omitempty"`
+	Rules     []Rule       `json:"rules,omitempty"`
+	Variants  []variant    `json:"variants,omitempty"`
+	// Variant is the index of the variant a click was served by
+	Variant *int `json:"variant,omitempty"`
+	// VariantClicks are the clicks of the variants by index, counted by a clicks record along with Clicks
+	VariantClicks []int64 `json:"variant_clicks,omitempty"`
+}
+
+// variant is persisted with its click counter, which Variant does not expose to clients
+type variant struct {
+	Destination string `json:"destination"`
+	Weight      int    `json:"weight"`
+	Clicks      int64  `json:"clicks,omitempty"`
+}
+
+func linkRecord(link Link) *record {
+	r := &record{
+		Hash:    link.Key(),
+		Domain:  link.Domain,
+		URL:     link.URL,
+		UserID:  link.UserID,
+		Clicks:  link.Clicks,
+		Deleted: link.Deleted,
+		Rules:   link.Rules,
+	}
+	if !link.CreatedAt.IsZero() {
+		createdAt := link.CreatedAt
+		r.CreatedAt = &createdAt
+	}
+	if !link.Options.IsZero() {
+		options := link.Options
+		r.Options = &options
+	}
+	for _, v := range link.Variants {
+		r.Variants = append(r.Variants, variant(v))
+	}
+	return r
+}
+
+func (r *record) link() Link {
+	link := Link{
+		ID:      strings.TrimPrefix(r.Hash, Key(r.Domain, "")),
+		Domain:  r.Domain,
+		URL:     r.URL,
+		UserID:  r.UserID,
+		Clicks:  r.Clicks,
+		Deleted: r.Deleted,
+		Rules:   r.Rules,
+	}
+	if r.CreatedAt != nil {
+		link.CreatedAt = *r.CreatedAt
+	}
+	if r.Options != nil {
+		link.Options = *r.Options
+	}
+	for _, v := range r.Variants {
+		link.Variants = append(link.Variants, Variant(v))
+	}
+	return link
 }
 
 type producer struct {
 	file    *os.File
 	encoder *json.Encoder
+	// size is the size of the file, which only the producer appends to
+	size int64
 }
 
 func NewProducer(filename string) (*producer, error) {
@@ -20,15 +102,26 @@ func NewProducer(filename string) (*producer, error) {
 	if err != nil {
 		return nil, err
 	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
 
-	return &producer{
-		file:    file,
-		encoder: json.NewEncoder(file),
-	}, nil
+	p := &producer{file: file, size: info.Size()}
+	p.encoder = json.NewEncoder(p)
+	return p, nil
+}
+
+// Write appends to the file, counting its size
+func (p *producer) Write(data []byte) (int, error) {
+	n, err := p.file.Write(data)
+	p.size += int64(n)
+	return n, err
 }
 
 func (p *producer) WriteRecord(record *record) error {
-	return p.encoder.Encode(&record)
+	return p.encoder.Encode(record)
 }
 
 func (p *producer) Close() error {
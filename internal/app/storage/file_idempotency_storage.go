@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileIdempotencyStorage appends responses to a JSON-lines file and keeps them in memory as well, within the bounds
+// of WithIdempotencyCapacity. The file is compacted, dropping expired, evicted and replaced responses,
+// when it is opened and whenever it grows much longer than the live responses
+type FileIdempotencyStorage struct {
+	path      string
+	file      *os.File
+	encoder   *json.Encoder
+	responses *idempotentResponses
+	records   int
+	mtx       sync.Mutex
+}
+
+var _ IdempotencyStorage = &FileIdempotencyStorage{}
+
+func NewFileIdempotencyStorage(path string, opts ...IdempotencyOption) (*FileIdempotencyStorage, error) {
+	checkDirExistOrCreate(path)
+	s := &FileIdempotencyStorage{path: path, responses: newIdempotentResponses(opts)}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileIdempotencyStorage) GetResponse(_ context.Context, key string) (IdempotentResponse, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.responses.get(key, time.Now())
+}
+
+func (s *FileIdempotencyStorage) PutResponse(_ context.Context, response IdempotentResponse) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.responses.put(response)
+	if err := s.encoder.Encode(response); err != nil {
+		return err
+	}
+	s.records++
+	if s.records > minCompactionRecords && s.records > 2*s.responses.len() {
+		return s.compact()
+	}
+	return nil
+}
+
+// Close closes the file; the storage must not be used afterwards
+func (s *FileIdempotencyStorage) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.file.Close()
+}
+
+func (s *FileIdempotencyStorage) replay() error {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var response IdempotentResponse
+		if err := decoder.Decode(&response); err != nil {
+			// a torn last line is left by a crash in the middle of a write
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		s.responses.put(response)
+	}
+}
+
+// compact rewrites the file with the live responses only, replacing it atomically
+func (s *FileIdempotencyStorage) compact() error {
+	s.responses.purgeExpired(time.Now())
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, response := range s.responses.all() {
+		if err := encoder.Encode(response); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+
+	if s.file != nil {
+		_ = s.file.Close()
+	}
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.encoder = json.NewEncoder(s.file)
+	s.records = s.responses.len()
+	return nil
+}
@@ -0,0 +1,133 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+// FileKeyStorage keeps API keys in a small JSON-lines file next to the link storage.
+// The file is rewritten as a whole on every change and reloaded whenever it changes on disk,
+// so keys created or revoked from the command line apply to a running server immediately
+type FileKeyStorage struct {
+	path    string
+	keys    map[string]APIKey
+	modTime time.Time
+	size    int64
+	mtx     sync.Mutex
+}
+
+var _ KeyStorage = &FileKeyStorage{}
+
+func NewFileKeyStorage(path string) *FileKeyStorage {
+	checkDirExistOrCreate(path)
+	return &FileKeyStorage{path: path, keys: make(map[string]APIKey)}
+}
+
+func (s *FileKeyStorage) PutKey(ctx context.Context, key APIKey) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reload(ctx)
+	if _, ok := s.keys[key.ID]; ok {
+		return ErrKeyExists
+	}
+	s.keys[key.ID] = key
+	return s.save()
+}
+
+func (s *FileKeyStorage) GetKeyByHash(ctx context.Context, hash string) (APIKey, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reload(ctx)
+	return findKeyByHash(s.keys, hash)
+}
+
+func (s *FileKeyStorage) ListKeys(ctx context.Context) []APIKey {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reload(ctx)
+	return sortedKeys(s.keys)
+}
+
+func (s *FileKeyStorage) RevokeKey(ctx context.Context, id string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.reload(ctx)
+	key, ok := s.keys[id]
+	if !ok {
+		return false, nil
+	}
+	key.Revoked = true
+	s.keys[id] = key
+	return true, s.save()
+}
+
+// reload reads the file again if its modification time or size differ from the last read
+func (s *FileKeyStorage) reload(ctx context.Context) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error(ctx, "could not stat key storage", "path", s.path, "error", err)
+		}
+		return
+	}
+	if info.ModTime().Equal(s.modTime) && info.Size() == s.size {
+		return
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		logger.Error(ctx, "could not open key storage", "path", s.path, "error", err)
+		return
+	}
+	defer file.Close()
+
+	keys := make(map[string]APIKey)
+	decoder := json.NewDecoder(file)
+	for {
+		var key APIKey
+		if err := decoder.Decode(&key); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Error(ctx, "could not read key storage", "path", s.path, "error", err)
+			}
+			break
+		}
+		keys[key.ID] = key
+	}
+	s.keys = keys
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+}
+
+// save replaces the file atomically so that readers never observe a partially written one
+func (s *FileKeyStorage) save() error {
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	for _, key := range sortedKeys(s.keys) {
+		if err := encoder.Encode(key); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		s.modTime = info.ModTime()
+		s.size = info.Size()
+	}
+	return nil
+}
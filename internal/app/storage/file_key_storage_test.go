@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/util"
+)
+
+func TestFileKeyStorageSeesChangesOfOtherProcesses(t *testing.T) {
+	ctx := context.Background()
+	path := "/tmp/shortener/" + util.GenerateUniqueID() + "/keys.log"
+	server := NewFileKeyStorage(path)
+	cli := NewFileKeyStorage(path)
+
+	key := APIKey{ID: "k1", Hash: "hash", UserID: "user", Scopes: []string{"links:create"}, CreatedAt: time.Now()}
+	require.NoError(t, cli.PutKey(ctx, key))
+	assert.ErrorIs(t, server.PutKey(ctx, APIKey{ID: "k1", Hash: "other"}), ErrKeyExists, "a stored key is never replaced")
+
+	found, ok := server.GetKeyByHash(ctx, "hash")
+	assert.True(t, ok)
+	assert.Equal(t, "user", found.UserID)
+
+	revoked, err := cli.RevokeKey(ctx, "k1")
+	require.NoError(t, err)
+	assert.True(t, revoked)
+
+	found, _ = server.GetKeyByHash(ctx, "hash")
+	assert.True(t, found.Revoked)
+	assert.Len(t, server.ListKeys(ctx), 1)
+}
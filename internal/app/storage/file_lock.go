@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrLogLocked = errors.New("the storage log is used by another process")
+
+// LogLock is held on the storage log by the process writing it, see LockLog
+type LogLock struct {
+	file *os.File
+}
+
+// LockLog takes the lock of the storage log at the path, which is kept in a file with the `.lock` suffix next to it,
+// so that operator commands do not change the log under a running server. The lock is released by Close
+// or when the process exits; the file is left in place
+func LockLog(path string) (*LogLock, error) {
+	checkDirExistOrCreate(path)
+	file, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		_ = file.Close()
+		if errors.Is(err, ErrLogLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrLogLocked, path)
+		}
+		return nil, err
+	}
+	return &LogLock{file: file}, nil
+}
+
+func (l *LogLock) Close() error {
+	return l.file.Close()
+}
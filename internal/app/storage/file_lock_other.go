@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package storage
+
+import "os"
+
+// lockFile does not lock where flock is not available, so that the log can still be used there
+func lockFile(*os.File) error {
+	return nil
+}
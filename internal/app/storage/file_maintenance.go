@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// CompactStats sums up a compaction of the storage log
+type CompactStats struct {
+	Records int `json:"records"`
+	Links   int `json:"links"`
+	Purged  int `json:"purged"`
+}
+
+// Problem is an inconsistency of the storage log found by VerifyFile, in a segment of a log directory
+type Problem struct {
+	Segment string `json:"segment,omitempty"`
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+// VerifyReport is the result of VerifyFile
+type VerifyReport struct {
+	Records  int       `json:"records"`
+	Links    int       `json:"links"`
+	Deleted  int       `json:"deleted"`
+	Problems []Problem `json:"problems"`
+}
+
+// Links returns all links including the deleted ones
+func (s *FileStorage) Links(ctx context.Context) []Link {
+	if !s.awaitLoaded(ctx) {
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	links := make([]Link, 0, len(s.data))
+	for _, link := range s.data {
+		links = append(links, s.withPendingClicks(link))
+	}
+	return links
+}
+
+// Close writes the pending clicks and closes the storage log
+func (s *FileStorage) Close() error {
+	<-s.loaded
+	s.stopFlushOnce.Do(func() {
+		close(s.stopFlush)
+	})
+	<-s.flushStopped
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.flushClicks(context.Background())
+	return s.producer.Close()
+}
+
+// CompactFile rewrites the storage log with a single record per link, optionally dropping deleted links;
+// the segments of a log directory are replaced by a single one. It must not run while a server has the log open.
+// A log with a corrupt record is left as is, except for a torn last line, which the server ignores too
+func CompactFile(path string, purgeDeleted bool) (CompactStats, error) {
+	var stats CompactStats
+	links := make(map[string]Link)
+	err := scanLog(path, func(_ string, line int, r *record, err error) error {
+		if errors.Is(err, errTornLine) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w, run verify for details", line, err)
+		}
+		stats.Records++
+		applyRecord(links, r)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	sorted := make([]Link, 0, len(links))
+	for _, link := range links {
+		if purgeDeleted && link.Deleted {
+			stats.Purged++
+			continue
+		}
+		sorted = append(sorted, link)
+	}
+	SortLinks(sorted)
+	stats.Links = len(sorted)
+	if isSegmented(path) {
+		return stats, replaceSegments(path, sorted)
+	}
+	return stats, writeLinksFile(path, sorted)
+}
+
+// writeLinksFile replaces the file with a record per link, in order, through a temporary file renamed over it
+func writeLinksFile(path string, links []Link) error {
+	records := make([]*record, len(links))
+	for i, link := range links {
+		records[i] = linkRecord(link)
+	}
+	return writeRecordsFile(path, records)
+}
+
+// writeRecordsFile replaces the file at the path with the records at once
+func writeRecordsFile(path string, records []*record) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// VerifyFile checks the storage log record by record without changing it
+func VerifyFile(path string) (VerifyReport, error) {
+	report := VerifyReport{Problems: []Problem{}}
+	links := make(map[string]Link)
+	current := ""
+	problem := func(line int, format string, args ...interface{}) {
+		report.Problems = append(report.Problems, Problem{Segment: current, Line: line, Message: fmt.Sprintf(format, args...)})
+	}
+	// the server stops reading a segment at its first corrupt record
+	corrupt := 0
+	ignored := func() {
+		if corrupt != 0 {
+			problem(corrupt, "the server ignores the records from this line on")
+			corrupt = 0
+		}
+	}
+	err := scanLog(path, func(segment string, line int, r *record, err error) error {
+		if segment != current {
+			ignored()
+			current = segment
+		}
+		if err != nil {
+			if errors.Is(err, errTornLine) {
+				problem(line, "the last record is incomplete and is ignored")
+				return nil
+			}
+			if corrupt == 0 {
+				corrupt = line
+			}
+			problem(line, "%v", err)
+			return nil
+		}
+		report.Records++
+		if corrupt != 0 {
+			return nil
+		}
+		if r.Hash == "" {
+			problem(line, "record has no key")
+			return nil
+		}
+		existing, exists := links[r.Hash]
+		switch r.Op {
+		case opPut:
+			if r.URL == "" && len(r.Variants) == 0 {
+				problem(line, "link %s has no URL", r.Hash)
+			}
+			if !strings.HasPrefix(r.Hash, Key(r.Domain, "")) || r.Hash == Key(r.Domain, "") {
+				problem(line, "key %s does not match domain %q", r.Hash, r.Domain)
+			}
+		case opDelete:
+			if !exists {
+				problem(line, "link %s is deleted before it is created", r.Hash)
+			}
+		case opClick:
+			if !exists {
+				problem(line, "link %s is clicked before it is created", r.Hash)
+			} else if v := r.Variant; v != nil && (*v < 0 || *v >= len(existing.Variants)) {
+				problem(line, "link %s has no variant %d", r.Hash, *v)
+			}
+		case opClicks:
+			if !exists {
+				problem(line, "link %s is clicked before it is created", r.Hash)
+			} else if len(r.VariantClicks) > len(existing.Variants) {
+				problem(line, "link %s has no variant %d", r.Hash, len(existing.Variants))
+			}
+		case opEvict:
+		default:
+			problem(line, "unknown operation %q", r.Op)
+		}
+		applyRecord(links, r)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	ignored()
+	for _, link := range links {
+		if link.Deleted {
+			report.Deleted++
+		}
+	}
+	report.Links = len(links)
+	return report, nil
+}
+
+var errTornLine = errors.New("incomplete last line")
+
+// scanFile calls fn for every non-blank line of the storage log, numbered from 1, with the record or the error
+// parsing it. A last line which is not terminated and cannot be parsed is reported as errTornLine.
+// An error returned by fn stops scanning
+func scanFile(path string, fn func(line int, r *record, err error) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		last := err != nil
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 {
+			var r record
+			if parseErr := json.Unmarshal(trimmed, &r); parseErr != nil {
+				if last {
+					parseErr = errTornLine
+				}
+				if fnErr := fn(line, nil, parseErr); fnErr != nil {
+					return fnErr
+				}
+			} else if fnErr := fn(line, &r, nil); fnErr != nil {
+				return fnErr
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// Stats describe the log: links are rebuilt from records, and the records beyond one per link are garbage,
+// which compaction drops
+func (s *FileStorage) Stats(ctx context.Context) Stats {
+	if !s.awaitLoaded(ctx) {
+		return Stats{}
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	stats := Stats{
+		Links:    len(s.data),
+		Records:  atomic.LoadInt64(&s.replayed.records) + s.written,
+		LogBytes: s.sealedBytes + s.producer.size,
+		Segments: len(s.manifest.Segments),
+	}
+	if stats.Records > 0 {
+		stats.GarbageRatio = 1 - float64(stats.Links)/float64(stats.Records)
+	}
+	return stats
+}
@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompactFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	fileStorage.Put(ctx, Link{ID: "b", Domain: "b.example", URL: "https://b.example", UserID: "user",
+		Variants: []Variant{{Destination: "https://one.example", Weight: 1}, {Destination: "https://two.example", Weight: 1}}})
+	fileStorage.Put(ctx, Link{ID: "c", URL: "https://c.example", UserID: "user"})
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	fileStorage.AddClick(ctx, Key("b.example", "b"), 1)
+	fileStorage.Delete(ctx, "user", []string{"c"})
+	require.NoError(t, fileStorage.Close())
+
+	stats, err := CompactFile(path, false)
+	require.NoError(t, err)
+	assert.Equal(t, CompactStats{Records: 6, Links: 3}, stats)
+
+	stats, err = CompactFile(path, true)
+	require.NoError(t, err)
+	assert.Equal(t, CompactStats{Records: 3, Links: 2, Purged: 1}, stats)
+
+	compacted := NewFileStorage(path)
+	defer compacted.Close()
+	link, ok := compacted.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), link.Clicks)
+	link, _ = compacted.Get(ctx, Key("b.example", "b"))
+	assert.Equal(t, "b", link.ID)
+	assert.Equal(t, int64(1), link.Variants[1].Clicks)
+	_, ok = compacted.Get(ctx, "c")
+	assert.False(t, ok)
+}
+
+func TestCompactFileKeepsCorruptLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	log := "{\"hash\":\"a\",\"url\":\"https://a.example\"}\nnot json\n{\"hash\":\"b\",\"url\":\"https://b.example\"}\n"
+	require.NoError(t, os.WriteFile(path, []byte(log), 0600))
+
+	_, err := CompactFile(path, false)
+	assert.Error(t, err)
+	data, _ := os.ReadFile(path)
+	assert.Equal(t, log, string(data))
+
+	require.NoError(t, os.WriteFile(path, []byte("{\"hash\":\"a\",\"url\":\"https://a.example\"}\n{\"hash\":\"b\""), 0600))
+	stats, err := CompactFile(path, false)
+	require.NoError(t, err, "a torn last line is dropped")
+	assert.Equal(t, 1, stats.Links)
+}
+
+func TestVerifyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	log := `{"hash":"a","url":"https://a.example"}
+{"op":"click","hash":"a","variant":2}
+{"op":"delete","hash":"missing"}
+{"hash":"x.example/b","domain":"y.example","url":"https://b.example"}
+{"op":"rename","hash":"a"}
+{"hash":"c"}
+not json
+{"hash":"d","url":"https://d.example"}
+{"hash":"e"`
+	require.NoError(t, os.WriteFile(path, []byte(log), 0600))
+
+	report, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 7, report.Records)
+	assert.Equal(t, 3, report.Links)
+	lines := make([]int, 0, len(report.Problems))
+	for _, problem := range report.Problems {
+		lines = append(lines, problem.Line)
+	}
+	assert.Equal(t, []int{2, 3, 4, 5, 6, 7, 9, 7}, lines)
+
+	report, err = VerifyFile(filepath.Join(t.TempDir(), "missing.log"))
+	assert.Error(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestVerifySegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.log")
+	require.NoError(t, os.MkdirAll(path, 0700))
+	require.NoError(t, writeManifest(path, &manifest{Version: manifestVersion,
+		Segments: []segment{{ID: 1, Sealed: true}, {ID: 2, Sealed: true}, {ID: 3}}}))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "00000001.log"),
+		[]byte("{\"hash\":\"a\",\"url\":\"https://a.example\"}\nnot json\n{\"hash\":\"b\",\"url\":\"https://b.example\"}\n"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "00000002.log"),
+		[]byte("{\"op\":\"click\",\"hash\":\"a\"}\n{\"op\":\"delete\",\"hash\":\"b\"}\n"), 0600))
+
+	report, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 4, report.Records)
+	assert.Equal(t, 1, report.Links)
+	assert.Equal(t, []Problem{
+		{Segment: "00000001.log", Line: 2, Message: "invalid character 'o' in literal null (expecting 'u')"},
+		{Segment: "00000001.log", Line: 2, Message: "the server ignores the records from this line on"},
+		{Segment: "00000002.log", Line: 2, Message: "link b is deleted before it is created"},
+	}, report.Problems)
+}
@@ -0,0 +1,188 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+// The storage log is a directory of segments, which are files of records appended in turn, and a manifest
+// listing them in order. Only the last segment is written; the others are sealed and never change, so that
+// they can be compacted, backed up or archived on their own. Files the manifest does not list are ignored
+const (
+	manifestName       = "MANIFEST"
+	manifestVersion    = 1
+	DefaultSegmentSize = 64 << 20
+
+	DefaultClickFlushInterval = 5 * time.Second
+)
+
+// manifest lists the segments of the storage log in the order of their records
+type manifest struct {
+	Version  int       `json:"version"`
+	Segments []segment `json:"segments"`
+}
+
+type segment struct {
+	ID     int  `json:"id"`
+	Sealed bool `json:"sealed,omitempty"`
+}
+
+func (s segment) name() string {
+	return fmt.Sprintf("%08d.log", s.ID)
+}
+
+// next is a new segment following the listed ones
+func (m *manifest) next() segment {
+	id := 1
+	if n := len(m.Segments); n > 0 {
+		id = m.Segments[n-1].ID + 1
+	}
+	return segment{ID: id}
+}
+
+// isSegmented tells whether the path is a directory of segments rather than a single-file log
+func isSegmented(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+func readManifest(dir string) (*manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return &manifest{Version: manifestVersion}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("manifest: unknown version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// writeManifest replaces the manifest at once, so that a crash leaves either the old or the new one
+func writeManifest(dir string, m *manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, manifestName+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, manifestName))
+}
+
+// openManifest makes the directory of the storage log, importing a single-file log found at its path
+// as the first sealed segment
+func openManifest(ctx context.Context, dir string) (*manifest, error) {
+	if err := importSingleFileLog(ctx, dir); err != nil {
+		return nil, fmt.Errorf("import single-file log: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return readManifest(dir)
+}
+
+// importSingleFileLog moves a single-file log into a staging directory which becomes the directory
+// of the log once it has a manifest. An import cut short is finished at the next start
+func importSingleFileLog(ctx context.Context, dir string) error {
+	staging := dir + ".import"
+	first := segment{ID: 1, Sealed: true}
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		if err := os.MkdirAll(staging, 0700); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, filepath.Join(staging, first.name())); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(filepath.Join(staging, first.name())); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := writeManifest(staging, &manifest{Version: manifestVersion, Segments: []segment{first}}); err != nil {
+		return err
+	}
+	if err := os.Rename(staging, dir); err != nil {
+		return err
+	}
+	logger.Info(ctx, "single-file storage log is imported", "path", dir, "segment", first.name())
+	return nil
+}
+
+// scanLog scans the records of a single-file log, or of the segments of a log directory in order,
+// see scanFile; segments are named in the calls of fn, single-file logs are not
+func scanLog(path string, fn func(segment string, line int, r *record, err error) error) error {
+	if !isSegmented(path) {
+		return scanFile(path, func(line int, r *record, err error) error {
+			return fn("", line, r, err)
+		})
+	}
+	m, err := readManifest(path)
+	if err != nil {
+		return err
+	}
+	for _, seg := range m.Segments {
+		name := seg.name()
+		err := scanFile(filepath.Join(path, name), func(line int, r *record, err error) error {
+			return fn(name, line, r, err)
+		})
+		if errors.Is(err, fs.ErrNotExist) && !seg.Sealed {
+			// the segment to write is created once it is listed
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("segment %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// replaceSegments writes the links into a new sealed segment, which the manifest then lists instead of the others
+func replaceSegments(dir string, links []Link) error {
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	compacted := m.next()
+	compacted.Sealed = true
+	if err := writeLinksFile(filepath.Join(dir, compacted.name()), links); err != nil {
+		return err
+	}
+	if err := writeManifest(dir, &manifest{Version: manifestVersion, Segments: []segment{compacted}}); err != nil {
+		return err
+	}
+	for _, seg := range m.Segments {
+		if err := os.Remove(filepath.Join(dir, seg.name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,45 +1,421 @@
 package storage
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
 )
 
 type FileStorage struct {
-	data            map[string]string
+	data map[string]Link
+	// fileStoragePath is the directory of the segments of the log, whose last one the producer writes
 	fileStoragePath string
+	segmentSize     int64
+	manifest        *manifest
+	sealedBytes     int64
 	producer        *producer
-	mtx             sync.RWMutex
+	// writeErr is the error of the last write, if it failed; written counts the records written since the log is opened
+	writeErr error
+	written  int64
+	counter  *linkCounter
+	mtx      sync.RWMutex
+
+	// loaded is closed once the log is replayed into data; replayed tells the progress until then
+	loaded     chan struct{}
+	replayed   *replayProgress
+	totalBytes int64
+
+	// pending holds the *clickCounters of the clicks not written yet by key. Clicks only take the read lock,
+	// and are written in a single record per link every clickFlushInterval and on Close
+	pending            sync.Map
+	clickFlushInterval time.Duration
+	stopFlush          chan struct{}
+	flushStopped       chan struct{}
+	stopFlushOnce      sync.Once
+}
+
+// replayProgress is updated atomically while the log is replayed
+type replayProgress struct {
+	records int64
+	bytes   int64
+}
+
+// segmentFile is a segment to replay, up to the size it has when the log is opened
+type segmentFile struct {
+	path string
+	size int64
+}
+
+var (
+	_ Storage = &FileStorage{}
+	_ Checker = &FileStorage{}
+	_ Loader  = &FileStorage{}
+
+	_ StatsReporter = &FileStorage{}
+	_ KeyWalker     = &FileStorage{}
+)
+
+// FileOption customizes the storage built by NewFileStorage
+type FileOption func(*FileStorage)
+
+// WithSegmentSize sets the size beyond which the segment written is sealed and a new one is started;
+// DefaultSegmentSize by default
+func WithSegmentSize(size int64) FileOption {
+	return func(s *FileStorage) {
+		s.segmentSize = size
+	}
+}
+
+// WithClickFlushInterval sets how often the clicks counted since are written to the log; DefaultClickFlushInterval
+// by default. The clicks of the last interval are lost on a crash
+func WithClickFlushInterval(interval time.Duration) FileOption {
+	return func(s *FileStorage) {
+		s.clickFlushInterval = interval
+	}
 }
 
-var _ Storage = &FileStorage{}
+// NewFileStorage opens the storage log in the directory at the path, importing a single-file log found there,
+// and replays it in the background; the methods of the storage wait until it is replayed, see Progress
+func NewFileStorage(fileStoragePath string, opts ...FileOption) *FileStorage {
+	ctx := context.Background()
+	s := &FileStorage{
+		data:            make(map[string]Link),
+		counter:         &linkCounter{},
+		fileStoragePath: fileStoragePath,
+		segmentSize:     DefaultSegmentSize,
+		loaded:          make(chan struct{}),
+		replayed:        &replayProgress{},
 
-func NewFileStorage(fileStoragePath string) *FileStorage {
-	checkDirExistOrCreate(fileStoragePath)
-	mapStore := readFromFileIntoMap(fileStoragePath)
+		clickFlushInterval: DefaultClickFlushInterval,
+		stopFlush:          make(chan struct{}),
+		flushStopped:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	segments, err := s.open(ctx)
+	if err != nil {
+		logger.Error(ctx, "could not open file storage", "path", fileStoragePath, "error", err)
+		os.Exit(1)
+	}
+	go s.load(segments)
+	go s.flushLoop(s.clickFlushInterval, s.stopFlush, s.flushStopped)
+	return s
+}
 
-	fileProducer, err := NewProducer(fileStoragePath)
+// open lists the segments to replay and starts the segment to write, unless the last one is still empty:
+// records are never appended to a segment written before, whose last record a crash may have torn
+func (s *FileStorage) open(ctx context.Context) ([]segmentFile, error) {
+	m, err := openManifest(ctx, s.fileStoragePath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	var segments []segmentFile
+	var lastSize int64
+	for _, seg := range m.Segments {
+		path := filepath.Join(s.fileStoragePath, seg.name())
+		lastSize = 0
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) && !seg.Sealed {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lastSize = info.Size(); lastSize > 0 {
+			segments = append(segments, segmentFile{path: path, size: lastSize})
+			s.totalBytes += lastSize
+		}
+	}
+	if n := len(m.Segments); n == 0 || m.Segments[n-1].Sealed || lastSize > 0 {
+		if n > 0 {
+			m.Segments[n-1].Sealed = true
+		}
+		m.Segments = append(m.Segments, m.next())
+	}
+	active := m.Segments[len(m.Segments)-1]
+	s.producer, err = NewProducer(filepath.Join(s.fileStoragePath, active.name()))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeManifest(s.fileStoragePath, m); err != nil {
+		_ = s.producer.Close()
+		return nil, err
+	}
+	s.manifest = m
+	s.sealedBytes = s.totalBytes
+	return segments, nil
+}
+
+// load replays the segments into data, which nothing else touches until loaded is closed. Segments are parsed
+// in parallel, and applied in order as soon as they are parsed; parsed segments waiting to be applied are
+// bounded by the number of parsers
+func (s *FileStorage) load(segments []segmentFile) {
+	start := time.Now()
+	parsed := make([]chan []*record, len(segments))
+	for i := range parsed {
+		parsed[i] = make(chan []*record, 1)
+	}
+	slots := make(chan struct{}, runtime.GOMAXPROCS(0))
+	go func() {
+		for i, seg := range segments {
+			slots <- struct{}{}
+			go func(i int, seg segmentFile) {
+				parsed[i] <- readSegment(seg.path, seg.size)
+			}(i, seg)
+		}
+	}()
+	var records, bytes int64
+	for i, seg := range segments {
+		for _, r := range <-parsed[i] {
+			applyRecord(s.data, r)
+			records++
+			atomic.StoreInt64(&s.replayed.records, records)
+		}
+		<-slots
+		bytes += seg.size
+		atomic.StoreInt64(&s.replayed.bytes, bytes)
+	}
+	for _, link := range s.data {
+		s.counter.add(link, 1)
+	}
+	logger.Info(context.Background(), "file storage is loaded", "path", s.fileStoragePath, "segments", len(segments),
+		"records", records, "links", len(s.data), "duration", time.Since(start))
+	close(s.loaded)
+}
+
+// Progress reports how much of the log is replayed
+func (s *FileStorage) Progress() LoadProgress {
+	progress := LoadProgress{
+		Records:    atomic.LoadInt64(&s.replayed.records),
+		Bytes:      atomic.LoadInt64(&s.replayed.bytes),
+		TotalBytes: s.totalBytes,
+	}
+	select {
+	case <-s.loaded:
+		progress.Loaded = true
+	default:
+	}
+	return progress
+}
+
+// awaitLoaded waits for the log to be replayed; it tells false if the context is done first
+func (s *FileStorage) awaitLoaded(ctx context.Context) bool {
+	select {
+	case <-s.loaded:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Check tells whether the log can still be written: the last write succeeded and the file can be opened for writing
+func (s *FileStorage) Check(context.Context) error {
+	s.mtx.RLock()
+	writeErr := s.writeErr
+	s.mtx.RUnlock()
+	if writeErr != nil {
+		return fmt.Errorf("last write failed: %w", writeErr)
+	}
+	s.mtx.RLock()
+	path := s.producer.file.Name()
+	s.mtx.RUnlock()
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Put keeps the clicks of the link it replaces, if any; it returns an empty ID if the context is done
+// before the log is replayed
+func (s *FileStorage) Put(ctx context.Context, link Link) string {
+	if !s.awaitLoaded(ctx) {
+		return ""
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.put(ctx, link)
+	return link.ID
+}
+
+func (s *FileStorage) PutIfAbsent(ctx context.Context, link Link) bool {
+	if !s.awaitLoaded(ctx) {
+		return false
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, taken := s.data[link.Key()]; taken {
+		return false
+	}
+	s.put(ctx, link)
+	return true
+}
+
+// put stores the link and writes it to the log; mtx must be held. The clicks of the link it replaces
+// are kept, the written ones as well as the pending ones
+func (s *FileStorage) put(ctx context.Context, link Link) {
+	if old, ok := s.data[link.Key()]; ok {
+		link = keepClicks(link, old)
+		s.counter.replace(old, link)
+	} else {
+		s.counter.add(link, 1)
 	}
-	return &FileStorage{data: mapStore, fileStoragePath: fileStoragePath, producer: fileProducer}
+	s.data[link.Key()] = link
+	s.writeToFile(ctx, linkRecord(link))
 }
 
-func (s *FileStorage) Put(hash string, url string) string {
+func (s *FileStorage) Get(ctx context.Context, key string) (Link, bool) {
+	if !s.awaitLoaded(ctx) {
+		return Link{}, false
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	value, ok := s.data[key]
+	if !ok {
+		return Link{}, false
+	}
+	return s.withPendingClicks(value), true
+}
+
+// withPendingClicks adds the clicks which are not written yet to the link; mtx must be held
+func (s *FileStorage) withPendingClicks(link Link) Link {
+	if value, ok := s.pending.Load(link.Key()); ok {
+		return value.(*clickCounters).addTo(link)
+	}
+	return link
+}
+
+func (s *FileStorage) GetByUser(ctx context.Context, userID string) []Link {
+	if !s.awaitLoaded(ctx) {
+		return nil
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	var links []Link
+	for _, link := range s.data {
+		if link.UserID == userID && !link.Deleted {
+			links = append(links, s.withPendingClicks(link))
+		}
+	}
+	return links
+}
+
+func (s *FileStorage) Delete(ctx context.Context, userID string, keys []string) {
+	if !s.awaitLoaded(ctx) {
+		return
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
-	s.data[hash] = url
-	s.writeToFile(hash, url)
-	return hash
+	for _, key := range keys {
+		link, ok := s.data[key]
+		if !ok || link.UserID != userID || link.Deleted {
+			continue
+		}
+		s.counter.add(link, -1)
+		link.Deleted = true
+		s.data[key] = link
+		s.writeToFile(ctx, &record{Op: opDelete, Hash: key})
+	}
 }
 
-func (s *FileStorage) Get(hash string) (string, bool) {
+// WalkKeys lists the keys once the log is replayed
+func (s *FileStorage) WalkKeys(ctx context.Context, fn func(key string)) error {
+	if !s.awaitLoaded(ctx) {
+		return ctx.Err()
+	}
 	s.mtx.RLock()
 	defer s.mtx.RUnlock()
-	value, ok := s.data[hash]
-	return value, ok
+	for key := range s.data {
+		fn(key)
+	}
+	return nil
+}
+
+func (s *FileStorage) CountLinks(ctx context.Context) int {
+	if !s.awaitLoaded(ctx) {
+		return 0
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return s.counter.links
+}
+
+func (s *FileStorage) CountUsers(ctx context.Context) int {
+	if !s.awaitLoaded(ctx) {
+		return 0
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return len(s.counter.users)
+}
+
+// AddClick counts the click in memory, see WithClickFlushInterval
+func (s *FileStorage) AddClick(ctx context.Context, key string, variant int) {
+	if !s.awaitLoaded(ctx) {
+		return
+	}
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	link, ok := s.data[key]
+	if !ok {
+		return
+	}
+	value, ok := s.pending.Load(key)
+	if !ok {
+		value, _ = s.pending.LoadOrStore(key, newClickCounters(len(link.Variants)))
+	}
+	value.(*clickCounters).add(variant)
+}
+
+// flushLoop writes the pending clicks every interval until stop is closed
+func (s *FileStorage) flushLoop(interval time.Duration, stop chan struct{}, stopped chan struct{}) {
+	defer close(stopped)
+	if interval <= 0 {
+		<-stop
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mtx.Lock()
+			s.flushClicks(context.Background())
+			s.mtx.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// flushClicks writes a record of the pending clicks of each link; mtx must be held, so that no clicks are counted
+// meanwhile
+func (s *FileStorage) flushClicks(ctx context.Context) {
+	s.pending.Range(func(key, value interface{}) bool {
+		s.pending.Delete(key)
+		c := value.(*clickCounters)
+		r := &record{Op: opClicks, Hash: key.(string), Clicks: c.clicks}
+		for i, clicks := range c.variants {
+			if clicks != 0 {
+				r.VariantClicks = c.variants[:i+1]
+			}
+		}
+		applyRecord(s.data, r)
+		s.writeToFile(ctx, r)
+		return true
+	})
 }
 
 func checkDirExistOrCreate(fileStoragePath string) {
@@ -50,33 +426,112 @@ func checkDirExistOrCreate(fileStoragePath string) {
 	if _, err := os.Stat(fileStoragePath); os.IsNotExist(err) {
 		err := os.MkdirAll(dir, 0700)
 		if err != nil {
-			log.Fatal(err)
+			logger.Error(context.Background(), "could not create storage directory", "dir", dir, "error", err)
+			os.Exit(1)
 		}
 	}
 }
 
-func readFromFileIntoMap(fileStoragePath string) map[string]string {
-	consumer, err := NewConsumer(fileStoragePath)
+// readSegment reads the records of the first size bytes of the segment, up to the first one which cannot be read
+func readSegment(path string, size int64) []*record {
+	ctx := context.Background()
+	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("Error while reading file from disk: %v\n", err)
+		logger.Error(ctx, "could not read file storage segment", "path", path, "error", err)
+		return nil
 	}
-	defer consumer.Close()
+	defer file.Close()
+	// records appended once the log is opened are written by the storage itself, which keeps them in the map already
+	decoder := json.NewDecoder(io.LimitReader(file, size))
 
-	mapStore := make(map[string]string)
+	var records []*record
 	for {
-		record, err := consumer.ReadRecord()
-		if err != nil {
-			break
+		var r record
+		if err := decoder.Decode(&r); err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Warn(ctx, "ignoring the rest of file storage segment", "path", path,
+					"records", len(records), "error", err)
+			}
+			return records
+		}
+		records = append(records, &r)
+	}
+}
+
+func applyRecord(mapStore map[string]Link, record *record) {
+	switch record.Op {
+	case opPut:
+		mapStore[record.Hash] = record.link()
+	case opDelete:
+		if link, ok := mapStore[record.Hash]; ok {
+			link.Deleted = true
+			mapStore[record.Hash] = link
+		}
+	case opClick:
+		if link, ok := mapStore[record.Hash]; ok {
+			link.Clicks++
+			if v := record.Variant; v != nil && *v >= 0 && *v < len(link.Variants) {
+				// variants are copied so that links handed out earlier are not changed
+				link.Variants = append([]Variant(nil), link.Variants...)
+				link.Variants[*v].Clicks++
+			}
+			mapStore[record.Hash] = link
+		}
+	case opClicks:
+		if link, ok := mapStore[record.Hash]; ok {
+			link.Clicks += record.Clicks
+			if len(record.VariantClicks) > 0 {
+				link.Variants = append([]Variant(nil), link.Variants...)
+				for i, clicks := range record.VariantClicks {
+					if i < len(link.Variants) {
+						link.Variants[i].Clicks += clicks
+					}
+				}
+			}
+			mapStore[record.Hash] = link
+		}
+	case opEvict:
+		delete(mapStore, record.Hash)
+	}
+}
+
+func (s *FileStorage) writeToFile(ctx context.Context, record *record) {
+	err := s.producer.WriteRecord(record)
+	s.writeErr = err
+	if err != nil {
+		logger.Error(ctx, "could not write record to file storage", "id", record.Hash, "op", record.Op, "error", err)
+		return
+	}
+	s.written++
+	if s.segmentSize > 0 && s.producer.size >= s.segmentSize {
+		if err := s.rotate(); err != nil {
+			logger.Error(ctx, "could not start a new file storage segment", "path", s.fileStoragePath, "error", err)
 		}
-		mapStore[record.Hash] = record.URL
 	}
-	return mapStore
 }
 
-func (s *FileStorage) writeToFile(hash string, url string) {
-	record := record{hash, url}
-	err := s.producer.WriteRecord(&record)
+// rotate seals the segment written and starts a new one; the manifest lists the new segment before it is
+// written, and the old one stays in use if it cannot
+func (s *FileStorage) rotate() error {
+	m := &manifest{Version: manifestVersion, Segments: append([]segment(nil), s.manifest.Segments...)}
+	m.Segments[len(m.Segments)-1].Sealed = true
+	active := m.next()
+	m.Segments = append(m.Segments, active)
+	path := filepath.Join(s.fileStoragePath, active.name())
+	p, err := NewProducer(path)
 	if err != nil {
-		log.Printf("Error while writing to file: %v\n", err)
+		return err
+	}
+	if err := writeManifest(s.fileStoragePath, m); err != nil {
+		_ = p.Close()
+		_ = os.Remove(path)
+		return err
+	}
+	if err := s.producer.Close(); err != nil {
+		logger.Warn(context.Background(), "could not close file storage segment", "error", err)
 	}
+	s.sealedBytes += s.producer.size
+	s.producer = p
+	s.manifest = m
+	return nil
 }
@@ -1,49 +1,355 @@
 package storage
 
 import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/tsupko/shortener/internal/app/util"
 )
 
-const fileStoragePath = "file.log"
-
 func TestReadFromFileWhenCreated(t *testing.T) {
 	hash := util.GenerateUniqueID()
+	path := filepath.Join(t.TempDir(), "links.log")
 
-	fileStorage := NewFileStorage(fileStoragePath)
-	fileStorage.writeToFile(hash, "url")
+	fileStorage := NewFileStorage(path)
+	defer fileStorage.Close()
+	fileStorage.writeToFile(context.Background(), linkRecord(Link{ID: hash, URL: "url"}))
 
-	url, _ := fileStorage.Get(hash)
-	assert.Equal(t, "", url)
+	link, _ := fileStorage.Get(context.Background(), hash)
+	assert.Equal(t, "", link.URL)
 
-	anotherStorage := NewFileStorage(fileStoragePath)
-	url, _ = anotherStorage.Get(hash)
-	assert.Equal(t, "url", url)
+	anotherStorage := NewFileStorage(path)
+	defer anotherStorage.Close()
+	link, _ = anotherStorage.Get(context.Background(), hash)
+	assert.Equal(t, "url", link.URL)
 }
 
 func TestDoubleSave(t *testing.T) {
 	hash := util.GenerateUniqueID()
+	path := filepath.Join(t.TempDir(), "links.log")
 
-	fileStorage := NewFileStorage(fileStoragePath)
-	fileStorage.Put(hash, "url")
-	fileStorage.Put(hash, "url2")
+	fileStorage := NewFileStorage(path)
+	defer fileStorage.Close()
+	fileStorage.Put(context.Background(), Link{ID: hash, URL: "url"})
+	fileStorage.Put(context.Background(), Link{ID: hash, URL: "url2"})
 
-	url, _ := fileStorage.Get(hash)
-	assert.Equal(t, "url2", url)
+	link, _ := fileStorage.Get(context.Background(), hash)
+	assert.Equal(t, "url2", link.URL)
 
-	anotherStorage := NewFileStorage(fileStoragePath)
-	url, _ = anotherStorage.Get(hash)
-	assert.Equal(t, "url2", url)
+	anotherStorage := NewFileStorage(path)
+	defer anotherStorage.Close()
+	link, _ = anotherStorage.Get(context.Background(), hash)
+	assert.Equal(t, "url2", link.URL)
+}
+
+func TestDeleteAndClicksAreReplayed(t *testing.T) {
+	ctx := context.Background()
+	hash := util.GenerateUniqueID()
+	other := util.GenerateUniqueID()
+	path := filepath.Join(t.TempDir(), "links.log")
+
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: hash, URL: "url", UserID: "user"})
+	fileStorage.Put(ctx, Link{ID: other, URL: "url", UserID: "user"})
+	fileStorage.AddClick(ctx, hash, NoVariant)
+	fileStorage.AddClick(ctx, hash, NoVariant)
+	fileStorage.Delete(ctx, "another user", []string{hash})
+	fileStorage.Delete(ctx, "user", []string{other})
+	require.NoError(t, fileStorage.Close())
+
+	anotherStorage := NewFileStorage(path)
+	defer anotherStorage.Close()
+	link, ok := anotherStorage.Get(ctx, hash)
+	assert.True(t, ok)
+	assert.False(t, link.Deleted)
+	assert.Equal(t, int64(2), link.Clicks)
+	link, _ = anotherStorage.Get(ctx, other)
+	assert.True(t, link.Deleted)
+}
+
+func TestOptionsAndRulesAreReplayed(t *testing.T) {
+	ctx := context.Background()
+	hash := util.GenerateUniqueID()
+	path := filepath.Join(t.TempDir(), "links.log")
+	link := Link{
+		ID:      hash,
+		Domain:  "a.example",
+		URL:     "url",
+		Options: LinkOptions{Interstitial: true, PassQuery: PassQueryAppend},
+		Rules:   []Rule{{Destination: "https://m.example", Platforms: []string{"android"}}},
+	}
+
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, link)
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	replayed, ok := reopened.Get(ctx, link.Key())
+	assert.True(t, ok)
+	assert.Equal(t, link, replayed)
+}
+
+func TestVariantClicksAreReplayed(t *testing.T) {
+	ctx := context.Background()
+	hash := util.GenerateUniqueID()
+	path := filepath.Join(t.TempDir(), "links.log")
+
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: hash, URL: "a", Variants: []Variant{{Destination: "a", Weight: 7}, {Destination: "b", Weight: 3}}})
+	fileStorage.AddClick(ctx, hash, 0)
+	fileStorage.AddClick(ctx, hash, 1)
+	fileStorage.AddClick(ctx, hash, 1)
+	fileStorage.AddClick(ctx, hash, NoVariant)
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	link, _ := reopened.Get(ctx, hash)
+	assert.Equal(t, int64(4), link.Clicks)
+	assert.Equal(t, []Variant{{Destination: "a", Weight: 7, Clicks: 1}, {Destination: "b", Weight: 3, Clicks: 2}}, link.Variants)
+}
+
+func TestLegacyRecordsAreRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.log")
+	assert.NoError(t, os.WriteFile(path, []byte(`{"hash":"abc","url":"https://ya.ru"}`+"\n"), 0600))
+
+	fileStorage := NewFileStorage(path)
+	defer fileStorage.Close()
+	link, ok := fileStorage.Get(context.Background(), "abc")
+	assert.True(t, ok)
+	assert.Equal(t, "https://ya.ru", link.URL)
 }
 
 func Test(t *testing.T) {
-	assert.NotEmpty(t, NewFileStorage("/tmp/shortener/shortener.log"))
+	fileStorage := NewFileStorage(filepath.Join(t.TempDir(), "shortener.log"))
+	defer fileStorage.Close()
+	assert.NotEmpty(t, fileStorage)
 }
 
 func TestDirNotExist(t *testing.T) {
-	dir := util.GenerateUniqueID()
-	assert.NotEmpty(t, NewFileStorage("/tmp/shortener/"+dir+"/log.file"))
+	fileStorage := NewFileStorage(filepath.Join(t.TempDir(), util.GenerateUniqueID(), "log.file"))
+	defer fileStorage.Close()
+	assert.NotEmpty(t, fileStorage)
+}
+
+func TestFileStorageProgressAndCheck(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	_, ok := reopened.Get(ctx, "a")
+	assert.True(t, ok)
+	progress := reopened.Progress()
+	assert.True(t, progress.Loaded)
+	assert.Equal(t, int64(2), progress.Records)
+	assert.Positive(t, progress.TotalBytes)
+	assert.Equal(t, progress.TotalBytes, progress.Bytes)
+	assert.NoError(t, reopened.Check(ctx))
+
+	require.NoError(t, reopened.Close())
+	reopened.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	assert.Error(t, reopened.Check(ctx), "failed writes make the storage fail its check")
+}
+
+func TestFileStorageGivesUpWaitingForReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	loading := &FileStorage{loaded: make(chan struct{})}
+	_, ok := loading.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Empty(t, loading.Put(ctx, Link{ID: "a", URL: "https://a.example"}))
+	assert.Empty(t, loading.GetByUser(ctx, "user"))
+	assert.Zero(t, loading.CountLinks(ctx))
+	assert.ErrorIs(t, loading.WalkKeys(ctx, func(string) {}), context.Canceled)
+}
+
+func TestFileStorageStats(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	fileStorage.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	reopened.AddClick(ctx, "b", NoVariant)
+	stats := reopened.Stats(ctx)
+	assert.Equal(t, 2, stats.Links)
+	assert.Equal(t, int64(3), stats.Records, "the clicks of a link are written in a single record")
+	assert.InDelta(t, 1.0/3, stats.GarbageRatio, 1e-9)
+	assert.Equal(t, 2, stats.Segments)
+	segments, err := filepath.Glob(filepath.Join(path, "*.log"))
+	require.NoError(t, err)
+	var size int64
+	for _, segment := range segments {
+		info, err := os.Stat(segment)
+		require.NoError(t, err)
+		size += info.Size()
+	}
+	assert.Equal(t, size, stats.LogBytes)
+}
+
+func TestFileStorageWalkKeys(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	fileStorage.Put(ctx, Link{ID: "b", Domain: "b.example", URL: "https://b.example"})
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	var keys []string
+	require.NoError(t, reopened.WalkKeys(ctx, func(key string) { keys = append(keys, key) }))
+	assert.ElementsMatch(t, []string{"a", Key("b.example", "b")}, keys)
+}
+
+func TestFileStorageRotatesSegments(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path, WithSegmentSize(1))
+	for _, id := range []string{"a", "b", "c", "d"} {
+		fileStorage.Put(ctx, Link{ID: id, URL: "https://" + id + ".example", UserID: "user"})
+	}
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	fileStorage.Delete(ctx, "user", []string{"b"})
+	require.NoError(t, fileStorage.Close())
+	stats := fileStorage.Stats(ctx)
+	assert.Equal(t, 7, stats.Segments, "segments are sealed once they reach their size")
+
+	m, err := readManifest(path)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 7)
+	for i, segment := range m.Segments {
+		assert.Equal(t, i+1, segment.ID)
+		assert.Equal(t, i < 6, segment.Sealed)
+	}
+
+	reopened := NewFileStorage(path, WithSegmentSize(1))
+	defer reopened.Close()
+	link, _ := reopened.Get(ctx, "a")
+	assert.Equal(t, int64(1), link.Clicks, "segments are replayed in order")
+	link, _ = reopened.Get(ctx, "b")
+	assert.True(t, link.Deleted)
+	assert.Equal(t, 3, reopened.CountLinks(ctx))
+	assert.Equal(t, stats.LogBytes, reopened.Progress().TotalBytes)
+}
+
+func TestFileStorageSkipsTornRecordOfSegment(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	require.NoError(t, fileStorage.Close())
+	segment, err := os.OpenFile(filepath.Join(path, "00000001.log"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = segment.WriteString(`{"hash":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, segment.Close())
+
+	reopened := NewFileStorage(path)
+	reopened.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	require.NoError(t, reopened.Close())
+
+	replayed := NewFileStorage(path)
+	defer replayed.Close()
+	_, ok := replayed.Get(ctx, "a")
+	assert.True(t, ok)
+	_, ok = replayed.Get(ctx, "b")
+	assert.True(t, ok, "records after a crash are written to a new segment")
+}
+
+func TestFileStorageImportsSingleFileLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "links.log")
+	require.NoError(t, os.WriteFile(path, []byte(`{"hash":"a","url":"https://a.example"}`+"\n"), 0600))
+
+	fileStorage := NewFileStorage(path)
+	fileStorage.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	require.NoError(t, fileStorage.Close())
+	assert.True(t, isSegmented(path))
+	data, err := os.ReadFile(filepath.Join(path, "00000001.log"))
+	require.NoError(t, err)
+	assert.Equal(t, `{"hash":"a","url":"https://a.example"}`+"\n", string(data))
+
+	// an import cut short before the directory took the place of the log
+	interrupted := filepath.Join(dir, "interrupted.log")
+	require.NoError(t, os.MkdirAll(interrupted+".import", 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(interrupted+".import", "00000001.log"),
+		[]byte(`{"hash":"c","url":"https://c.example"}`+"\n"), 0600))
+	resumed := NewFileStorage(interrupted)
+	defer resumed.Close()
+	_, ok := resumed.Get(ctx, "c")
+	assert.True(t, ok)
+	_, err = os.Stat(interrupted + ".import")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileStorageKeepsClicksOfReplacedLinks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path, WithClickFlushInterval(0))
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	link, _ := fileStorage.Get(ctx, "a")
+	fileStorage.AddClick(ctx, "a", NoVariant)
+	link.Rules = []Rule{{Destination: "https://b.example"}}
+	fileStorage.Put(ctx, link)
+	link, _ = fileStorage.Get(ctx, "a")
+	assert.Equal(t, int64(2), link.Clicks, "clicks counted after the link is read are kept")
+	require.NoError(t, fileStorage.Close())
+
+	reopened := NewFileStorage(path)
+	defer reopened.Close()
+	link, _ = reopened.Get(ctx, "a")
+	assert.Equal(t, int64(2), link.Clicks)
+	assert.Len(t, link.Rules, 1)
+}
+
+func TestFileStorageBatchesClicks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.log")
+	fileStorage := NewFileStorage(path, WithClickFlushInterval(0))
+	fileStorage.Put(ctx, Link{ID: "a", URL: "https://a.example", Variants: []Variant{{Destination: "a", Weight: 1}, {Destination: "b", Weight: 1}}})
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fileStorage.AddClick(ctx, "a", i%2)
+		}(i)
+	}
+	wg.Wait()
+
+	link, _ := fileStorage.Get(ctx, "a")
+	assert.Equal(t, int64(100), link.Clicks)
+	assert.Equal(t, int64(50), link.Variants[1].Clicks)
+	assert.Equal(t, int64(1), fileStorage.Stats(ctx).Records, "clicks are not written one by one")
+	require.NoError(t, fileStorage.Close())
+	assert.Equal(t, int64(2), fileStorage.Stats(ctx).Records)
+
+	reopened := NewFileStorage(path, WithClickFlushInterval(10*time.Millisecond))
+	defer reopened.Close()
+	link, _ = reopened.Get(ctx, "a")
+	assert.Equal(t, int64(100), link.Clicks)
+	assert.Equal(t, []Variant{{Destination: "a", Weight: 1, Clicks: 50}, {Destination: "b", Weight: 1, Clicks: 50}}, link.Variants)
+	reopened.AddClick(ctx, "a", NoVariant)
+	assert.Eventually(t, func() bool { return reopened.Stats(ctx).Records == 3 }, time.Second, 5*time.Millisecond,
+		"clicks are written every interval")
 }
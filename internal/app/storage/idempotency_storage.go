@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// purgeInterval is how many puts happen between scans for expired responses
+	purgeInterval = 1024
+	// minCompactionRecords keeps small logs from being rewritten too often
+	minCompactionRecords = 1024
+
+	// DefaultIdempotentResponses and DefaultIdempotentBytes bound the responses kept by default
+	DefaultIdempotentResponses = 100000
+	DefaultIdempotentBytes     = 256 << 20
+)
+
+// IdempotentResponse is the response to the first request made with an idempotency key,
+// which is served again to repeated requests until it expires
+type IdempotentResponse struct {
+	// Key identifies the caller together with the idempotency key
+	Key string `json:"key"`
+	// Fingerprint tells repeats from different requests reusing the key
+	Fingerprint string              `json:"fingerprint"`
+	Status      int                 `json:"status"`
+	Header      map[string][]string `json:"header,omitempty"`
+	Body        []byte              `json:"body,omitempty"`
+	ExpiresAt   time.Time           `json:"expires_at"`
+}
+
+func (r IdempotentResponse) expired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// size is about the memory the response takes
+func (r IdempotentResponse) size() int64 {
+	size := len(r.Key) + len(r.Fingerprint) + len(r.Body)
+	for name, values := range r.Header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+// IdempotencyStorage keeps responses until they expire; expired ones are never returned
+type IdempotencyStorage interface {
+	GetResponse(ctx context.Context, key string) (IdempotentResponse, bool)
+	PutResponse(ctx context.Context, response IdempotentResponse) error
+}
+
+// IdempotencyOption customizes the storages built by NewMemoryIdempotencyStorage and NewFileIdempotencyStorage
+type IdempotencyOption func(*idempotentResponses)
+
+// WithIdempotencyCapacity bounds the number of responses and the bytes they take, evicting the least recently
+// used responses beyond either bound; the defaults are DefaultIdempotentResponses and DefaultIdempotentBytes.
+// Requests whose responses are evicted are made again when they are repeated
+func WithIdempotencyCapacity(responses int, bytes int64) IdempotencyOption {
+	return func(r *idempotentResponses) {
+		if responses > 0 {
+			r.capacity = responses
+		}
+		if bytes > 0 {
+			r.maxBytes = bytes
+		}
+	}
+}
+
+type MemoryIdempotencyStorage struct {
+	responses *idempotentResponses
+	puts      int
+	mtx       sync.Mutex
+}
+
+var _ IdempotencyStorage = &MemoryIdempotencyStorage{}
+
+func NewMemoryIdempotencyStorage(opts ...IdempotencyOption) *MemoryIdempotencyStorage {
+	return &MemoryIdempotencyStorage{responses: newIdempotentResponses(opts)}
+}
+
+func (s *MemoryIdempotencyStorage) GetResponse(_ context.Context, key string) (IdempotentResponse, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.responses.get(key, time.Now())
+}
+
+func (s *MemoryIdempotencyStorage) PutResponse(_ context.Context, response IdempotentResponse) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.responses.put(response)
+	s.puts++
+	if s.puts%purgeInterval == 0 {
+		s.responses.purgeExpired(time.Now())
+	}
+	return nil
+}
+
+// idempotentResponses keeps responses from the most to the least recently used, within the bounds
+// of WithIdempotencyCapacity; it is guarded by the storage holding it
+type idempotentResponses struct {
+	capacity int
+	maxBytes int64
+	bytes    int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newIdempotentResponses(opts []IdempotencyOption) *idempotentResponses {
+	r := &idempotentResponses{
+		capacity: DefaultIdempotentResponses,
+		maxBytes: DefaultIdempotentBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	return r
+}
+
+func (r *idempotentResponses) get(key string, now time.Time) (IdempotentResponse, bool) {
+	element, ok := r.entries[key]
+	if !ok {
+		return IdempotentResponse{}, false
+	}
+	response := element.Value.(IdempotentResponse)
+	if response.expired(now) {
+		return IdempotentResponse{}, false
+	}
+	r.order.MoveToFront(element)
+	return response, true
+}
+
+// put keeps the response, replacing the one of the same key, and evicts the least recently used ones
+// beyond the bounds, the response itself if it is larger than all of them
+func (r *idempotentResponses) put(response IdempotentResponse) {
+	if element, ok := r.entries[response.Key]; ok {
+		r.remove(element)
+	}
+	r.entries[response.Key] = r.order.PushFront(response)
+	r.bytes += response.size()
+	for r.order.Len() > r.capacity || r.bytes > r.maxBytes {
+		r.remove(r.order.Back())
+	}
+}
+
+func (r *idempotentResponses) remove(element *list.Element) {
+	response := r.order.Remove(element).(IdempotentResponse)
+	delete(r.entries, response.Key)
+	r.bytes -= response.size()
+}
+
+func (r *idempotentResponses) purgeExpired(now time.Time) {
+	for element := r.order.Back(); element != nil; {
+		prev := element.Prev()
+		if element.Value.(IdempotentResponse).expired(now) {
+			r.remove(element)
+		}
+		element = prev
+	}
+}
+
+// all lists the responses from the least to the most recently used, the order in which they are put back
+func (r *idempotentResponses) all() []IdempotentResponse {
+	responses := make([]IdempotentResponse, 0, r.order.Len())
+	for element := r.order.Back(); element != nil; element = element.Prev() {
+		responses = append(responses, element.Value.(IdempotentResponse))
+	}
+	return responses
+}
+
+func (r *idempotentResponses) len() int {
+	return r.order.Len()
+}
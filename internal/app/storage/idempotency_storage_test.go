@@ -0,0 +1,99 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileIdempotencyStorage(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "idempotency")
+	s, err := NewFileIdempotencyStorage(path)
+	require.NoError(t, err)
+
+	live := IdempotentResponse{Key: "live", Fingerprint: "f", Status: 201, Body: []byte("body"), ExpiresAt: time.Now().Add(time.Hour)}
+	require.NoError(t, s.PutResponse(ctx, live))
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "expired", ExpiresAt: time.Now().Add(-time.Second)}))
+	_, ok := s.GetResponse(ctx, "expired")
+	assert.False(t, ok)
+	require.NoError(t, s.Close())
+
+	reopened, err := NewFileIdempotencyStorage(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	got, ok := reopened.GetResponse(ctx, "live")
+	assert.True(t, ok)
+	assert.Equal(t, live.Body, got.Body)
+	assert.Equal(t, 201, got.Status)
+	assert.Equal(t, 1, reopened.responses.len(), "expired responses are compacted away")
+}
+
+func TestMemoryIdempotencyStorageEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	s := NewMemoryIdempotencyStorage(WithIdempotencyCapacity(2, 0))
+
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "a", ExpiresAt: expiresAt}))
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "b", ExpiresAt: expiresAt}))
+	_, ok := s.GetResponse(ctx, "a")
+	require.True(t, ok)
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "c", ExpiresAt: expiresAt}))
+
+	_, ok = s.GetResponse(ctx, "b")
+	assert.False(t, ok, "the least recently used response is evicted")
+	_, ok = s.GetResponse(ctx, "a")
+	assert.True(t, ok)
+	_, ok = s.GetResponse(ctx, "c")
+	assert.True(t, ok)
+}
+
+func TestMemoryIdempotencyStorageBoundsBytes(t *testing.T) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour)
+	body := make([]byte, 100)
+	s := NewMemoryIdempotencyStorage(WithIdempotencyCapacity(0, 250))
+
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: key, Body: body, ExpiresAt: expiresAt}))
+	}
+	assert.Equal(t, 2, s.responses.len())
+	assert.LessOrEqual(t, s.responses.bytes, int64(250))
+	_, ok := s.GetResponse(ctx, "a")
+	assert.False(t, ok)
+
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "huge", Body: make([]byte, 300), ExpiresAt: expiresAt}))
+	_, ok = s.GetResponse(ctx, "huge")
+	assert.False(t, ok, "a response larger than the bound is not kept")
+	assert.Equal(t, int64(0), s.responses.bytes)
+
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "d", Body: body, ExpiresAt: expiresAt}))
+	require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: "d", Body: body, ExpiresAt: expiresAt}))
+	assert.Equal(t, 1, s.responses.len())
+	assert.Equal(t, int64(101), s.responses.bytes, "a replaced response is no longer counted")
+}
+
+func TestFileIdempotencyStorageKeepsCapacityWhenReopened(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "idempotency")
+	expiresAt := time.Now().Add(time.Hour)
+	s, err := NewFileIdempotencyStorage(path)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		require.NoError(t, s.PutResponse(ctx, IdempotentResponse{Key: key, ExpiresAt: expiresAt}))
+	}
+	require.NoError(t, s.Close())
+
+	reopened, err := NewFileIdempotencyStorage(path, WithIdempotencyCapacity(2, 0))
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 2, reopened.records, "evicted responses are compacted away")
+	_, ok := reopened.GetResponse(ctx, "a")
+	assert.False(t, ok)
+	_, ok = reopened.GetResponse(ctx, "c")
+	assert.True(t, ok)
+}
@@ -0,0 +1,96 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// APIKey is a credential of a programmatic client; only the hash of its secret token is kept
+type APIKey struct {
+	ID        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Name      string    `json:"name"`
+	UserID    string    `json:"user_id"`
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	Revoked   bool      `json:"revoked,omitempty"`
+}
+
+// ErrKeyExists is returned by PutKey when a key with the same ID is already stored
+var ErrKeyExists = errors.New("API key ID is already taken")
+
+// KeyStorage keeps API keys; PutKey adds a new key and never replaces a stored one
+type KeyStorage interface {
+	PutKey(ctx context.Context, key APIKey) error
+	GetKeyByHash(ctx context.Context, hash string) (APIKey, bool)
+	ListKeys(ctx context.Context) []APIKey
+	RevokeKey(ctx context.Context, id string) (bool, error)
+}
+
+type MemoryKeyStorage struct {
+	keys map[string]APIKey
+	mtx  sync.RWMutex
+}
+
+var _ KeyStorage = &MemoryKeyStorage{}
+
+func NewMemoryKeyStorage() *MemoryKeyStorage {
+	return &MemoryKeyStorage{keys: make(map[string]APIKey)}
+}
+
+func (s *MemoryKeyStorage) PutKey(_ context.Context, key APIKey) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.keys[key.ID]; ok {
+		return ErrKeyExists
+	}
+	s.keys[key.ID] = key
+	return nil
+}
+
+func (s *MemoryKeyStorage) GetKeyByHash(_ context.Context, hash string) (APIKey, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return findKeyByHash(s.keys, hash)
+}
+
+func (s *MemoryKeyStorage) ListKeys(context.Context) []APIKey {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	return sortedKeys(s.keys)
+}
+
+func (s *MemoryKeyStorage) RevokeKey(_ context.Context, id string) (bool, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return false, nil
+	}
+	key.Revoked = true
+	s.keys[id] = key
+	return true, nil
+}
+
+func findKeyByHash(keys map[string]APIKey, hash string) (APIKey, bool) {
+	for _, key := range keys {
+		if key.Hash == hash {
+			return key, true
+		}
+	}
+	return APIKey{}, false
+}
+
+func sortedKeys(keys map[string]APIKey) []APIKey {
+	result := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, key)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result
+}
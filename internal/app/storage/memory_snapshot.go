@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+// snapshots write the links of a memory storage to a file, which has the format of a compacted storage log,
+// and the keys of the evicted links
+type snapshots struct {
+	path     string
+	interval time.Duration
+
+	// mtx serializes the writes, whose last error and size it guards
+	mtx   sync.Mutex
+	err   error
+	bytes int64
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// WithSnapshots restores the links from the snapshot at the path, if there is one, and writes them to it
+// every interval, if it is positive, and on Close. Snapshots replace the file at once, so that a crash loses
+// the changes since the last one only. Links which are restored count as used at startup
+func WithSnapshots(path string, interval time.Duration) MemoryOption {
+	return func(s *MemoryStorage) {
+		s.snapshots = &snapshots{
+			path:     path,
+			interval: interval,
+			stop:     make(chan struct{}),
+			stopped:  make(chan struct{}),
+		}
+	}
+}
+
+// restore puts the links of the snapshot in the order they were used. A snapshot which cannot be read stops
+// the process, as the next snapshot would overwrite it
+func (s *MemoryStorage) restore() {
+	ctx := context.Background()
+	path := s.snapshots.path
+	checkDirExistOrCreate(path)
+	links := make(map[string]Link)
+	var order, evicted []string
+	err := scanFile(path, func(line int, r *record, err error) error {
+		if errors.Is(err, errTornLine) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		applyRecord(links, r)
+		switch r.Op {
+		case opPut:
+			order = append(order, r.Hash)
+		case opEvict:
+			evicted = append(evicted, r.Hash)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		logger.Error(ctx, "could not restore memory storage snapshot", "path", path, "error", err)
+		os.Exit(1)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	now := s.now()
+	for _, key := range evicted {
+		s.keepEvicted(key, now)
+	}
+	for _, key := range order {
+		s.put(links[key])
+	}
+	logger.Info(ctx, "memory storage snapshot is restored", "path", path, "links", len(links))
+}
+
+func (sn *snapshots) start(s *MemoryStorage) {
+	if sn.interval <= 0 {
+		close(sn.stopped)
+		return
+	}
+	go func() {
+		defer close(sn.stopped)
+		ticker := time.NewTicker(sn.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.snapshot(); err != nil {
+					logger.Error(context.Background(), "could not write memory storage snapshot", "path", sn.path, "error", err)
+				}
+			case <-sn.stop:
+				return
+			}
+		}
+	}()
+}
+
+// snapshot writes the links from the least to the most recently used, so that restoring them keeps their order
+func (s *MemoryStorage) snapshot() error {
+	sn := s.snapshots
+	sn.mtx.Lock()
+	defer sn.mtx.Unlock()
+	sn.err = writeRecordsFile(sn.path, s.snapshotRecords())
+	if sn.err != nil {
+		return sn.err
+	}
+	if info, err := os.Stat(sn.path); err == nil {
+		sn.bytes = info.Size()
+	}
+	return nil
+}
+
+// snapshotRecords lists the kept keys of the evicted links from the oldest, then the links from the least
+// to the most recently used, or by creation for unbounded storages
+func (s *MemoryStorage) snapshotRecords() []*record {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	evicted := s.evicted.keys()
+	records := make([]*record, 0, len(evicted))
+	for _, key := range evicted {
+		records = append(records, &record{Op: opEvict, Hash: key})
+	}
+	if s.recency != nil {
+		for _, key := range s.recency.keys() {
+			if value, ok := s.concurrentMap.Load(key); ok {
+				records = append(records, linkRecord(value.(*memoryLink).get()))
+			}
+		}
+		return records
+	}
+	var links []Link
+	s.concurrentMap.Range(func(_, value interface{}) bool {
+		links = append(links, value.(*memoryLink).get())
+		return true
+	})
+	SortLinks(links)
+	for _, link := range links {
+		records = append(records, linkRecord(link))
+	}
+	return records
+}
+
+func (sn *snapshots) size() int64 {
+	sn.mtx.Lock()
+	defer sn.mtx.Unlock()
+	return sn.bytes
+}
+
+// Check returns the error of the last snapshot, if it failed
+func (s *MemoryStorage) Check(context.Context) error {
+	if s.snapshots == nil {
+		return nil
+	}
+	s.snapshots.mtx.Lock()
+	defer s.snapshots.mtx.Unlock()
+	return s.snapshots.err
+}
+
+// Close stops the periodic snapshots and writes the last one
+func (s *MemoryStorage) Close() error {
+	if s.snapshots == nil {
+		return nil
+	}
+	s.snapshots.stopOnce.Do(func() {
+		close(s.snapshots.stop)
+	})
+	<-s.snapshots.stopped
+	return s.snapshot()
+}
@@ -1,27 +1,309 @@
 package storage
 
-import "sync"
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultEvictedKeys is how many keys of evicted links are kept by storages bounded by a TTL only
+const DefaultEvictedKeys = 1 << 16
 
 type MemoryStorage struct {
 	concurrentMap sync.Map
+	// mtx serializes changes of links, so that they are counted right; reads and clicks do not take it
+	mtx     sync.Mutex
+	counter linkCounter
+
+	// capacity and ttl bound the links, which recency orders by use if either is set
+	capacity  int
+	ttl       time.Duration
+	now       func() time.Time
+	recency   *recency
+	evictions uint64
+	// evicted keeps the keys of the latest evicted links, up to evictedLimit, which are not reissued,
+	// so that their short URLs do not lead to other destinations
+	evicted      *recency
+	evictedLimit int
+	onExpire     func(Link)
+
+	snapshots *snapshots
+}
+
+var (
+	_ Storage       = &MemoryStorage{}
+	_ Checker       = &MemoryStorage{}
+	_ StatsReporter = &MemoryStorage{}
+	_ KeyWalker     = &MemoryStorage{}
+	_ Expirer       = &MemoryStorage{}
+	_ io.Closer     = &MemoryStorage{}
+)
+
+// memoryLink keeps the click counters apart so that they can be incremented without replacing the map entry;
+// entries replacing the link share them, so that clicks counted on a replaced entry are not lost
+type memoryLink struct {
+	link     Link
+	counters *clickCounters
+}
+
+// MemoryOption customizes the storage built by NewMemoryStorage
+type MemoryOption func(*MemoryStorage)
+
+// WithCapacity bounds the number of links, deleted ones included, evicting the least recently used links
+// beyond it; links are used when they are put or looked up. The keys of as many evicted links are kept,
+// see PutIfAbsent and WithEvictedKeys
+func WithCapacity(capacity int) MemoryOption {
+	return func(s *MemoryStorage) {
+		s.capacity = capacity
+	}
+}
+
+// WithTTL evicts the links which are not used for the TTL
+func WithTTL(ttl time.Duration) MemoryOption {
+	return func(s *MemoryStorage) {
+		s.ttl = ttl
+	}
+}
+
+// WithEvictedKeys bounds the keys of evicted links which are kept, so that they are not reissued; older ones
+// are forgotten. It defaults to the capacity, or to DefaultEvictedKeys for storages bounded by a TTL only
+func WithEvictedKeys(limit int) MemoryOption {
+	return func(s *MemoryStorage) {
+		s.evictedLimit = limit
+	}
+}
+
+// NewMemoryStorage keeps the links in memory only, without a bound unless WithCapacity or WithTTL is given,
+// and without persistence unless WithSnapshots is given
+func NewMemoryStorage(opts ...MemoryOption) *MemoryStorage {
+	s := &MemoryStorage{now: time.Now, evicted: newRecency()}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.capacity > 0 || s.ttl > 0 {
+		s.recency = newRecency()
+	}
+	if s.evictedLimit <= 0 {
+		s.evictedLimit = s.capacity
+		if s.evictedLimit <= 0 {
+			s.evictedLimit = DefaultEvictedKeys
+		}
+	}
+	if s.snapshots != nil {
+		s.restore()
+		s.snapshots.start(s)
+	}
+	return s
+}
+
+// Put keeps the clicks of the link it replaces, if any
+func (s *MemoryStorage) Put(_ context.Context, link Link) string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.put(link)
+	return link.ID
+}
+
+// PutIfAbsent takes the kept keys of evicted links for used ones, so that links put under generated IDs
+// or aliases do not take over the short URLs of evicted links
+func (s *MemoryStorage) PutIfAbsent(_ context.Context, link Link) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.recency != nil {
+		// an expired link frees its key
+		s.evict(s.now())
+	}
+	if _, taken := s.concurrentMap.Load(link.Key()); taken {
+		return false
+	}
+	if s.evicted.has(link.Key()) {
+		return false
+	}
+	s.put(link)
+	return true
+}
+
+// put stores the link, evicting others if it makes the storage exceed its bounds; mtx must be held
+func (s *MemoryStorage) put(link Link) {
+	if value, existed := s.concurrentMap.Load(link.Key()); existed {
+		old := value.(*memoryLink)
+		s.concurrentMap.Store(link.Key(), old.replace(link))
+		s.counter.replace(old.link, link)
+	} else {
+		s.concurrentMap.Store(link.Key(), newMemoryLink(link))
+		s.counter.add(link, 1)
+		s.evicted.remove(link.Key())
+	}
+	if s.recency != nil {
+		now := s.now()
+		s.recency.push(link.Key(), now)
+		s.evict(now)
+	}
+}
+
+func (s *MemoryStorage) Get(_ context.Context, key string) (Link, bool) {
+	value, ok := s.concurrentMap.Load(key)
+	if !ok {
+		return Link{}, false
+	}
+	if s.recency != nil && !s.recency.touch(key, s.now(), s.ttl) {
+		// the link expired, unless it is put again meanwhile
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+		s.evict(s.now())
+		if value, ok = s.concurrentMap.Load(key); !ok {
+			return Link{}, false
+		}
+	}
+	return value.(*memoryLink).get(), true
+}
+
+// OnExpire has fn called with the links which expire, once the storage finds them unused for the TTL;
+// it is called with the storage locked, so it must not call the storage
+func (s *MemoryStorage) OnExpire(fn func(link Link)) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.onExpire = fn
+}
+
+// evict drops the least recently used links while there are more than the capacity, and the expired ones;
+// mtx must be held
+func (s *MemoryStorage) evict(now time.Time) {
+	for {
+		key, used, ok := s.recency.oldest()
+		if !ok {
+			return
+		}
+		overflow := s.capacity > 0 && s.recency.len() > s.capacity
+		expired := s.ttl > 0 && !now.Before(used.Add(s.ttl))
+		if !overflow && !expired {
+			return
+		}
+		if value, ok := s.concurrentMap.Load(key); ok {
+			link := value.(*memoryLink)
+			s.counter.add(link.link, -1)
+			s.concurrentMap.Delete(key)
+			if expired && s.onExpire != nil {
+				s.onExpire(link.get())
+			}
+		}
+		s.recency.remove(key)
+		s.keepEvicted(key, now)
+		atomic.AddUint64(&s.evictions, 1)
+	}
+}
+
+// keepEvicted keeps the key of an evicted link, forgetting the oldest ones beyond the limit; mtx must be held
+func (s *MemoryStorage) keepEvicted(key string, now time.Time) {
+	s.evicted.push(key, now)
+	for s.evicted.len() > s.evictedLimit {
+		oldest, _, _ := s.evicted.oldest()
+		s.evicted.remove(oldest)
+	}
+}
+
+// evictExpired drops the expired links before the links are listed or counted
+func (s *MemoryStorage) evictExpired() {
+	if s.recency == nil || s.ttl <= 0 {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.evict(s.now())
 }
 
-var _ Storage = &MemoryStorage{}
+func (s *MemoryStorage) GetByUser(_ context.Context, userID string) []Link {
+	s.evictExpired()
+	var links []Link
+	s.concurrentMap.Range(func(_, value interface{}) bool {
+		link := value.(*memoryLink).get()
+		if link.UserID == userID && !link.Deleted {
+			links = append(links, link)
+		}
+		return true
+	})
+	return links
+}
+
+func (s *MemoryStorage) Delete(_ context.Context, userID string, keys []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	for _, key := range keys {
+		value, ok := s.concurrentMap.Load(key)
+		if !ok {
+			continue
+		}
+		old := value.(*memoryLink)
+		link := old.link
+		if link.UserID != userID || link.Deleted {
+			continue
+		}
+		s.counter.add(link, -1)
+		link.Deleted = true
+		s.concurrentMap.Store(key, old.replace(link))
+	}
+}
+
+func (s *MemoryStorage) CountLinks(context.Context) int {
+	s.evictExpired()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.counter.links
+}
+
+func (s *MemoryStorage) CountUsers(context.Context) int {
+	s.evictExpired()
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.counter.users)
+}
 
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{}
+func (s *MemoryStorage) AddClick(_ context.Context, key string, variant int) {
+	value, ok := s.concurrentMap.Load(key)
+	if !ok {
+		return
+	}
+	value.(*memoryLink).counters.add(variant)
 }
 
-func (s *MemoryStorage) Put(id string, originalURL string) string {
-	s.concurrentMap.Store(id, originalURL)
-	return id
+// Stats count the links and, for bounded storages, the links evicted since the storage is made
+func (s *MemoryStorage) Stats(context.Context) Stats {
+	s.evictExpired()
+	stats := Stats{Evictions: atomic.LoadUint64(&s.evictions)}
+	s.concurrentMap.Range(func(_, _ interface{}) bool {
+		stats.Links++
+		return true
+	})
+	if s.snapshots != nil {
+		stats.SnapshotBytes = s.snapshots.size()
+	}
+	return stats
 }
 
-func (s *MemoryStorage) Get(id string) (string, bool) {
-	value, ok := s.concurrentMap.Load(id)
-	originalURL := ""
-	if ok {
-		originalURL = value.(string)
+// WalkKeys lists the kept keys of evicted links too, as they are not reissued
+func (s *MemoryStorage) WalkKeys(_ context.Context, fn func(key string)) error {
+	s.evictExpired()
+	s.concurrentMap.Range(func(key, _ interface{}) bool {
+		fn(key.(string))
+		return true
+	})
+	for _, key := range s.evicted.keys() {
+		fn(key)
 	}
-	return originalURL, ok
+	return nil
+}
+
+func newMemoryLink(link Link) *memoryLink {
+	return &memoryLink{link: link, counters: newClickCounters(len(link.Variants))}
+}
+
+// replace makes an entry of the link sharing the click counters of this one
+func (l *memoryLink) replace(link Link) *memoryLink {
+	return &memoryLink{link: keepClicks(link, l.link), counters: l.counters}
+}
+
+func (l *memoryLink) get() Link {
+	return l.counters.addTo(l.link)
 }
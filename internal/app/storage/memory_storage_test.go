@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorageKeepsClicksOfReplacedLinks(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage()
+	link := Link{ID: "a", URL: "https://a.example", UserID: "user", Variants: []Variant{{Destination: "b", Weight: 1}}}
+	s.Put(ctx, link)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 250; j++ {
+				s.AddClick(ctx, "a", 0)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		link.Rules = []Rule{{Destination: "https://b.example"}}
+		s.Put(ctx, link)
+	}
+	s.Delete(ctx, "user", []string{"a"})
+	wg.Wait()
+
+	got, _ := s.Get(ctx, "a")
+	assert.True(t, got.Deleted)
+	assert.Equal(t, int64(1000), got.Clicks)
+	assert.Equal(t, int64(1000), got.Variants[0].Clicks)
+}
+
+func TestMemoryStorageEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage(WithCapacity(2))
+	s.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	s.Put(ctx, Link{ID: "b", URL: "https://b.example", UserID: "another user"})
+	s.Get(ctx, "a")
+	s.Put(ctx, Link{ID: "c", URL: "https://c.example", UserID: "user"})
+
+	_, ok := s.Get(ctx, "b")
+	assert.False(t, ok, "b is evicted as the least recently used")
+	_, ok = s.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.Equal(t, 2, s.CountLinks(ctx))
+	assert.Equal(t, 1, s.CountUsers(ctx), "evicted links are counted out")
+	assert.Equal(t, Stats{Links: 2, Evictions: 1}, s.Stats(ctx))
+}
+
+func TestMemoryStorageKeepsKeysOfEvictedLinks(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "links.snapshot")
+	s := NewMemoryStorage(WithCapacity(1), WithSnapshots(path, 0))
+	s.Put(ctx, Link{ID: "a", URL: "https://a.example"})
+	s.Put(ctx, Link{ID: "b", URL: "https://b.example"})
+	assert.False(t, s.PutIfAbsent(ctx, Link{ID: "a", URL: "https://c.example"}), "the key of an evicted link is not reissued")
+	var keys []string
+	require.NoError(t, s.WalkKeys(ctx, func(key string) { keys = append(keys, key) }))
+	assert.ElementsMatch(t, []string{"a", "b"}, keys)
+	require.NoError(t, s.Close())
+
+	restored := NewMemoryStorage(WithCapacity(1), WithSnapshots(path, 0))
+	defer restored.Close()
+	_, ok := restored.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.False(t, restored.PutIfAbsent(ctx, Link{ID: "a", URL: "https://c.example"}), "evicted keys survive restarts")
+	assert.True(t, restored.PutIfAbsent(ctx, Link{ID: "c", URL: "https://c.example"}))
+
+	report, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems)
+}
+
+func TestMemoryStorageForgetsOldestKeysOfEvictedLinks(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStorage(WithCapacity(1), WithEvictedKeys(2))
+	s.OnExpire(func(link Link) { t.Errorf("%s is evicted beyond the capacity, it does not expire", link.ID) })
+	for _, id := range []string{"a", "b", "c", "d"} {
+		s.Put(ctx, Link{ID: id, URL: "https://" + id + ".example"})
+	}
+	assert.Equal(t, []string{"b", "c"}, s.evicted.keys())
+	assert.False(t, s.PutIfAbsent(ctx, Link{ID: "b", URL: "https://e.example"}))
+	assert.True(t, s.PutIfAbsent(ctx, Link{ID: "a", URL: "https://e.example"}), "the oldest key is forgotten")
+	assert.Equal(t, 2, s.evicted.len())
+
+	ttl := NewMemoryStorage(WithTTL(time.Minute))
+	assert.Equal(t, DefaultEvictedKeys, ttl.evictedLimit)
+}
+
+func TestMemoryStorageExpiresUnusedLinks(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryStorage(WithTTL(time.Minute))
+	s.now = func() time.Time { return now }
+	var expired []string
+	s.OnExpire(func(link Link) { expired = append(expired, link.ID) })
+	s.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	s.Put(ctx, Link{ID: "b", URL: "https://b.example", UserID: "user"})
+
+	now = now.Add(50 * time.Second)
+	_, ok := s.Get(ctx, "a")
+	assert.True(t, ok)
+	now = now.Add(50 * time.Second)
+	_, ok = s.Get(ctx, "a")
+	assert.True(t, ok, "lookups keep links")
+	assert.Len(t, s.GetByUser(ctx, "user"), 1, "b expires")
+	assert.Equal(t, 1, s.CountLinks(ctx))
+	assert.Equal(t, []string{"b"}, expired)
+
+	now = now.Add(time.Minute)
+	_, ok = s.Get(ctx, "a")
+	assert.False(t, ok)
+	assert.Equal(t, 0, s.CountUsers(ctx))
+	assert.Equal(t, []string{"b", "a"}, expired)
+}
+
+func TestMemoryStorageSnapshots(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "snapshots", "links.snapshot")
+	s := NewMemoryStorage(WithCapacity(2), WithSnapshots(path, 0))
+	s.Put(ctx, Link{ID: "a", URL: "https://a.example", UserID: "user"})
+	s.Put(ctx, Link{ID: "b", URL: "https://b.example", UserID: "user"})
+	s.AddClick(ctx, "b", NoVariant)
+	s.Get(ctx, "a")
+	s.Delete(ctx, "user", []string{"a"})
+	require.NoError(t, s.Close())
+	assert.NoError(t, s.Check(ctx))
+	assert.Positive(t, s.Stats(ctx).SnapshotBytes)
+
+	restored := NewMemoryStorage(WithCapacity(2), WithSnapshots(path, time.Hour))
+	defer restored.Close()
+	link, ok := restored.Get(ctx, "a")
+	assert.True(t, ok)
+	assert.True(t, link.Deleted)
+	link, _ = restored.Get(ctx, "b")
+	assert.Equal(t, int64(1), link.Clicks)
+	assert.Equal(t, 1, restored.CountLinks(ctx))
+
+	// b is used last, so a is evicted first
+	restored.Put(ctx, Link{ID: "c", URL: "https://c.example"})
+	_, ok = restored.Get(ctx, "a")
+	assert.False(t, ok)
+
+	report, err := VerifyFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, report.Problems, "snapshots are compacted storage logs")
+}
+
+func TestMemoryStorageSnapshotFailureFailsCheck(t *testing.T) {
+	dir := t.TempDir()
+	s := NewMemoryStorage(WithSnapshots(filepath.Join(dir, "links.snapshot"), 0))
+	s.snapshots.path = filepath.Join(dir, "missing", "links.snapshot")
+	assert.Error(t, s.Close())
+	assert.Error(t, s.Check(context.Background()))
+}
@@ -1,8 +1,9 @@
 package mocks
 
 import (
-	"log"
+	"context"
 
+	"github.com/tsupko/shortener/internal/app/logger"
 	"github.com/tsupko/shortener/internal/app/storage"
 )
 
@@ -12,15 +13,33 @@ type MockStorage struct {
 
 var _ storage.Storage = &MockStorage{}
 
-func (m *MockStorage) Put(id string, _ string) string {
-	return id
+func (m *MockStorage) Put(_ context.Context, link storage.Link) string {
+	return link.ID
 }
 
-func (m *MockStorage) Get(id string) (string, bool) {
-	log.Default().Println("mock storage: got with id:", id)
+func (m *MockStorage) Get(ctx context.Context, id string) (storage.Link, bool) {
+	logger.Debug(ctx, "mock storage: got", "id", id)
 	if m.requestCount > 0 {
-		return "", false
+		return storage.Link{}, false
 	}
 	m.requestCount++
-	return "idExists", true
+	return storage.Link{ID: id, URL: "idExists"}, true
+}
+
+func (m *MockStorage) GetByUser(context.Context, string) []storage.Link {
+	return nil
+}
+
+func (m *MockStorage) Delete(context.Context, string, []string) {
+}
+
+func (m *MockStorage) AddClick(context.Context, string, int) {
+}
+
+func (m *MockStorage) CountLinks(context.Context) int {
+	return 0
+}
+
+func (m *MockStorage) CountUsers(context.Context) int {
+	return 0
 }
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// recency orders keys from the most to the least recently used, for the eviction of bounded storages
+type recency struct {
+	mtx     sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type recentKey struct {
+	key  string
+	used time.Time
+}
+
+func newRecency() *recency {
+	return &recency{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// push marks the key as used, adding it if it is new
+func (r *recency) push(key string, now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if element, ok := r.entries[key]; ok {
+		element.Value.(*recentKey).used = now
+		r.order.MoveToFront(element)
+		return
+	}
+	r.entries[key] = r.order.PushFront(&recentKey{key: key, used: now})
+}
+
+// touch marks a known key as used unless it is unused for the TTL, in which case it returns false and leaves
+// the key to eviction; unknown keys, evicted meanwhile, are left alone
+func (r *recency) touch(key string, now time.Time, ttl time.Duration) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	element, ok := r.entries[key]
+	if !ok {
+		return true
+	}
+	recent := element.Value.(*recentKey)
+	if ttl > 0 && !now.Before(recent.used.Add(ttl)) {
+		return false
+	}
+	recent.used = now
+	r.order.MoveToFront(element)
+	return true
+}
+
+func (r *recency) has(key string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, ok := r.entries[key]
+	return ok
+}
+
+func (r *recency) remove(key string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if element, ok := r.entries[key]; ok {
+		r.order.Remove(element)
+		delete(r.entries, key)
+	}
+}
+
+// oldest returns the least recently used key
+func (r *recency) oldest() (string, time.Time, bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	element := r.order.Back()
+	if element == nil {
+		return "", time.Time{}, false
+	}
+	recent := element.Value.(*recentKey)
+	return recent.key, recent.used, true
+}
+
+func (r *recency) len() int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.order.Len()
+}
+
+// keys lists the keys from the least to the most recently used
+func (r *recency) keys() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	keys := make([]string, 0, r.order.Len())
+	for element := r.order.Back(); element != nil; element = element.Prev() {
+		keys = append(keys, element.Value.(*recentKey).key)
+	}
+	return keys
+}
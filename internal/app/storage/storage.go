@@ -1,6 +1,175 @@
 package storage
 
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Link is a shortened URL together with its metadata
+type Link struct {
+	ID        string
+	Domain    string
+	URL       string
+	UserID    string
+	CreatedAt time.Time
+	Deleted   bool
+	Clicks    int64
+	Options   LinkOptions
+	Rules     []Rule
+	Variants  []Variant
+}
+
+// NoVariant is passed to AddClick for clicks which were not served by a variant
+const NoVariant = -1
+
+// Variant is one of the weighted destinations a link is split across; each visitor sticks to the variant
+// picked on the first visit
+type Variant struct {
+	Destination string `json:"destination"`
+	// Weight is the share of visitors relative to the total weight of the variants of the link
+	Weight int `json:"weight"`
+	// Clicks is counted by the storage and is not accepted from clients
+	Clicks int64 `json:"-"`
+}
+
+// Rule sends visitors matching all of its conditions to its own destination;
+// rules of a link are evaluated in order and the first matching one wins
+type Rule struct {
+	Destination string `json:"destination"`
+	// Platforms are operating systems detected from the User-Agent: ios, android, windows, macos, linux or other
+	Platforms []string `json:"platforms,omitempty"`
+	// Languages are matched against the Accept-Language header, `de` also matches `de-AT`
+	Languages []string `json:"languages,omitempty"`
+	// After and Before bound the time window the rule is active in
+	After  *time.Time `json:"after,omitempty"`
+	Before *time.Time `json:"before,omitempty"`
+	// Headers must all be present with the given values compared case-insensitively, `*` matches any value
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Query passthrough policies, deciding which value wins when a parameter is both in the destination and in the request
+const (
+	PassQueryLink    = "link"
+	PassQueryRequest = "request"
+	PassQueryAppend  = "append"
+)
+
+// LinkOptions change how a link is followed
+type LinkOptions struct {
+	// Interstitial shows a warning page instead of redirecting to destinations outside the served domains
+	Interstitial bool `json:"interstitial,omitempty"`
+	// PassQuery merges the query of the request into the destination using one of the PassQuery policies
+	PassQuery string `json:"pass_query,omitempty"`
+	// PassPath appends the path segments following the ID in the request to the destination path
+	PassPath bool `json:"pass_path,omitempty"`
+}
+
+func (o LinkOptions) IsZero() bool {
+	return o == LinkOptions{}
+}
+
+// Key identifies a link within the storage: IDs are namespaced by domain, and links of the primary domain,
+// which is the empty one, are keyed by their bare ID
+func Key(domain, id string) string {
+	if domain == "" {
+		return id
+	}
+	return domain + "/" + id
+}
+
+func (l Link) Key() string {
+	return Key(l.Domain, l.ID)
+}
+
+// SortLinks orders links by creation, so that listings are stable
+func SortLinks(links []Link) {
+	sort.Slice(links, func(i, j int) bool {
+		if !links[i].CreatedAt.Equal(links[j].CreatedAt) {
+			return links[i].CreatedAt.Before(links[j].CreatedAt)
+		}
+		return links[i].Key() < links[j].Key()
+	})
+}
+
+// Storage keeps links by their keys, see Key
 type Storage interface {
-	Put(id string, url string) string
-	Get(id string) (string, bool)
+	Put(ctx context.Context, link Link) string
+	Get(ctx context.Context, key string) (Link, bool)
+	GetByUser(ctx context.Context, userID string) []Link
+	Delete(ctx context.Context, userID string, keys []string)
+	// AddClick counts a click of the link and of its variant with the given index unless it is NoVariant
+	AddClick(ctx context.Context, key string, variant int)
+	// CountLinks returns the number of links which are not deleted
+	CountLinks(ctx context.Context) int
+	// CountUsers returns the number of users owning links which are not deleted
+	CountUsers(ctx context.Context) int
+}
+
+// Inserter is implemented by storages which can check that a key is free and store a link under it at once
+type Inserter interface {
+	// PutIfAbsent stores the link unless there is one under its key, deleted or not; it tells whether it did
+	PutIfAbsent(ctx context.Context, link Link) bool
+}
+
+// PutIfAbsent stores the link unless there is one under its key, deleted or not, and returns its ID if it did;
+// storages which are not Inserters are checked first, so that concurrent calls may both store
+func PutIfAbsent(ctx context.Context, s Storage, link Link) (string, bool) {
+	if inserter, ok := s.(Inserter); ok {
+		if !inserter.PutIfAbsent(ctx, link) {
+			return "", false
+		}
+		return link.ID, true
+	}
+	if _, taken := s.Get(ctx, link.Key()); taken {
+		return "", false
+	}
+	return s.Put(ctx, link), true
+}
+
+// Expirer is implemented by storages whose links expire on their own
+type Expirer interface {
+	// OnExpire has fn called with every link which expires
+	OnExpire(fn func(link Link))
+}
+
+// Checker is implemented by storages depending on resources which may fail, such as files or databases
+type Checker interface {
+	// Check returns why the storage cannot serve, if it cannot
+	Check(ctx context.Context) error
+}
+
+// Loader is implemented by storages loading their data at startup, which may take a while
+type Loader interface {
+	Progress() LoadProgress
+}
+
+// LoadProgress tells how far a storage is in loading its data
+type LoadProgress struct {
+	Loaded     bool  `json:"loaded"`
+	Records    int64 `json:"records"`
+	Bytes      int64 `json:"bytes"`
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// KeyWalker is implemented by storages which can list the keys of their links, deleted ones included
+type KeyWalker interface {
+	WalkKeys(ctx context.Context, fn func(key string)) error
+}
+
+// StatsReporter is implemented by storages describing how they keep their data
+type StatsReporter interface {
+	Stats(ctx context.Context) Stats
+}
+
+// Stats describe how a storage keeps its data; Records, LogBytes, Segments and GarbageRatio are specific
+// to log-based storages, Evictions and SnapshotBytes to memory storages
+type Stats struct {
+	Links         int     `json:"links"`
+	Records       int64   `json:"records,omitempty"`
+	LogBytes      int64   `json:"log_bytes,omitempty"`
+	Segments      int     `json:"segments,omitempty"`
+	GarbageRatio  float64 `json:"garbage_ratio,omitempty"`
+	Evictions     uint64  `json:"evictions,omitempty"`
+	SnapshotBytes int64   `json:"snapshot_bytes,omitempty"`
 }
@@ -1,5 +1,7 @@
 package storage
 
+import "context"
+
 type TestStorage struct {
 }
 
@@ -7,13 +9,31 @@ func NewTestStorage() *TestStorage {
 	return &TestStorage{}
 }
 
-func (t TestStorage) Put(string, string) string {
+func (t TestStorage) Put(context.Context, Link) string {
 	return "12345"
 }
 
-func (t TestStorage) Get(id string) (string, bool) {
+func (t TestStorage) Get(_ context.Context, id string) (Link, bool) {
 	if id == "12345" {
-		return "https://ya.ru", true
+		return Link{ID: id, URL: "https://ya.ru"}, true
 	}
-	return "", false
+	return Link{}, false
+}
+
+func (t TestStorage) GetByUser(context.Context, string) []Link {
+	return nil
+}
+
+func (t TestStorage) Delete(context.Context, string, []string) {
+}
+
+func (t TestStorage) AddClick(context.Context, string, int) {
+}
+
+func (t TestStorage) CountLinks(context.Context) int {
+	return 1
+}
+
+func (t TestStorage) CountUsers(context.Context) int {
+	return 0
 }
@@ -2,10 +2,11 @@ package util
 
 import (
 	"io"
-	"log"
 	"math/rand"
 	"net/http"
 	"time"
+
+	"github.com/tsupko/shortener/internal/app/logger"
 )
 
 const (
@@ -33,7 +34,7 @@ func ReadRequestBody(r *http.Request) (string, error) {
 	}()
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error while reading request body: %v\n", err)
+		logger.Error(r.Context(), "could not read request body", "error", err)
 	}
 	return string(body), err
 }
@@ -0,0 +1,316 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/logger"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultBaseDelay   = time.Second
+	defaultMaxDelay    = time.Hour
+	defaultTimeout     = 10 * time.Second
+	defaultWorkers     = 4
+	// eventBuffer bounds the events waiting to be queued; events are dropped rather than blocking the publisher
+	eventBuffer = 1024
+)
+
+// Option customizes the dispatcher built by NewDispatcher
+type Option func(*Dispatcher)
+
+// WithClient sets the HTTP client deliveries are sent with; its timeout bounds a single attempt
+func WithClient(client *http.Client) Option {
+	return func(d *Dispatcher) {
+		d.client = client
+	}
+}
+
+// WithRetries sets how many attempts a delivery gets before it is dead-lettered
+// and the delays between them, which double from baseDelay up to maxDelay
+func WithRetries(maxAttempts int, baseDelay, maxDelay time.Duration) Option {
+	return func(d *Dispatcher) {
+		d.maxAttempts = maxAttempts
+		d.baseDelay = baseDelay
+		d.maxDelay = maxDelay
+	}
+}
+
+// WithWorkers sets how many deliveries are sent concurrently
+func WithWorkers(workers int) Option {
+	return func(d *Dispatcher) {
+		d.workers = workers
+	}
+}
+
+// Dispatcher is an events.Publisher delivering events to webhook subscriptions in the background
+type Dispatcher struct {
+	subscriptions map[string]Subscription
+	order         []string
+	queue         Queue
+	client        *http.Client
+	maxAttempts   int
+	baseDelay     time.Duration
+	maxDelay      time.Duration
+	workers       int
+
+	events chan events.Event
+	ready  chan Delivery
+	done   chan struct{}
+	timers map[string]*time.Timer
+	mtx    sync.Mutex
+	wg     sync.WaitGroup
+	once   sync.Once
+}
+
+var _ events.Publisher = &Dispatcher{}
+
+// NewDispatcher starts delivering events to the subscriptions, resuming the deliveries left in the queue
+func NewDispatcher(subscriptions []Subscription, queue Queue, opts ...Option) *Dispatcher {
+	d := &Dispatcher{
+		subscriptions: make(map[string]Subscription),
+		queue:         queue,
+		client:        &http.Client{Timeout: defaultTimeout},
+		maxAttempts:   defaultMaxAttempts,
+		baseDelay:     defaultBaseDelay,
+		maxDelay:      defaultMaxDelay,
+		workers:       defaultWorkers,
+		events:        make(chan events.Event, eventBuffer),
+		done:          make(chan struct{}),
+		timers:        make(map[string]*time.Timer),
+	}
+	for _, s := range subscriptions {
+		d.subscriptions[s.ID] = s
+		d.order = append(d.order, s.ID)
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.ready = make(chan Delivery, d.workers)
+
+	pending, err := queue.Pending()
+	if err != nil {
+		logger.Error(context.Background(), "could not read pending webhook deliveries", "error", err)
+	}
+	for _, delivery := range pending {
+		d.schedule(delivery)
+	}
+
+	d.wg.Add(1 + d.workers)
+	go d.enqueueEvents()
+	for i := 0; i < d.workers; i++ {
+		go d.deliverReady()
+	}
+	return d
+}
+
+// Publish queues the event for the subscriptions accepting it without waiting for the queue to be written
+func (d *Dispatcher) Publish(ctx context.Context, event events.Event) {
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	select {
+	case d.events <- event:
+	default:
+		logger.Warn(ctx, "webhook event is dropped, too many events are waiting", "event", event.ID, "type", event.Type)
+	}
+}
+
+// Close stops the dispatcher, waiting for deliveries in flight until the context is done, then closes
+// the queue if it is an io.Closer. Published events are still queued, so that they are delivered after a restart
+func (d *Dispatcher) Close(ctx context.Context) error {
+	d.once.Do(func() {
+		close(d.done)
+		d.mtx.Lock()
+		for id, timer := range d.timers {
+			timer.Stop()
+			delete(d.timers, id)
+		}
+		d.mtx.Unlock()
+	})
+	stopped := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// deliveries in flight still write to the queue
+		return ctx.Err()
+	}
+	if closer, ok := d.queue.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (d *Dispatcher) enqueueEvents() {
+	defer d.wg.Done()
+	for {
+		select {
+		case event := <-d.events:
+			d.enqueue(event, true)
+		case <-d.done:
+			for {
+				select {
+				case event := <-d.events:
+					d.enqueue(event, false)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (d *Dispatcher) enqueue(event events.Event, schedule bool) {
+	ctx := context.Background()
+	payload, err := json.Marshal(event)
+	if err != nil {
+		logger.Error(ctx, "could not marshal webhook event", "event", event.ID, "error", err)
+		return
+	}
+	for _, id := range d.order {
+		if !d.subscriptions[id].Accepts(event.Type) {
+			continue
+		}
+		delivery := Delivery{
+			ID:             event.ID + "-" + id,
+			SubscriptionID: id,
+			EventType:      event.Type,
+			Payload:        payload,
+			NextAttempt:    time.Now().UTC(),
+		}
+		if err := d.queue.Push(delivery); err != nil {
+			logger.Error(ctx, "could not queue webhook delivery", "delivery", delivery.ID, "error", err)
+			continue
+		}
+		if schedule {
+			d.schedule(delivery)
+		}
+	}
+}
+
+// schedule hands the delivery to the workers when its next attempt is due
+func (d *Dispatcher) schedule(delivery Delivery) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	select {
+	case <-d.done:
+		return
+	default:
+	}
+	d.timers[delivery.ID] = time.AfterFunc(time.Until(delivery.NextAttempt), func() {
+		d.mtx.Lock()
+		delete(d.timers, delivery.ID)
+		d.mtx.Unlock()
+		select {
+		case d.ready <- delivery:
+		case <-d.done:
+		}
+	})
+}
+
+func (d *Dispatcher) deliverReady() {
+	defer d.wg.Done()
+	for {
+		select {
+		case delivery := <-d.ready:
+			d.deliver(delivery)
+		case <-d.done:
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) deliver(delivery Delivery) {
+	ctx := context.Background()
+	subscription, ok := d.subscriptions[delivery.SubscriptionID]
+	if !ok {
+		delivery.LastError = "subscription is removed"
+		d.deadLetter(ctx, delivery)
+		return
+	}
+
+	delivery.Attempts++
+	retry, err := d.send(subscription, delivery)
+	if err == nil {
+		if err := d.queue.Done(delivery.ID); err != nil {
+			logger.Error(ctx, "could not mark webhook delivery as done", "delivery", delivery.ID, "error", err)
+		}
+		logger.Debug(ctx, "webhook is delivered", "delivery", delivery.ID, "attempts", delivery.Attempts)
+		return
+	}
+	delivery.LastError = err.Error()
+	if !retry || delivery.Attempts >= d.maxAttempts {
+		d.deadLetter(ctx, delivery)
+		return
+	}
+
+	delivery.NextAttempt = time.Now().UTC().Add(d.backoff(delivery.Attempts))
+	logger.Info(ctx, "webhook delivery failed, retrying", "delivery", delivery.ID, "attempts", delivery.Attempts,
+		"next_attempt", delivery.NextAttempt, "error", err)
+	if err := d.queue.Push(delivery); err != nil {
+		logger.Error(ctx, "could not requeue webhook delivery", "delivery", delivery.ID, "error", err)
+	}
+	d.schedule(delivery)
+}
+
+// send posts the signed payload; it tells whether a failed attempt is worth retrying:
+// network errors, `408`, `429` and `5xx` responses are, other responses are not
+func (d *Dispatcher) send(subscription Subscription, delivery Delivery) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("User-Agent", "shortener-webhook")
+	request.Header.Set(EventHeader, string(delivery.EventType))
+	request.Header.Set(DeliveryHeader, delivery.ID)
+	request.Header.Set(SignatureHeader, Sign([]byte(subscription.Secret), time.Now(), delivery.Payload))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(response.Body, 64<<10))
+	_ = response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("receiver responded with %s", response.Status)
+}
+
+func (d *Dispatcher) deadLetter(ctx context.Context, delivery Delivery) {
+	logger.Warn(ctx, "webhook delivery is dead-lettered", "delivery", delivery.ID, "attempts", delivery.Attempts, "error", delivery.LastError)
+	if err := d.queue.DeadLetter(delivery); err != nil {
+		logger.Error(ctx, "could not dead-letter webhook delivery", "delivery", delivery.ID, "error", err)
+	}
+}
+
+// backoff doubles the delay with every attempt and spreads it by up to a fifth either way,
+// so that deliveries failed together are not retried together
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	delay := d.baseDelay
+	for i := 1; i < attempts && delay < d.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.maxDelay {
+		delay = d.maxDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/5*2+1)) - delay/5
+	return delay + jitter
+}
@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	opPush = ""
+	opDone = "done"
+
+	// minCompactionRecords keeps small logs from being rewritten too often
+	minCompactionRecords = 1024
+)
+
+// FileQueue is a Queue kept in a JSON-lines log of pushed and finished deliveries, which is compacted
+// when it grows much longer than the pending deliveries. Dead letters are appended to a separate file
+// with the `.dead` suffix
+type FileQueue struct {
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	pending map[string]Delivery
+	records int
+	mtx     sync.Mutex
+}
+
+var _ Queue = &FileQueue{}
+
+type queueRecord struct {
+	Op       string    `json:"op,omitempty"`
+	ID       string    `json:"id"`
+	Delivery *Delivery `json:"delivery,omitempty"`
+}
+
+func NewFileQueue(path string) (*FileQueue, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	q := &FileQueue{path: path, pending: make(map[string]Delivery)}
+	if err := q.replay(); err != nil {
+		return nil, err
+	}
+	if err := q.compact(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *FileQueue) Push(delivery Delivery) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.pending[delivery.ID] = delivery
+	return q.write(queueRecord{ID: delivery.ID, Delivery: &delivery})
+}
+
+func (q *FileQueue) Done(id string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.pending, id)
+	return q.write(queueRecord{Op: opDone, ID: id})
+}
+
+func (q *FileQueue) DeadLetter(delivery Delivery) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	file, err := os.OpenFile(q.path+".dead", os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(file).Encode(delivery); err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	delete(q.pending, delivery.ID)
+	return q.write(queueRecord{Op: opDone, ID: delivery.ID})
+}
+
+func (q *FileQueue) Pending() ([]Delivery, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return sortedDeliveries(q.pending), nil
+}
+
+// Close closes the log; the queue must not be used afterwards
+func (q *FileQueue) Close() error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return q.file.Close()
+}
+
+func (q *FileQueue) replay() error {
+	file, err := os.Open(q.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var record queueRecord
+		if err := decoder.Decode(&record); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			// a torn last line is left by a crash in the middle of a write
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		switch record.Op {
+		case opPush:
+			if record.Delivery != nil {
+				q.pending[record.ID] = *record.Delivery
+			}
+		case opDone:
+			delete(q.pending, record.ID)
+		}
+	}
+}
+
+func (q *FileQueue) write(record queueRecord) error {
+	if err := q.encoder.Encode(record); err != nil {
+		return err
+	}
+	q.records++
+	if q.records > minCompactionRecords && q.records > 2*len(q.pending) {
+		return q.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log with the pending deliveries only, replacing it atomically
+func (q *FileQueue) compact() error {
+	tmp := q.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	pending := sortedDeliveries(q.pending)
+	for i := range pending {
+		if err := encoder.Encode(queueRecord{ID: pending[i].ID, Delivery: &pending[i]}); err != nil {
+			_ = file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, q.path); err != nil {
+		return err
+	}
+
+	if q.file != nil {
+		_ = q.file.Close()
+	}
+	q.file, err = os.OpenFile(q.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	q.encoder = json.NewEncoder(q.file)
+	q.records = len(pending)
+	return nil
+}
@@ -0,0 +1,95 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tsupko/shortener/internal/app/events"
+)
+
+// Delivery is an event on its way to a subscription
+type Delivery struct {
+	ID             string          `json:"id"`
+	SubscriptionID string          `json:"subscription_id"`
+	EventType      events.Type     `json:"event_type"`
+	Payload        json.RawMessage `json:"payload"`
+	Attempts       int             `json:"attempts,omitempty"`
+	NextAttempt    time.Time       `json:"next_attempt"`
+	LastError      string          `json:"last_error,omitempty"`
+}
+
+// Queue keeps deliveries until they succeed, so that they survive restarts
+type Queue interface {
+	// Push stores a new delivery or replaces a rescheduled one
+	Push(delivery Delivery) error
+	// Done removes a successful delivery
+	Done(id string) error
+	// DeadLetter removes a delivery which is not retried anymore and keeps it for inspection
+	DeadLetter(delivery Delivery) error
+	// Pending returns the deliveries to resume, the earliest due first
+	Pending() ([]Delivery, error)
+}
+
+// MemoryQueue is a Queue which does not survive restarts
+type MemoryQueue struct {
+	pending map[string]Delivery
+	dead    []Delivery
+	mtx     sync.Mutex
+}
+
+var _ Queue = &MemoryQueue{}
+
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{pending: make(map[string]Delivery)}
+}
+
+func (q *MemoryQueue) Push(delivery Delivery) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	q.pending[delivery.ID] = delivery
+	return nil
+}
+
+func (q *MemoryQueue) Done(id string) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.pending, id)
+	return nil
+}
+
+func (q *MemoryQueue) DeadLetter(delivery Delivery) error {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	delete(q.pending, delivery.ID)
+	q.dead = append(q.dead, delivery)
+	return nil
+}
+
+func (q *MemoryQueue) Pending() ([]Delivery, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return sortedDeliveries(q.pending), nil
+}
+
+// Dead returns the dead-lettered deliveries
+func (q *MemoryQueue) Dead() []Delivery {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	return append([]Delivery(nil), q.dead...)
+}
+
+func sortedDeliveries(deliveries map[string]Delivery) []Delivery {
+	result := make([]Delivery, 0, len(deliveries))
+	for _, delivery := range deliveries {
+		result = append(result, delivery)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].NextAttempt.Equal(result[j].NextAttempt) {
+			return result[i].NextAttempt.Before(result[j].NextAttempt)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
@@ -0,0 +1,77 @@
+// Package webhook delivers link events to the HTTP endpoints of subscribers. Deliveries are signed with HMAC-SHA256,
+// kept in a persistent queue and retried with exponential backoff until they succeed or are dead-lettered
+package webhook
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/tsupko/shortener/internal/app/events"
+)
+
+// Subscription is an endpoint receiving the events of the listed types, or of all types when none are listed
+type Subscription struct {
+	// ID identifies the subscription in the queue, it defaults to the URL
+	ID     string        `json:"id,omitempty"`
+	URL    string        `json:"url"`
+	Secret string        `json:"secret"`
+	Events []events.Type `json:"events,omitempty"`
+}
+
+// Accepts tells whether the subscription receives events of the type
+func (s Subscription) Accepts(eventType events.Type) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, t := range s.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadSubscriptions reads a JSON array of subscriptions
+func LoadSubscriptions(path string) ([]Subscription, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []Subscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, fmt.Errorf("could not parse webhook subscriptions %s: %w", path, err)
+	}
+	if err := ValidateSubscriptions(subscriptions); err != nil {
+		return nil, err
+	}
+	return subscriptions, nil
+}
+
+// ValidateSubscriptions checks the subscriptions and fills in their default IDs
+func ValidateSubscriptions(subscriptions []Subscription) error {
+	ids := make(map[string]bool)
+	for i := range subscriptions {
+		s := &subscriptions[i]
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook subscription %d: URL must be an absolute HTTP(S) URL", i)
+		}
+		if s.Secret == "" {
+			return fmt.Errorf("webhook subscription %d: secret is required", i)
+		}
+		for _, t := range s.Events {
+			if _, err := events.ParseType(string(t)); err != nil {
+				return fmt.Errorf("webhook subscription %d: %w", i, err)
+			}
+		}
+		if s.ID == "" {
+			s.ID = s.URL
+		}
+		if ids[s.ID] {
+			return fmt.Errorf("webhook subscription %d: duplicate ID %q", i, s.ID)
+		}
+		ids[s.ID] = true
+	}
+	return nil
+}
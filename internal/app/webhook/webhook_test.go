@@ -0,0 +1,193 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tsupko/shortener/internal/app/events"
+	"github.com/tsupko/shortener/internal/app/storage"
+)
+
+type receiver struct {
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+	received chan struct{}
+	mtx      sync.Mutex
+}
+
+func newReceiver(statuses ...int) (*receiver, *httptest.Server) {
+	r := &receiver{statuses: statuses, received: make(chan struct{}, 100)}
+	return r, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, request *http.Request) {
+		body, _ := io.ReadAll(request.Body)
+		r.mtx.Lock()
+		status := http.StatusOK
+		if n := len(r.requests); n < len(r.statuses) {
+			status = r.statuses[n]
+		}
+		r.requests = append(r.requests, request)
+		r.bodies = append(r.bodies, body)
+		r.mtx.Unlock()
+		w.WriteHeader(status)
+		r.received <- struct{}{}
+	}))
+}
+
+func (r *receiver) wait(t *testing.T, n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case <-r.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d requests", i, n)
+		}
+	}
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition is not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDeliveryIsSignedAndFiltered(t *testing.T) {
+	r, ts := newReceiver()
+	defer ts.Close()
+	queue := NewMemoryQueue()
+	d := NewDispatcher([]Subscription{{ID: "clicks", URL: ts.URL, Secret: "secret", Events: []events.Type{events.LinkClicked}}}, queue)
+	defer d.Close(context.Background())
+
+	d.Publish(context.Background(), events.New(events.LinkCreated, storage.Link{ID: "skipped"}))
+	d.Publish(context.Background(), events.New(events.LinkClicked, storage.Link{ID: "abc", URL: "https://ya.ru"}))
+	r.wait(t, 1)
+
+	request, body := r.requests[0], r.bodies[0]
+	assert.Equal(t, string(events.LinkClicked), request.Header.Get(EventHeader))
+	assert.NotEmpty(t, request.Header.Get(DeliveryHeader))
+	assert.NoError(t, Verify([]byte("secret"), request.Header.Get(SignatureHeader), body, time.Now(), time.Minute))
+	assert.ErrorIs(t, Verify([]byte("other"), request.Header.Get(SignatureHeader), body, time.Now(), time.Minute), ErrInvalidSignature)
+	var event events.Event
+	require.NoError(t, json.Unmarshal(body, &event))
+	assert.Equal(t, "abc", event.Link.ID)
+
+	waitFor(t, func() bool {
+		pending, _ := queue.Pending()
+		return len(pending) == 0
+	})
+	select {
+	case <-r.received:
+		t.Fatal("filtered event is delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDeliveryIsRetriedThenDeadLettered(t *testing.T) {
+	r, ts := newReceiver(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	defer ts.Close()
+	queue := NewMemoryQueue()
+	d := NewDispatcher([]Subscription{{ID: "all", URL: ts.URL, Secret: "secret"}}, queue, WithRetries(3, time.Millisecond, 10*time.Millisecond))
+	defer d.Close(context.Background())
+
+	d.Publish(context.Background(), events.New(events.LinkCreated, storage.Link{ID: "retried"}))
+	r.wait(t, 3)
+	assert.Equal(t, r.requests[0].Header.Get(DeliveryHeader), r.requests[2].Header.Get(DeliveryHeader))
+
+	d.Publish(context.Background(), events.New(events.LinkCreated, storage.Link{ID: "rejected"}))
+	r.wait(t, 1)
+	waitFor(t, func() bool { return len(queue.Dead()) == 1 })
+	dead := queue.Dead()[0]
+	assert.Equal(t, 1, dead.Attempts, "client errors are not retried")
+	assert.Contains(t, dead.LastError, "400")
+}
+
+func TestBackoffIsBounded(t *testing.T) {
+	d := &Dispatcher{baseDelay: time.Second, maxDelay: time.Minute}
+	assert.InDelta(t, time.Second, d.backoff(1), float64(time.Second/5))
+	assert.InDelta(t, 4*time.Second, d.backoff(3), float64(4*time.Second/5))
+	assert.InDelta(t, time.Minute, d.backoff(30), float64(time.Minute/5))
+}
+
+func TestCloseKeepsQueuedDeliveries(t *testing.T) {
+	r, ts := newReceiver(http.StatusServiceUnavailable)
+	defer ts.Close()
+	path := filepath.Join(t.TempDir(), "webhooks")
+	queue, err := NewFileQueue(path)
+	require.NoError(t, err)
+	d := NewDispatcher([]Subscription{{ID: "all", URL: ts.URL, Secret: "secret"}}, queue, WithRetries(3, time.Hour, time.Hour))
+
+	d.Publish(context.Background(), events.New(events.LinkCreated, storage.Link{ID: "retried"}))
+	r.wait(t, 1)
+	require.NoError(t, d.Close(context.Background()))
+	assert.ErrorIs(t, queue.Close(), os.ErrClosed, "the queue is closed with the dispatcher")
+
+	reopened, err := NewFileQueue(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	pending, err := reopened.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, 1, pending[0].Attempts)
+}
+
+func TestFileQueueSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks")
+	queue, err := NewFileQueue(path)
+	require.NoError(t, err)
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, queue.Push(Delivery{ID: id, SubscriptionID: "s", Payload: json.RawMessage(`{}`)}))
+	}
+	require.NoError(t, queue.Done("a"))
+	require.NoError(t, queue.Push(Delivery{ID: "b", SubscriptionID: "s", Payload: json.RawMessage(`{}`), Attempts: 2}))
+	require.NoError(t, queue.DeadLetter(Delivery{ID: "c", SubscriptionID: "s", Payload: json.RawMessage(`{}`)}))
+	require.NoError(t, queue.Close())
+
+	reopened, err := NewFileQueue(path)
+	require.NoError(t, err)
+	defer reopened.Close()
+	pending, err := reopened.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "b", pending[0].ID)
+	assert.Equal(t, 2, pending[0].Attempts)
+}
+
+func TestPendingDeliveriesAreResumed(t *testing.T) {
+	r, ts := newReceiver()
+	defer ts.Close()
+	queue := NewMemoryQueue()
+	require.NoError(t, queue.Push(Delivery{ID: "left", SubscriptionID: "all", EventType: events.LinkDeleted, Payload: json.RawMessage(`{}`)}))
+
+	d := NewDispatcher([]Subscription{{ID: "all", URL: ts.URL, Secret: "secret"}}, queue)
+	defer d.Close(context.Background())
+	r.wait(t, 1)
+	assert.Equal(t, "left", r.requests[0].Header.Get(DeliveryHeader))
+}
+
+func TestValidateSubscriptions(t *testing.T) {
+	subscriptions := []Subscription{{URL: "https://example.com/hook", Secret: "s"}}
+	assert.NoError(t, ValidateSubscriptions(subscriptions))
+	assert.Equal(t, "https://example.com/hook", subscriptions[0].ID)
+
+	for _, invalid := range [][]Subscription{
+		{{URL: "ftp://example.com", Secret: "s"}},
+		{{URL: "https://example.com"}},
+		{{URL: "https://example.com", Secret: "s", Events: []events.Type{"link.renamed"}}},
+		{{URL: "https://example.com", Secret: "s"}, {URL: "https://example.com", Secret: "t"}},
+	} {
+		assert.Error(t, ValidateSubscriptions(invalid))
+	}
+}